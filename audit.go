@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"time"
+
+	"mongodb_backup/pkg/backup"
+)
+
+// auditStoreTimeout bounds how long storing an audit entry may delay the
+// action it records.
+const auditStoreTimeout = 30 * time.Second
+
+// audit logs entry as an "audit" record and stores it below AUDIT_PREFIX.
+// Failing to store it is logged, the action goes ahead.
+func audit(ctx context.Context, cfg appConfig, entry backup.AuditEntry) {
+	entry.Time = time.Now().UTC()
+	logger.Info("audit", "action", entry.Action, "principal", entry.Principal, "source", entry.Source,
+		"outcome", entry.Outcome, "run_id", entry.RunID, "label", entry.Label, "key", entry.Key,
+		"databases", entry.Databases, "error", entry.Error)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditStoreTimeout)
+	defer cancel()
+	if err := backup.StoreAuditEntry(ctx, cfg.Backup, entry); err != nil {
+		logger.Error("failed to store audit entry", "action", entry.Action, "error", err)
+	}
+}
+
+// requestAudit starts the audit entry of an HTTP request. The principal is
+// the AUDIT_PRINCIPAL_HEADER a proxy sets after authenticating the
+// caller, or the basic auth user, or "anonymous".
+func requestAudit(r *http.Request, cfg appConfig, action string) backup.AuditEntry {
+	principal := "anonymous"
+	if v := r.Header.Get(cfg.AuditPrincipalHeader); cfg.AuditPrincipalHeader != "" && v != "" {
+		principal = v
+	} else if name, _, ok := r.BasicAuth(); ok && name != "" {
+		principal = name
+	}
+	source := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	return backup.AuditEntry{Action: action, Principal: principal, Source: source}
+}
+
+// commandAudit starts the audit entry of a subcommand, run by the OS user
+// on this host.
+func commandAudit(action string) backup.AuditEntry {
+	principal := "unknown"
+	if u, err := user.Current(); err == nil {
+		principal = u.Username
+	}
+	host, _ := os.Hostname()
+	return backup.AuditEntry{Action: action, Principal: principal, Source: host}
+}
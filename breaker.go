@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker stops backups from hammering an unreachable cluster. After
+// threshold consecutive connection failures it opens for cooldown, then lets
+// a single run through (half-open) to probe whether the cluster is back.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     string
+	openedAt  time.Time
+}
+
+// BreakerStatus is the breaker state reported by /status.
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenUntil           *time.Time `json:"open_until,omitempty"`
+}
+
+var mongoBreaker = newCircuitBreaker(3, 15*time.Minute)
+
+// newCircuitBreaker returns a closed breaker. A threshold of 0 disables it.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, state: breakerClosed}
+}
+
+// allow reports whether a run may try to connect. It returns the time the
+// breaker stays open until when it refuses.
+func (b *circuitBreaker) allow() (bool, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen {
+		return true, time.Time{}
+	}
+	until := b.openedAt.Add(b.cooldown)
+	if time.Now().Before(until) {
+		return false, until
+	}
+	b.state = breakerHalfOpen
+	return true, time.Time{}
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.state = breakerClosed
+}
+
+// failure records a connection failure and reports whether it opened the
+// breaker.
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.threshold <= 0 {
+		return false
+	}
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+func (b *circuitBreaker) snapshot() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BreakerStatus{State: b.state, ConsecutiveFailures: b.failures}
+	if b.state == breakerOpen {
+		until := b.openedAt.Add(b.cooldown)
+		s.OpenUntil = &until
+	}
+	return s
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/viper"
+
+	"mongodb_backup/pkg/backup"
+)
+
+// appConfig is the backup library's Config plus the settings that only
+// concern the long-running service.
+type appConfig struct {
+	Backup backup.Config
+
+	Port             string
+	Schedule         string
+	OverlapPolicy    string
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// RunMaxRetries is how often a failed run is attempted again,
+	// RunRetryDelay apart, before it is reported as failed.
+	RunMaxRetries int
+	RunRetryDelay time.Duration
+
+	// HealthcheckPingURL is pinged after every run, see pingHealthcheck.
+	HealthcheckPingURL string
+	// LogTailSize is how many bytes of a run's last log lines the ping
+	// carries; 0 sends none.
+	LogTailSize int
+
+	// MaxBackupAge makes /healthz unhealthy once the last successful
+	// backup is older; 0 keeps it a liveness check.
+	MaxBackupAge time.Duration
+
+	// StorageMetricsInterval is how often storage usage is measured for
+	// /metrics, in addition to after every run.
+	StorageMetricsInterval time.Duration
+
+	// TracingEndpoint is the OTLP/HTTP base URL backup runs are traced
+	// to, see startTracing; empty disables tracing.
+	TracingEndpoint    string
+	TracingServiceName string
+
+	// AuditPrincipalHeader names the request header an authenticating
+	// proxy puts the caller's identity in, e.g. X-Forwarded-User.
+	AuditPrincipalHeader string
+}
+
+// LoadConfig reads the config file, the environment and the command-line
+// flags once at startup. It is the only place that talks to viper; every
+// key it reads must also be listed in configKeys.
+func LoadConfig() (appConfig, error) {
+	var cfg appConfig
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		path = ".env"
+	}
+
+	data, err := readConfigFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("error loading %s: %w", path, err)
+	}
+
+	viper.SetConfigType("env")
+	viper.AutomaticEnv()
+	if err := bindConfigFlags(); err != nil {
+		return cfg, err
+	}
+	if err := viper.ReadConfig(bytes.NewReader(data)); err != nil {
+		return cfg, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	// The profile of APP_ENV is layered over the base file; the
+	// environment and flags still win over both
+	if env := os.Getenv("APP_ENV"); env != "" {
+		profile, err := profilePath(path, env)
+		if err != nil {
+			return cfg, err
+		}
+		data, err := readConfigFile(profile)
+		if errors.Is(err, fs.ErrNotExist) {
+			return cfg, fmt.Errorf("APP_ENV=%s: profile %s not found", env, profile)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("error loading %s: %w", profile, err)
+		}
+		if err := viper.MergeConfig(bytes.NewReader(data)); err != nil {
+			return cfg, fmt.Errorf("error parsing %s: %w", profile, err)
+		}
+	}
+
+	b := backup.DefaultConfig()
+	b.Mongo = backup.MongoConfig{
+		Username:   viper.GetString("MONGO_USERNAME"),
+		Password:   viper.GetString("MONGO_PASSWORD"),
+		ClusterURI: viper.GetString("MONGO_CLUSTER_URI"),
+
+		ConnectTimeout: durationOr("MONGO_CONNECT_TIMEOUT", b.Mongo.ConnectTimeout),
+		ListTimeout:    durationOr("MONGO_LIST_TIMEOUT", b.Mongo.ListTimeout),
+	}
+	if viper.IsSet("FAILOVER_GRACE") {
+		b.FailoverGrace = viper.GetDuration("FAILOVER_GRACE")
+	}
+	b.Timeouts = backup.StageTimeouts{
+		Dump:    durationOr("DUMP_TIMEOUT", 0),
+		Archive: durationOr("ARCHIVE_TIMEOUT", 0),
+		Upload:  durationOr("UPLOAD_TIMEOUT", 0),
+	}
+	b.AWS = backup.AWSConfig{
+		Region:          viper.GetString("AWS_REGION"),
+		AccessKeyID:     viper.GetString("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: viper.GetString("AWS_SECRET_ACCESS_KEY"),
+		Bucket:          viper.GetString("AWS_BUCKET_NAME"),
+		Timeout:         durationOr("S3_TIMEOUT", b.AWS.Timeout),
+		PartSize:        b.AWS.PartSize,
+		UploadAttempts:  b.AWS.UploadAttempts,
+		StaleUploadAge:  b.AWS.StaleUploadAge,
+	}
+	if viper.IsSet("S3_PART_SIZE_MB") {
+		b.AWS.PartSize = viper.GetInt64("S3_PART_SIZE_MB") << 20
+	}
+	if n := viper.GetInt("S3_UPLOAD_ATTEMPTS"); n > 0 {
+		b.AWS.UploadAttempts = n
+	}
+	b.AWS.UploadBufferSize = viper.GetInt("S3_UPLOAD_BUFFER_KB") << 10
+	b.AWS.ObjectACL = viper.GetString("S3_OBJECT_ACL")
+	if err := backup.CheckObjectACL(b.AWS.ObjectACL); err != nil {
+		return cfg, fmt.Errorf("invalid S3_OBJECT_ACL: %w", err)
+	}
+	b.AWS.ContentMD5 = viper.GetBool("S3_CONTENT_MD5")
+	b.AWS.CreateBucket = viper.GetBool("CREATE_BUCKET_IF_MISSING")
+	if viper.IsSet("S3_STALE_UPLOAD_AGE") {
+		b.AWS.StaleUploadAge = viper.GetDuration("S3_STALE_UPLOAD_AGE")
+	}
+	if b.AWS.AbortIncompleteDays = viper.GetInt("S3_ABORT_INCOMPLETE_DAYS"); b.AWS.AbortIncompleteDays < 0 {
+		return cfg, fmt.Errorf("invalid S3_ABORT_INCOMPLETE_DAYS %d (expected days, 0 disables)", b.AWS.AbortIncompleteDays)
+	}
+	b.SFTP = backup.SFTPConfig{
+		Host:                 viper.GetString("SFTP_HOST"),
+		User:                 viper.GetString("SFTP_USER"),
+		Path:                 viper.GetString("SFTP_PATH"),
+		Password:             viper.GetString("SFTP_PASSWORD"),
+		PrivateKeyFile:       viper.GetString("SFTP_PRIVATE_KEY_FILE"),
+		PrivateKeyPassphrase: viper.GetString("SFTP_PRIVATE_KEY_PASSPHRASE"),
+		KnownHostsFile:       viper.GetString("SFTP_KNOWN_HOSTS"),
+		Timeout:              viper.GetDuration("SFTP_TIMEOUT"),
+	}
+	if name := viper.GetString("CLUSTER_NAME"); name != "" {
+		if b.ClusterName = backup.SanitizeClusterName(name); b.ClusterName == "" {
+			return cfg, fmt.Errorf("invalid CLUSTER_NAME %q: use letters, digits and dashes", name)
+		}
+	}
+	if b.AppVersion = viper.GetString("APP_VERSION"); b.AppVersion != "" {
+		if err := backup.ValidateAppVersion(b.AppVersion); err != nil {
+			return cfg, fmt.Errorf("APP_VERSION: %w", err)
+		}
+	}
+	b.OutputDir = stringOr("BACKUP_OUTPUT_DIR", b.OutputDir)
+	b.StateDir = stringOr("STATE_DIR", b.StateDir)
+	if umask := viper.GetString("BACKUP_UMASK"); umask != "" {
+		n, err := strconv.ParseUint(umask, 8, 32)
+		if err != nil || n > 0o777 {
+			return cfg, fmt.Errorf("invalid BACKUP_UMASK %q (expected an octal mask such as 077)", umask)
+		}
+		b.Umask = os.FileMode(n)
+	}
+	b.ChangedOnly = viper.GetBool("BACKUP_CHANGED_ONLY")
+	b.SkipEmpty = viper.GetBool("SKIP_EMPTY_DBS")
+	if b.MaxDatabases = viper.GetInt("MAX_DATABASES"); b.MaxDatabases < 0 {
+		return cfg, fmt.Errorf("invalid MAX_DATABASES %d (expected a count, 0 dumps every database)", b.MaxDatabases)
+	}
+	b.DBDelay = viper.GetDuration("BACKUP_DB_DELAY")
+	b.Verify = viper.GetBool("BACKUP_VERIFY")
+	b.DumpLogs = viper.GetBool("UPLOAD_DUMP_LOGS")
+	b.IndexSpecs = viper.GetBool("EXPORT_INDEX_SPECS")
+	b.RestoreScripts = viper.GetBool("RESTORE_SCRIPTS")
+	b.Strict = viper.GetBool("STRICT_MODE")
+	if b.DumpArgs, err = backup.ParseDumpArgs(viper.GetString("MONGODUMP_EXTRA_ARGS")); err != nil {
+		return cfg, fmt.Errorf("invalid MONGODUMP_EXTRA_ARGS: %w", err)
+	}
+	if b.DumpQueries, err = backup.ParseDumpQueries(viper.GetString("MONGODUMP_QUERIES")); err != nil {
+		return cfg, fmt.Errorf("invalid MONGODUMP_QUERIES: %w", err)
+	}
+	b.Engine = strings.ToLower(stringOr("BACKUP_ENGINE", b.Engine))
+	switch b.Engine {
+	case backup.EngineMongodump:
+	case backup.EngineNative:
+		if len(b.DumpArgs) > 0 {
+			return cfg, errors.New("MONGODUMP_EXTRA_ARGS needs BACKUP_ENGINE=mongodump")
+		}
+	default:
+		return cfg, fmt.Errorf("invalid BACKUP_ENGINE %q (expected mongodump or native)", b.Engine)
+	}
+	b.Split = backup.SplitConfig{
+		Documents: max(viper.GetInt64("NATIVE_SPLIT_DOCUMENTS"), 0),
+		Bytes:     max(viper.GetInt64("NATIVE_SPLIT_SIZE_MB"), 0) << 20,
+	}
+	if b.Split != (backup.SplitConfig{}) && b.Engine != backup.EngineNative {
+		return cfg, errors.New("NATIVE_SPLIT_DOCUMENTS and NATIVE_SPLIT_SIZE_MB need BACKUP_ENGINE=native")
+	}
+	b.Archive.Format = strings.ToLower(stringOr("ARCHIVE_FORMAT", b.Archive.Format))
+	if err := backup.CheckArchiveFormat(b.Archive.Format); err != nil {
+		return cfg, fmt.Errorf("invalid ARCHIVE_FORMAT: %w", err)
+	}
+	// COMPRESSION_ALGO=brotli is another name for ARCHIVE_FORMAT=tar.br;
+	// the other compressions are only picked through ARCHIVE_FORMAT
+	switch algo := strings.ToLower(viper.GetString("COMPRESSION_ALGO")); algo {
+	case "":
+	case "brotli":
+		if format := viper.GetString("ARCHIVE_FORMAT"); format != "" && b.Archive.Format != backup.FormatTarBr {
+			return cfg, fmt.Errorf("COMPRESSION_ALGO=brotli conflicts with ARCHIVE_FORMAT=%s", format)
+		}
+		b.Archive.Format = backup.FormatTarBr
+	default:
+		return cfg, fmt.Errorf("invalid COMPRESSION_ALGO %q (expected brotli; choose other compressions with ARCHIVE_FORMAT)", algo)
+	}
+	if n := viper.GetInt("COMPRESSION_PARALLELISM"); n > 0 {
+		b.Archive.Parallelism = n
+	}
+	switch level := strings.ToLower(viper.GetString("COMPRESSION_LEVEL")); level {
+	case "":
+	case "auto":
+		b.Archive.AutoLevel = true
+	default:
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 1 || n > 9 {
+			return cfg, fmt.Errorf("invalid COMPRESSION_LEVEL %q (expected 1 to 9 or auto)", level)
+		}
+		b.Archive.Level = n
+	}
+	if b.Archive.StorePatterns, err = globsOf("ZIP_STORE_PATTERNS"); err != nil {
+		return cfg, err
+	}
+	// pgzip keeps a 16 KiB tail of every block for the next one
+	b.Archive.BlockSize = viper.GetInt("COMPRESSION_BLOCK_SIZE_KB") << 10
+	if b.Archive.BlockSize != 0 && b.Archive.BlockSize <= 16<<10 {
+		return cfg, fmt.Errorf("invalid COMPRESSION_BLOCK_SIZE_KB %d (expected more than 16)", b.Archive.BlockSize>>10)
+	}
+	b.Archive.CopyBufferSize = viper.GetInt("COMPRESSION_BUFFER_KB") << 10
+	if viper.IsSet("ARCHIVE_COMMENT") {
+		b.Archive.Comment = viper.GetBool("ARCHIVE_COMMENT")
+	}
+	b.Archive.PerDatabase = viper.GetBool("ARCHIVE_PER_DATABASE")
+	b.LocalArchive.Keep = viper.GetBool("KEEP_LOCAL_ARCHIVE")
+	b.LocalArchive.Dir = stringOr("LOCAL_ARCHIVE_DIR", b.LocalArchive.Dir)
+	if viper.IsSet("LOCAL_ARCHIVE_COUNT") {
+		b.LocalArchive.Count = viper.GetInt("LOCAL_ARCHIVE_COUNT")
+	}
+	// The dump folder is wiped after every run
+	if b.LocalArchive.Keep {
+		inside, err := pathInside(b.OutputDir, b.LocalArchive.Dir)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid LOCAL_ARCHIVE_DIR: %w", err)
+		}
+		if inside {
+			return cfg, fmt.Errorf("LOCAL_ARCHIVE_DIR must not be inside BACKUP_OUTPUT_DIR")
+		}
+	}
+	b.Encryption.Mode = strings.ToLower(stringOr("ENCRYPTION_MODE", b.Encryption.Mode))
+	b.Encryption.KMSKeyID = viper.GetString("KMS_KEY_ID")
+	if recipients := listOf("AGE_RECIPIENTS"); len(recipients) > 0 {
+		if b.Encryption.AgeRecipients, err = age.ParseRecipients(strings.NewReader(strings.Join(recipients, "\n"))); err != nil {
+			return cfg, fmt.Errorf("invalid AGE_RECIPIENTS: %w", err)
+		}
+	}
+	if file := viper.GetString("AGE_IDENTITY_FILE"); file != "" {
+		if b.Encryption.AgeIdentities, err = readAgeIdentities(file); err != nil {
+			return cfg, fmt.Errorf("invalid AGE_IDENTITY_FILE: %w", err)
+		}
+	}
+	switch b.Encryption.Mode {
+	case backup.EncryptionNone:
+	case backup.EncryptionKMSEnvelope:
+		if b.Encryption.KMSKeyID == "" {
+			return cfg, fmt.Errorf("ENCRYPTION_MODE=kms-envelope needs KMS_KEY_ID")
+		}
+	case backup.EncryptionAge:
+		if len(b.Encryption.AgeRecipients) == 0 {
+			return cfg, fmt.Errorf("ENCRYPTION_MODE=age needs AGE_RECIPIENTS")
+		}
+	default:
+		return cfg, fmt.Errorf("invalid ENCRYPTION_MODE %q (expected none, kms-envelope or age)", b.Encryption.Mode)
+	}
+	if command := viper.GetString("PRE_UPLOAD_CMD"); command != "" {
+		if b.Upload.PreUploadCommand, err = backup.ParseCommand(command); err != nil {
+			return cfg, fmt.Errorf("invalid PRE_UPLOAD_CMD: %w", err)
+		}
+	}
+	b.Upload.Pipeline = viper.GetBool("PIPELINE_UPLOADS")
+	if b.Upload.Pipeline && !b.Archive.PerDatabase {
+		return cfg, fmt.Errorf("PIPELINE_UPLOADS needs ARCHIVE_PER_DATABASE=true")
+	}
+	// The dictionary is trained on every dump of the run before the
+	// first archive is written
+	b.Archive.Dictionary = viper.GetBool("ZSTD_DICTIONARY")
+	switch {
+	case !b.Archive.Dictionary:
+	case b.Archive.Format != backup.FormatTarZst || !b.Archive.PerDatabase:
+		return cfg, fmt.Errorf("ZSTD_DICTIONARY needs ARCHIVE_FORMAT=tar.zst and ARCHIVE_PER_DATABASE=true")
+	case b.Upload.Pipeline:
+		return cfg, fmt.Errorf("ZSTD_DICTIONARY does not work with PIPELINE_UPLOADS")
+	}
+	if b.Archive.DictionarySize = viper.GetInt("ZSTD_DICTIONARY_SIZE_KB") << 10; b.Archive.DictionarySize < 0 {
+		return cfg, fmt.Errorf("invalid ZSTD_DICTIONARY_SIZE_KB %d (expected a positive size)", b.Archive.DictionarySize>>10)
+	}
+	if n := viper.GetInt("UPLOAD_CONCURRENCY"); n > 0 {
+		b.Upload.Concurrency = n
+	}
+	if b.Upload.BandwidthLimit = viper.GetInt64("UPLOAD_BANDWIDTH_LIMIT"); b.Upload.BandwidthLimit < 0 {
+		return cfg, fmt.Errorf("invalid UPLOAD_BANDWIDTH_LIMIT %d (expected bytes per second, 0 for unlimited)", b.Upload.BandwidthLimit)
+	}
+	if n := viper.GetInt("DATABASE_UPLOAD_ATTEMPTS"); n > 0 {
+		b.Upload.DatabaseAttempts = n
+	}
+	b.Upload.Retry.Max = durationOr("UPLOAD_RETRY_MAX_DELAY", b.Upload.Retry.Max)
+	if b.Upload.Retry.Max < b.Upload.Retry.Base {
+		return cfg, fmt.Errorf("invalid UPLOAD_RETRY_MAX_DELAY %s (expected at least %s)", b.Upload.Retry.Max, b.Upload.Retry.Base)
+	}
+	if viper.IsSet("UPLOAD_RETRY_JITTER") {
+		b.Upload.Retry.Jitter = viper.GetBool("UPLOAD_RETRY_JITTER")
+	}
+	if n := viper.GetInt("DUMP_CONCURRENCY"); n > 0 {
+		b.DumpConcurrency = n
+	}
+	// A streamed run keeps a single database on disk
+	b.Upload.Stream = viper.GetBool("STREAM_PER_DB")
+	switch {
+	case !b.Upload.Stream:
+	case !b.Archive.PerDatabase:
+		return cfg, fmt.Errorf("STREAM_PER_DB needs ARCHIVE_PER_DATABASE=true")
+	case b.Upload.Pipeline:
+		return cfg, fmt.Errorf("STREAM_PER_DB does not work with PIPELINE_UPLOADS")
+	case b.Archive.Dictionary:
+		return cfg, fmt.Errorf("ZSTD_DICTIONARY does not work with STREAM_PER_DB")
+	case b.DumpConcurrency > 1:
+		return cfg, fmt.Errorf("STREAM_PER_DB dumps one database at a time, DUMP_CONCURRENCY must be 1")
+	}
+	if n := viper.GetInt("CLEANUP_ATTEMPTS"); n > 0 {
+		b.CleanupAttempts = n
+	}
+
+	if b.IncludeDatabases, err = regexpOrNil("MONGO_INCLUDE_REGEX"); err != nil {
+		return cfg, err
+	}
+	if b.ExcludeDatabases, err = regexpOrNil("MONGO_EXCLUDE_REGEX"); err != nil {
+		return cfg, err
+	}
+	if b.DatabaseRegistry = viper.GetString("MONGO_DATABASE_REGISTRY"); b.DatabaseRegistry != "" {
+		if db, coll, ok := strings.Cut(b.DatabaseRegistry, "."); !ok || db == "" || coll == "" {
+			return cfg, fmt.Errorf("invalid MONGO_DATABASE_REGISTRY %q (expected database.collection)", b.DatabaseRegistry)
+		}
+	}
+	b.DatabaseRegistryField = viper.GetString("MONGO_DATABASE_REGISTRY_FIELD")
+	if b.Catalog.Collection = viper.GetString("CATALOG_COLLECTION"); b.Catalog.Collection != "" {
+		if db, coll, ok := strings.Cut(b.Catalog.Collection, "."); !ok || db == "" || coll == "" {
+			return cfg, fmt.Errorf("invalid CATALOG_COLLECTION %q (expected database.collection)", b.Catalog.Collection)
+		}
+	}
+	if b.Catalog.URI = viper.GetString("CATALOG_MONGO_URI"); b.Catalog.URI != "" &&
+		!strings.HasPrefix(b.Catalog.URI, "mongodb://") && !strings.HasPrefix(b.Catalog.URI, "mongodb+srv://") {
+		return cfg, fmt.Errorf("invalid CATALOG_MONGO_URI (expected a mongodb:// or mongodb+srv:// connection string)")
+	}
+	b.Catalog.Timeout = viper.GetDuration("CATALOG_TIMEOUT")
+
+	if viper.IsSet("MANIFEST_DROP_THRESHOLD") {
+		b.Manifest.DropThreshold = viper.GetFloat64("MANIFEST_DROP_THRESHOLD")
+	}
+	b.Manifest.Sidecar = viper.GetBool("MANIFEST_SIDECAR")
+	b.Manifest.CollectionStats = viper.GetBool("REPORT_COLLECTION_STATS")
+	if b.Manifest.WebhookURL, err = httpURL("MANIFEST_WEBHOOK_URL"); err != nil {
+		return cfg, err
+	}
+	b.Manifest.SizeDeviation = viper.GetFloat64("SIZE_DEVIATION_THRESHOLD")
+	if b.Manifest.SizeDeviation < 0 {
+		return cfg, fmt.Errorf("invalid SIZE_DEVIATION_THRESHOLD %v (expected a percentage, 0 disables)", b.Manifest.SizeDeviation)
+	}
+	if viper.IsSet("SIZE_HISTORY_RUNS") {
+		if b.Manifest.SizeHistory = viper.GetInt("SIZE_HISTORY_RUNS"); b.Manifest.SizeHistory < backup.MinSizeHistory {
+			return cfg, fmt.Errorf("invalid SIZE_HISTORY_RUNS %d (expected at least %d)", b.Manifest.SizeHistory, backup.MinSizeHistory)
+		}
+	}
+	if b.Manifest.AlertWebhookURL, err = httpURL("ALERT_WEBHOOK_URL"); err != nil {
+		return cfg, err
+	}
+
+	b.Upload.Destinations = listOf("STORAGE_DESTINATIONS")
+	if strings.TrimSpace(viper.GetString("STORAGE_DESTINATIONS")) != "" && len(b.Upload.Destinations) == 0 {
+		return cfg, fmt.Errorf("STORAGE_DESTINATIONS does not contain any destination")
+	}
+	switch b.Upload.Backend = strings.ToLower(stringOr("STORAGE_BACKEND", backup.BackendS3)); b.Upload.Backend {
+	case backup.BackendS3:
+	case backup.BackendSFTP:
+		if len(b.Upload.Destinations) > 0 {
+			break
+		}
+		if b.SFTP.Host == "" || b.SFTP.User == "" {
+			return cfg, fmt.Errorf("STORAGE_BACKEND=sftp needs SFTP_HOST and SFTP_USER")
+		}
+		if b.SFTP.Password == "" && b.SFTP.PrivateKeyFile == "" {
+			return cfg, fmt.Errorf("STORAGE_BACKEND=sftp needs SFTP_PASSWORD or SFTP_PRIVATE_KEY_FILE")
+		}
+	default:
+		return cfg, fmt.Errorf("invalid STORAGE_BACKEND %q (expected s3 or sftp)", b.Upload.Backend)
+	}
+	b.Upload.Quorum = viper.GetInt("UPLOAD_QUORUM")
+	if viper.IsSet("S3_CONTENT_DISPOSITION") {
+		b.Upload.ContentDisposition = viper.GetString("S3_CONTENT_DISPOSITION")
+	}
+	if viper.IsSet("S3_CACHE_CONTROL") {
+		b.Upload.CacheControl = viper.GetString("S3_CACHE_CONTROL")
+	}
+	b.Upload.Dedup = viper.GetBool("DEDUP_UPLOADS")
+	b.Upload.ChecksumSidecar = viper.GetBool("CHECKSUM_SIDECAR")
+	if viper.IsSet("LATEST_POINTER_KEY") {
+		b.Upload.LatestPointer = viper.GetString("LATEST_POINTER_KEY")
+	}
+	b.Upload.LatestCopy = viper.GetString("LATEST_COPY_KEY")
+
+	b.Retention.MaxAge = time.Duration(viper.GetInt("RETENTION_DAYS")) * 24 * time.Hour
+	if n := viper.GetInt("RETENTION_CONCURRENCY"); n > 0 {
+		b.Retention.Concurrency = n
+	}
+	if n := viper.GetInt("RETENTION_DELETE_ATTEMPTS"); n > 0 {
+		b.Retention.DeleteAttempts = n
+	}
+	b.Restore.Dir = stringOr("RESTORE_DIR", b.Restore.Dir)
+	b.RestoreCheck.Enabled = viper.GetBool("VERIFY_WITH_EPHEMERAL_MONGO")
+	// The check restores the uploaded archive, which only an identity opens
+	if b.RestoreCheck.Enabled && b.Encryption.Mode == backup.EncryptionAge && len(b.Encryption.AgeIdentities) == 0 {
+		return cfg, fmt.Errorf("VERIFY_WITH_EPHEMERAL_MONGO with ENCRYPTION_MODE=age needs AGE_IDENTITY_FILE")
+	}
+	b.RestoreCheck.Docker = stringOr("VERIFY_EPHEMERAL_DOCKER", b.RestoreCheck.Docker)
+	b.RestoreCheck.Image = stringOr("VERIFY_EPHEMERAL_IMAGE", b.RestoreCheck.Image)
+	b.RestoreCheck.StartTimeout = durationOr("VERIFY_EPHEMERAL_TIMEOUT", b.RestoreCheck.StartTimeout)
+	if n := viper.GetInt("RESTORE_CONCURRENCY"); n > 0 {
+		b.Restore.Concurrency = n
+	}
+	if n := viper.GetInt("RESTORE_PARALLEL_COLLECTIONS"); n > 0 {
+		b.Restore.ParallelCollections = n
+	}
+	b.Restore.Drop = viper.GetBool("RESTORE_DROP")
+	if viper.IsSet("RESTORE_DOWNLOAD_CHUNK_MB") {
+		b.Restore.DownloadChunkSize = viper.GetInt64("RESTORE_DOWNLOAD_CHUNK_MB") << 20
+	}
+	if n := viper.GetInt("RESTORE_DOWNLOAD_ATTEMPTS"); n > 0 {
+		b.Restore.DownloadAttempts = n
+	}
+	b.Restore.ToolsCheck = strings.ToLower(stringOr("RESTORE_TOOLS_CHECK", b.Restore.ToolsCheck))
+	switch b.Restore.ToolsCheck {
+	case backup.ToolsCheckWarn, backup.ToolsCheckRefuse, backup.ToolsCheckOff:
+	default:
+		return cfg, fmt.Errorf("invalid RESTORE_TOOLS_CHECK %q (expected warn, refuse or off)", b.Restore.ToolsCheck)
+	}
+	b.Restore.Target = backup.MongoConfig{
+		Username:   viper.GetString("RESTORE_TARGET_USERNAME"),
+		Password:   viper.GetString("RESTORE_TARGET_PASSWORD"),
+		ClusterURI: viper.GetString("RESTORE_TARGET_URI"),
+	}
+	b.Restore.ReuseCredentials = viper.GetBool("RESTORE_TARGET_REUSE_CREDENTIALS")
+	if b.Restore.ReuseCredentials && (b.Restore.Target.ClusterURI == "" || b.Restore.Target.Username != "" || b.Restore.Target.Password != "") {
+		return cfg, errors.New("RESTORE_TARGET_REUSE_CREDENTIALS needs RESTORE_TARGET_URI without RESTORE_TARGET_USERNAME and RESTORE_TARGET_PASSWORD")
+	}
+
+	b.Sharded.Enabled = viper.GetBool("SHARDED_CLUSTER")
+	b.Sharded.FsyncLock = viper.GetBool("SHARDED_FSYNC_LOCK")
+
+	cfg.Backup = b
+	cfg.Port = viper.GetString("APP_PORT")
+	cfg.Schedule = stringOr("BACKUP_SCHEDULE", "0 0 * * *")
+	if _, err := cron.ParseStandard(cfg.Schedule); err != nil {
+		return cfg, fmt.Errorf("invalid BACKUP_SCHEDULE %q: %w", cfg.Schedule, err)
+	}
+	cfg.OverlapPolicy = strings.ToLower(stringOr("OVERLAP_POLICY", "skip"))
+	if err := validateOverlapPolicy(cfg.OverlapPolicy); err != nil {
+		return cfg, err
+	}
+	cfg.BreakerThreshold = 3
+	if viper.IsSet("BREAKER_THRESHOLD") {
+		cfg.BreakerThreshold = viper.GetInt("BREAKER_THRESHOLD")
+	}
+	cfg.BreakerCooldown = durationOr("BREAKER_COOLDOWN", 15*time.Minute)
+	if cfg.RunMaxRetries = viper.GetInt("RUN_MAX_RETRIES"); cfg.RunMaxRetries < 0 {
+		return cfg, fmt.Errorf("invalid RUN_MAX_RETRIES %d (expected 0 or more)", cfg.RunMaxRetries)
+	}
+	cfg.RunRetryDelay = durationOr("RUN_RETRY_DELAY", 5*time.Minute)
+	if cfg.HealthcheckPingURL, err = httpURL("HEALTHCHECK_PING_URL"); err != nil {
+		return cfg, err
+	}
+	cfg.LogTailSize = max(viper.GetInt("LOG_TAIL_KB"), 0) << 10
+	if cfg.MaxBackupAge = viper.GetDuration("MAX_BACKUP_AGE"); cfg.MaxBackupAge < 0 {
+		return cfg, fmt.Errorf("invalid MAX_BACKUP_AGE %s (expected a duration, 0 disables)", cfg.MaxBackupAge)
+	}
+	cfg.StorageMetricsInterval = time.Hour
+	if viper.IsSet("STORAGE_METRICS_INTERVAL") {
+		cfg.StorageMetricsInterval = viper.GetDuration("STORAGE_METRICS_INTERVAL")
+	}
+	if cfg.TracingEndpoint, err = httpURL("OTEL_EXPORTER_OTLP_ENDPOINT"); err != nil {
+		return cfg, err
+	}
+	cfg.TracingServiceName = stringOr("OTEL_SERVICE_NAME", "mongodb-backup")
+	cfg.AuditPrincipalHeader = viper.GetString("AUDIT_PRINCIPAL_HEADER")
+	cfg.Backup.AuditPrefix = strings.Trim(viper.GetString("AUDIT_PREFIX"), "/")
+	return cfg, nil
+}
+
+// httpURL returns the value of key, which must be empty or an http or
+// https URL. These URLs tend to carry tokens, so a bad one is not echoed
+// back.
+func httpURL(key string) (string, error) {
+	raw := viper.GetString(key)
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid %s: expected an http or https URL", key)
+	}
+	return raw, nil
+}
+
+func stringOr(key, def string) string {
+	if v := viper.GetString(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func durationOr(key string, def time.Duration) time.Duration {
+	if v := viper.GetDuration(key); v > 0 {
+		return v
+	}
+	return def
+}
+
+// globsOf is listOf for path.Match patterns, which must all be valid.
+func globsOf(key string) ([]string, error) {
+	patterns := listOf(key)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", key, pattern, err)
+		}
+	}
+	return patterns, nil
+}
+
+// listOf splits a comma-separated value, dropping empty entries.
+func listOf(key string) []string {
+	var out []string
+	for _, entry := range strings.Split(viper.GetString(key), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// pathInside reports whether path is dir or below it. Both are made
+// absolute first, so a relative and an absolute path compare as well.
+func pathInside(dir, path string) (bool, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		// Only on Windows, for paths on different volumes
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// regexpOrNil compiles the pattern in key so that an invalid pattern is
+// reported at startup instead of at midnight.
+func regexpOrNil(key string) (*regexp.Regexp, error) {
+	pattern := viper.GetString(key)
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %w", key, pattern, err)
+	}
+	return re, nil
+}
+
+// readConfigFile returns the plaintext contents of the config file. When
+// CONFIG_DECRYPT_KEY holds an age identity the file is expected to be
+// age-encrypted (binary or armored) and is decrypted in memory only.
+func readConfigFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	key := os.Getenv("CONFIG_DECRYPT_KEY")
+	if key == "" {
+		return io.ReadAll(file)
+	}
+
+	identities, err := age.ParseIdentities(strings.NewReader(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CONFIG_DECRYPT_KEY: %w", err)
+	}
+
+	var src io.Reader = bufio.NewReader(file)
+	if peek, _ := src.(*bufio.Reader).Peek(len(armor.Header)); string(peek) == armor.Header {
+		src = armor.NewReader(src)
+	}
+
+	plaintext, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return io.ReadAll(plaintext)
+}
+
+// profilePath returns the config file of the APP_ENV profile env,
+// <env>.env next to base.
+func profilePath(base, env string) (string, error) {
+	if !profileName.MatchString(env) {
+		return "", fmt.Errorf("invalid APP_ENV %q: use letters, digits, dashes and underscores", env)
+	}
+	return filepath.Join(filepath.Dir(base), env+".env"), nil
+}
+
+var profileName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// readAgeIdentities reads the age identities in file, one per line as
+// written by age-keygen.
+func readAgeIdentities(file string) ([]age.Identity, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return age.ParseIdentities(f)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// environmentOnlyKeys are read from the process environment before any
+// config file is, so setting them in one has no effect.
+var environmentOnlyKeys = []string{"CONFIG_FILE", "APP_ENV", "CONFIG_DECRYPT_KEY"}
+
+// runConfig implements the config subcommand, which loads the
+// configuration like a backup run, prints the effective value of every
+// key with secrets masked and warns about keys of the config files that
+// are not read, and returns the exit code:
+//
+//	mongodb_backup config [-all] [-strict]
+func runConfig(args []string) int {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	all := fs.Bool("all", false, "also list the keys that are not set, which take their defaults")
+	strict := fs.Bool("strict", false, "fail when the config files contain unknown keys")
+	if err := fs.Parse(args); err != nil {
+		return ExitConfigError
+	}
+
+	_, loadErr := LoadConfig()
+	unknown := unknownConfigKeys()
+	for _, key := range unknown {
+		switch {
+		case slices.Contains(environmentOnlyKeys, key):
+			log.Printf("Warning: %s is only read from the environment, the config file setting has no effect", key)
+		case closestConfigKey(key) != "":
+			log.Printf("Warning: unknown key %s, did you mean %s?", key, closestConfigKey(key))
+		default:
+			log.Printf("Warning: unknown key %s", key)
+		}
+	}
+	if loadErr != nil {
+		log.Printf("Configuration error: %v", loadErr)
+		return ExitConfigError
+	}
+
+	fmt.Printf("# config file: %s\n", cmp.Or(os.Getenv("CONFIG_FILE"), ".env"))
+	if env := os.Getenv("APP_ENV"); env != "" {
+		fmt.Printf("# profile: %s\n", env)
+	}
+	for _, key := range configKeys {
+		if !viper.IsSet(key) || viper.GetString(key) == "" {
+			if *all {
+				fmt.Printf("#%s=\n", key)
+			}
+			continue
+		}
+		fmt.Printf("%s=%s\n", key, maskConfigValue(key, viper.GetString(key)))
+	}
+	if *strict && len(unknown) > 0 {
+		return ExitConfigError
+	}
+	return ExitOK
+}
+
+// unknownConfigKeys lists the keys of the config file and profile that
+// LoadConfig does not read, sorted. Environment variables are not checked,
+// since the environment holds much besides the configuration.
+func unknownConfigKeys() []string {
+	var unknown []string
+	for _, key := range viper.AllKeys() {
+		key = strings.ToUpper(key)
+		if !slices.Contains(configKeys, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
+
+// closestConfigKey returns the known key that key is most likely a typo
+// of, such as MONGO_USERNAME for MONGO_USER, or "" when none is close.
+func closestConfigKey(key string) string {
+	best, bestDistance := "", len(key)/3+2
+	for _, known := range configKeys {
+		if d := editDistance(key, known); d < bestDistance {
+			best, bestDistance = known, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// maskConfigValue hides the secrets of a configuration value: passwords
+// and secret keys entirely, the password of a connection string, and the
+// path and query of webhook URLs, which usually carry a token. Lists are
+// masked entry by entry.
+func maskConfigValue(key, value string) string {
+	for _, secret := range []string{"PASSWORD", "SECRET", "PASSPHRASE"} {
+		if strings.Contains(key, secret) {
+			return "********"
+		}
+	}
+	if entries := strings.Split(value, ","); len(entries) > 1 {
+		for i, entry := range entries {
+			entries[i] = maskConfigValue(key, entry)
+		}
+		return strings.Join(entries, ",")
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return value
+	}
+	if strings.HasSuffix(key, "WEBHOOK_URL") || key == "HEALTHCHECK_PING_URL" {
+		return u.Scheme + "://" + u.Host + "/********"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathInside(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dir, path string
+		want      bool
+	}{
+		{dir: "backup", path: "backup", want: true},
+		{dir: "backup", path: "backup/archives", want: true},
+		{dir: "backup", path: "./backup/../backup/archives", want: true},
+		{dir: "backup", path: filepath.Join(wd, "backup", "archives"), want: true},
+		{dir: filepath.Join(wd, "backup"), path: "backup/archives", want: true},
+		{dir: "backup", path: "backup/..keep", want: true},
+		{dir: "backup", path: "archives"},
+		{dir: "backup", path: "backup-archives"},
+		{dir: "backup", path: "backup/.."},
+		{dir: "backup/dump", path: "backup/..keep"},
+		{dir: "backup", path: filepath.Join(wd, "archives")},
+	}
+	for _, tt := range tests {
+		got, err := pathInside(tt.dir, tt.path)
+		if err != nil {
+			t.Errorf("pathInside(%q, %q): %v", tt.dir, tt.path, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("pathInside(%q, %q) = %v, want %v", tt.dir, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"mongodb_backup/pkg/backup"
+)
+
+// runDiff implements the diff subcommand, which compares the document
+// counts and sizes of every collection between two backups, or a backup
+// and the live cluster, and prints them as a table:
+//
+//	mongodb_backup diff [-changed] mongodb-dump-2024-06-01.zip latest|live
+func runDiff(ctx context.Context, cfg appConfig, args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	changed := fs.Bool("changed", false, "only list collections that differ")
+	if err := fs.Parse(args); err != nil {
+		return ExitConfigError
+	}
+	if fs.NArg() != 2 {
+		log.Printf("Configuration error: diff needs two backup keys, latest or live")
+		return ExitConfigError
+	}
+	keyA, keyB := fs.Arg(0), fs.Arg(1)
+	ctx = backup.WithLogger(ctx, logger.With("run_id", newRunID()))
+
+	if keyA != backup.DiffLive || keyB != backup.DiffLive {
+		if err := initStorage(ctx, cfg, false); err != nil {
+			log.Printf("Configuration error: %v", err)
+			return ExitConfigError
+		}
+	}
+	load := func(key string) (backup.Manifest, error) {
+		if key == backup.DiffLive {
+			return backup.LiveManifest(ctx, cfg.Backup)
+		}
+		return backup.LoadBackupManifest(ctx, cfg.Backup, key)
+	}
+	a, err := load(keyA)
+	if err != nil {
+		logger.Error("failed to read manifest", "key", keyA, "error", err)
+		return exitCode(err)
+	}
+	b, err := load(keyB)
+	if err != nil {
+		logger.Error("failed to read manifest", "key", keyB, "error", err)
+		return exitCode(err)
+	}
+
+	fmt.Printf("A: %s (%s)\n", keyA, a.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+	fmt.Printf("B: %s (%s)\n", keyB, b.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATABASE\tCOLLECTION\tDOCS A\tDOCS B\tDOCS Δ\tSIZE A\tSIZE B\tSIZE Δ\tSTATUS\t")
+	var differ int
+	for _, d := range backup.DiffManifests(a, b) {
+		if d.Changed() {
+			differ++
+		} else if *changed {
+			continue
+		}
+		status := ""
+		switch {
+		case !d.InA:
+			status = "added"
+		case !d.InB:
+			status = "removed"
+		case d.Changed():
+			status = "changed"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", d.Database, d.Collection,
+			diffCount(d.DocumentsA, d.InA), diffCount(d.DocumentsB, d.InB), diffDelta(d.DocumentsA, d.DocumentsB, d.InA && d.InB),
+			diffCount(d.SizeA, d.InA && d.SizeA != 0), diffCount(d.SizeB, d.InB && d.SizeB != 0),
+			diffDelta(d.SizeA, d.SizeB, d.InA && d.InB && d.SizeA != 0 && d.SizeB != 0), status)
+	}
+	tw.Flush()
+	fmt.Printf("%d collections differ\n", differ)
+	return ExitOK
+}
+
+// diffCount formats n, or - when it is not known.
+func diffCount(n int64, known bool) string {
+	if !known {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// diffDelta formats b-a with its sign, or - when it is not known.
+func diffDelta(a, b int64, known bool) string {
+	if !known {
+		return "-"
+	}
+	if b > a {
+		return "+" + strconv.FormatInt(b-a, 10)
+	}
+	return strconv.FormatInt(b-a, 10)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"mongodb_backup/pkg/backup"
+)
+
+// runDump implements the dump subcommand, which writes the archive to
+// stdout instead of uploading it, and returns the exit code:
+//
+//	mongodb_backup dump | gpg -e -r ops | aws s3 cp - s3://bucket/backup.tar.gpg
+//
+// Logs and mongodump's output go to stderr.
+func runDump(ctx context.Context, cfg appConfig) int {
+	runID := newRunID()
+	log := logger.With("run_id", runID)
+	ctx = backup.WithLogger(ctx, log)
+	ctx = backup.WithCommandOutput(ctx, os.Stderr)
+
+	err := backup.BackUp(ctx, cfg.Backup)
+	if err == nil {
+		err = backup.WriteArchive(ctx, cfg.Backup, os.Stdout)
+	}
+	if cleanErr := backup.CleanExportsFolder(ctx, cfg.Backup); cleanErr != nil && err == nil {
+		err = cleanErr
+	}
+	if err != nil {
+		log.Error("dump failed", "error", err)
+	}
+	return exitCode(err)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+
+	"mongodb_backup/pkg/backup"
+)
+
+// Exit codes returned by one-shot mode (-once). Each pipeline stage has its
+// own code so that schedulers can route failures to different runbooks.
+const (
+	ExitOK            = 0
+	ExitUnknown       = 1
+	ExitConfigError   = 2
+	ExitMongoConnect  = 3
+	ExitDumpFailed    = 4
+	ExitUploadFailed  = 5
+	ExitCleanupFailed = 6
+	ExitRestoreFailed = 7
+	ExitVerifyFailed  = 8
+)
+
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, backup.ErrMongoConnect):
+		return ExitMongoConnect
+	case errors.Is(err, backup.ErrDumpFailed):
+		return ExitDumpFailed
+	case errors.Is(err, backup.ErrUploadFailed):
+		return ExitUploadFailed
+	case errors.Is(err, backup.ErrCleanup):
+		return ExitCleanupFailed
+	case errors.Is(err, backup.ErrRestoreFailed):
+		return ExitRestoreFailed
+	case errors.Is(err, backup.ErrVerifyFailed):
+		return ExitVerifyFailed
+	default:
+		return ExitUnknown
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// configKeys are the configuration keys that can also be given as flags.
+// Every key read by LoadConfig belongs here.
+var configKeys = []string{
+	"MONGO_USERNAME", "MONGO_PASSWORD", "MONGO_CLUSTER_URI", "CLUSTER_NAME", "APP_VERSION",
+	"MONGO_CONNECT_TIMEOUT", "MONGO_LIST_TIMEOUT", "FAILOVER_GRACE", "DUMP_TIMEOUT", "ARCHIVE_TIMEOUT", "UPLOAD_TIMEOUT",
+	"MONGO_INCLUDE_REGEX", "MONGO_EXCLUDE_REGEX", "MONGO_DATABASE_REGISTRY", "MONGO_DATABASE_REGISTRY_FIELD", "CATALOG_COLLECTION", "CATALOG_MONGO_URI", "CATALOG_TIMEOUT", "MONGODUMP_EXTRA_ARGS", "MONGODUMP_QUERIES",
+	"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_REGION", "AWS_BUCKET_NAME",
+	"S3_TIMEOUT", "S3_PART_SIZE_MB", "S3_UPLOAD_ATTEMPTS", "S3_STALE_UPLOAD_AGE", "S3_ABORT_INCOMPLETE_DAYS", "S3_CONTENT_MD5",
+	"S3_UPLOAD_BUFFER_KB", "S3_CONTENT_DISPOSITION", "S3_CACHE_CONTROL", "S3_OBJECT_ACL", "CREATE_BUCKET_IF_MISSING",
+	"SFTP_HOST", "SFTP_USER", "SFTP_PATH", "SFTP_PASSWORD", "SFTP_PRIVATE_KEY_FILE", "SFTP_PRIVATE_KEY_PASSPHRASE", "SFTP_KNOWN_HOSTS", "SFTP_TIMEOUT",
+	"STORAGE_BACKEND", "STORAGE_DESTINATIONS", "UPLOAD_QUORUM", "DEDUP_UPLOADS", "CHECKSUM_SIDECAR", "LATEST_POINTER_KEY", "LATEST_COPY_KEY",
+	"BACKUP_SCHEDULE", "BACKUP_OUTPUT_DIR", "STATE_DIR", "BACKUP_UMASK", "BACKUP_CHANGED_ONLY", "SKIP_EMPTY_DBS", "MAX_DATABASES", "BACKUP_DB_DELAY",
+	"BACKUP_ENGINE", "NATIVE_SPLIT_DOCUMENTS", "NATIVE_SPLIT_SIZE_MB", "BACKUP_VERIFY", "UPLOAD_DUMP_LOGS", "EXPORT_INDEX_SPECS", "RESTORE_SCRIPTS", "STRICT_MODE", "CLEANUP_ATTEMPTS",
+	"ARCHIVE_FORMAT", "ARCHIVE_COMMENT", "ARCHIVE_PER_DATABASE", "KEEP_LOCAL_ARCHIVE", "LOCAL_ARCHIVE_DIR", "LOCAL_ARCHIVE_COUNT", "ENCRYPTION_MODE", "KMS_KEY_ID", "AGE_RECIPIENTS", "AGE_IDENTITY_FILE", "PRE_UPLOAD_CMD", "PIPELINE_UPLOADS", "STREAM_PER_DB", "UPLOAD_CONCURRENCY", "DATABASE_UPLOAD_ATTEMPTS", "UPLOAD_RETRY_MAX_DELAY", "UPLOAD_RETRY_JITTER", "UPLOAD_BANDWIDTH_LIMIT", "DUMP_CONCURRENCY", "COMPRESSION_PARALLELISM", "COMPRESSION_LEVEL", "COMPRESSION_ALGO", "ZSTD_DICTIONARY", "ZSTD_DICTIONARY_SIZE_KB",
+	"COMPRESSION_BLOCK_SIZE_KB", "COMPRESSION_BUFFER_KB", "MANIFEST_DROP_THRESHOLD", "MANIFEST_SIDECAR", "MANIFEST_WEBHOOK_URL", "REPORT_COLLECTION_STATS",
+	"SIZE_DEVIATION_THRESHOLD", "SIZE_HISTORY_RUNS", "ALERT_WEBHOOK_URL",
+	"RETENTION_DAYS", "RETENTION_CONCURRENCY", "RETENTION_DELETE_ATTEMPTS",
+	"VERIFY_WITH_EPHEMERAL_MONGO", "VERIFY_EPHEMERAL_DOCKER", "VERIFY_EPHEMERAL_IMAGE", "VERIFY_EPHEMERAL_TIMEOUT",
+	"RESTORE_DIR", "RESTORE_CONCURRENCY", "RESTORE_PARALLEL_COLLECTIONS", "RESTORE_DROP", "RESTORE_DOWNLOAD_CHUNK_MB", "RESTORE_DOWNLOAD_ATTEMPTS", "RESTORE_TOOLS_CHECK",
+	"RESTORE_TARGET_URI", "RESTORE_TARGET_USERNAME", "RESTORE_TARGET_PASSWORD", "RESTORE_TARGET_REUSE_CREDENTIALS",
+	"SHARDED_CLUSTER", "SHARDED_FSYNC_LOCK",
+	"APP_PORT", "OVERLAP_POLICY", "BREAKER_THRESHOLD", "BREAKER_COOLDOWN", "RUN_MAX_RETRIES", "RUN_RETRY_DELAY",
+	"HEALTHCHECK_PING_URL", "LOG_TAIL_KB", "MAX_BACKUP_AGE", "STORAGE_METRICS_INTERVAL", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_SERVICE_NAME", "AUDIT_PREFIX", "AUDIT_PRINCIPAL_HEADER",
+}
+
+// flagNames shortens the flags of the most used keys. The others are the
+// key in lower case with dashes, e.g. --mongo-cluster-uri.
+var flagNames = map[string]string{
+	"BACKUP_SCHEDULE":   "schedule",
+	"BACKUP_OUTPUT_DIR": "output-dir",
+	"AWS_BUCKET_NAME":   "bucket",
+}
+
+func configFlagName(key string) string {
+	if name, ok := flagNames[key]; ok {
+		return name
+	}
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+func init() {
+	for _, key := range configKeys {
+		flag.String(configFlagName(key), "", "overrides "+key)
+	}
+	// Stop at the first argument, so that a subcommand such as restore
+	// parses its own flags
+	flag.CommandLine.SetInterspersed(false)
+}
+
+// parseFlags parses the command line. Single-dash long flags, as in
+// -once, are accepted for compatibility with the standard flag package,
+// which also parses the subcommand flags and accepts both forms.
+func parseFlags() {
+	args := os.Args[1:]
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && flag.Lookup(name) != nil {
+			args[i] = "-" + arg
+		}
+	}
+	flag.CommandLine.Parse(args)
+}
+
+// bindConfigFlags makes flags take precedence over the environment, which
+// takes precedence over the config file. Flags that were not given fall
+// through to the environment and the file.
+func bindConfigFlags() error {
+	for _, key := range configKeys {
+		if err := viper.BindPFlag(key, flag.Lookup(configFlagName(key))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
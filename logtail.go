@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// logTail keeps the last log lines of every backup run in progress, by run
+// ID, up to limit bytes per run, so that the healthcheck ping of a run can
+// carry them. Lines of runs that were not begun are not kept.
+type logTail struct {
+	limit int
+
+	mu   sync.Mutex
+	runs map[string]*tailBuffer
+}
+
+type tailBuffer struct {
+	lines []string
+	size  int
+}
+
+func newLogTail(limit int) *logTail {
+	return &logTail{limit: limit, runs: map[string]*tailBuffer{}}
+}
+
+// begin starts keeping the lines of run id, dropping any left over.
+func (t *logTail) begin(id string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.runs[id] = &tailBuffer{}
+}
+
+// end stops keeping the lines of run id and returns them, oldest first.
+func (t *logTail) end(id string) string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	buf, ok := t.runs[id]
+	if !ok {
+		return ""
+	}
+	delete(t.runs, id)
+	return strings.Join(buf.lines, "")
+}
+
+// add appends line to the lines of run id and drops the oldest ones that no
+// longer fit. A single line longer than the limit is cut.
+func (t *logTail) add(id, line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	buf, ok := t.runs[id]
+	if !ok {
+		return
+	}
+	if len(line) > t.limit {
+		line = line[:t.limit-1] + "\n"
+	}
+	buf.lines = append(buf.lines, line)
+	buf.size += len(line)
+	for buf.size > t.limit {
+		buf.size -= len(buf.lines[0])
+		buf.lines = buf.lines[1:]
+	}
+}
+
+// tailWriter receives the lines a text handler formats for run id. slog
+// handlers write every record in a single call.
+type tailWriter struct {
+	tail *logTail
+	id   string
+}
+
+func (w tailWriter) Write(p []byte) (int, error) {
+	w.tail.add(w.id, string(p))
+	return len(p), nil
+}
+
+// tailHandler passes every record on to next and, once a run_id attribute
+// was added to the logger, also formats it into the tail of that run. It is
+// safe for concurrent use, like next.
+type tailHandler struct {
+	next    slog.Handler
+	tail    *logTail
+	grouped bool
+	// text formats the records of the run; nil until run_id is known.
+	text slog.Handler
+	// ops replays the attributes and groups of the logger onto a new text
+	// handler once the run is known.
+	ops []func(slog.Handler) slog.Handler
+}
+
+func newTailHandler(next slog.Handler, tail *logTail) *tailHandler {
+	return &tailHandler{next: next, tail: tail}
+}
+
+func (h *tailHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *tailHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.text != nil {
+		// Keeping the tail never fails the log call
+		_ = h.text.Handle(ctx, r.Clone())
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *tailHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	op := func(t slog.Handler) slog.Handler { return t.WithAttrs(attrs) }
+	c := h.derive(h.next.WithAttrs(attrs), op)
+	for _, attr := range attrs {
+		if attr.Key == "run_id" && !h.grouped {
+			text := slog.Handler(slog.NewTextHandler(tailWriter{h.tail, attr.Value.String()}, nil))
+			for _, op := range c.ops {
+				text = op(text)
+			}
+			c.text = text
+		}
+	}
+	return c
+}
+
+func (h *tailHandler) WithGroup(name string) slog.Handler {
+	c := h.derive(h.next.WithGroup(name), func(t slog.Handler) slog.Handler { return t.WithGroup(name) })
+	c.grouped = true
+	return c
+}
+
+func (h *tailHandler) derive(next slog.Handler, op func(slog.Handler) slog.Handler) *tailHandler {
+	c := *h
+	c.next = next
+	c.ops = append(h.ops[:len(h.ops):len(h.ops)], op)
+	if c.text != nil {
+		c.text = op(c.text)
+	}
+	return &c
+}
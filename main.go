@@ -1,279 +1,353 @@
-package main
-
-import (
-	"archive/zip"
-	"context"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/robfig/cron/v3"
-	"github.com/spf13/viper"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-)
-
-var AWSClient *s3.Client
-
-func init() {
-	viper.SetConfigFile(".env")
-	viper.AutomaticEnv()
-	err := viper.ReadInConfig()
-	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
-	}
-}
-
-func main() {
-	InitializeS3Client()
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "MongoDB Backup service is up...")
-	})
-
-	// Schedule the job to run at midnight (00:00)
-	c := cron.New()
-	c.AddFunc("0 0 * * *", func() {
-		BackUp()
-		UploadToS3()
-		CleanExportsFolder()
-	})
-	c.Start()
-
-	// Start the HTTP server on port 8080
-	port := viper.GetString("APP_PORT")
-	fmt.Println("Server listening on port ", fmt.Sprint(":", port))
-	log.Fatal(http.ListenAndServe(fmt.Sprint(":", port), nil))
-
-	fmt.Println("Backup uploaded to S3 successfully")
-}
-
-func BackUp() {
-	// Load credentials from environment variables
-	username := viper.GetString("MONGO_USERNAME")
-	password := viper.GetString("MONGO_PASSWORD")
-	clusterURI := viper.GetString("MONGO_CLUSTER_URI")
-	outputDir := viper.GetString("BACKUP_OUTPUT_DIR")
-	if outputDir == "" {
-		outputDir = "./backup"
-	}
-
-	// Build connection string
-	connStr := fmt.Sprintf("mongodb+srv://%s:%s@%s", username, password, clusterURI)
-
-	// Connect to MongoDB
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	clientOpts := options.Client().ApplyURI(connStr)
-	client, err := mongo.Connect(ctx, clientOpts)
-	if err != nil {
-		fmt.Printf("Failed to connect to MongoDB: %v\n", err)
-		return
-	}
-	defer client.Disconnect(ctx)
-
-	// Get list of database names
-	dbs, err := client.ListDatabaseNames(ctx, map[string]interface{}{})
-	if err != nil {
-		fmt.Printf("Failed to list databases: %v\n", err)
-		return
-	}
-
-	// Loop through databases and run mongodump
-	for _, dbName := range dbs {
-		// Skip internal databases (optional)
-		if dbName == "admin" || dbName == "local" || dbName == "config" {
-			continue
-		}
-
-		fmt.Printf("Backing up database: %s\n", dbName)
-		cmd := exec.Command("mongodump",
-			"--uri", fmt.Sprintf("mongodb+srv://%s:%s@%s/%s", username, password, clusterURI, dbName),
-			"--out", fmt.Sprintf("%s/%s", outputDir, dbName),
-		)
-
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		if err := cmd.Run(); err != nil {
-			fmt.Printf("Failed to dump %s: %v\n", dbName, err)
-		} else {
-			fmt.Printf("Successfully backed up %s\n", dbName)
-		}
-	}
-
-	fmt.Println("All backups completed.")
-}
-
-func CleanExportsFolder() error {
-	dir := viper.GetString("BACKUP_OUTPUT_DIR")
-	if dir == "" {
-		dir = "./backup"
-	}
-
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return err
-	}
-
-	for _, entry := range entries {
-		path := filepath.Join(dir, entry.Name())
-		err := os.RemoveAll(path) // Removes both files and directories
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func InitializeS3Client() {
-	awsCfg, err := CreateAWSConfig()
-	if err != nil {
-		fmt.Printf("unable to load AWS config: %v", err)
-	}
-
-	AWSClient = s3.NewFromConfig(awsCfg)
-}
-
-func CreateAWSConfig() (aws.Config, error) {
-	awsCfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(viper.GetString("AWS_REGION")),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			viper.GetString("AWS_ACCESS_KEY_ID"),
-			viper.GetString("AWS_SECRET_ACCESS_KEY"),
-			"",
-		)),
-	)
-	if err != nil {
-		return aws.Config{}, fmt.Errorf("unable to load AWS config: %w", err)
-	}
-
-	return awsCfg, nil
-}
-
-func UploadToS3() error {
-	// Zip the backup folder
-	dir := viper.GetString("BACKUP_OUTPUT_DIR")
-	if dir == "" {
-		dir = "./backup"
-	}
-	zipPath := "mongodb-dump-" + time.Now().Format("2006-01-02") + ".zip"
-	if err := ZipFolder(dir, zipPath); err != nil {
-		return fmt.Errorf("failed to zip backup folder: %w", err)
-	}
-
-	// Open the zip file
-	file, err := os.Open(zipPath)
-	if err != nil {
-		return fmt.Errorf("failed to open zipped backup: %w", err)
-	}
-
-	// Read content type
-	buffer := make([]byte, 512)
-	_, err = file.Read(buffer)
-	if err != nil && err != io.EOF {
-		return fmt.Errorf("failed to read from zip file: %w", err)
-	}
-	contentType := http.DetectContentType(buffer)
-
-	// Reset pointer
-	_, err = file.Seek(0, 0)
-	if err != nil {
-		return fmt.Errorf("failed to seek to beginning of zip file: %w", err)
-	}
-
-	imagekey := zipPath
-
-	// Upload to S3
-	_, err = AWSClient.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(viper.GetString("AWS_BUCKET_NAME")),
-		Key:         aws.String(imagekey),
-		Body:        file,
-		ContentType: aws.String(contentType),
-	})
-
-	if err != nil {
-		return fmt.Errorf("failed to upload to S3: %w", err)
-	}
-
-	fmt.Println("Backup uploaded to S3 successfully as", imagekey)
-	file.Close()
-	// Attempt to remove the file
-	removeerr := os.Remove(zipPath)
-	if removeerr != nil {
-		// Handle the error, e.g., if the file doesn't exist or permissions are insufficient
-		if os.IsNotExist(removeerr) {
-			fmt.Printf("File not found: %s\n", zipPath)
-		} else {
-			log.Fatalf("Error removing file %s: %v\n", zipPath, removeerr)
-		}
-	} else {
-		fmt.Printf("File %s removed successfully.\n", zipPath)
-	}
-
-	return nil
-}
-
-func ZipFolder(source, target string) error {
-	zipfile, err := os.Create(target)
-	if err != nil {
-		return err
-	}
-	defer zipfile.Close()
-
-	archive := zip.NewWriter(zipfile)
-	defer archive.Close()
-
-	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
-		}
-
-		relPath, err := filepath.Rel(source, path)
-		if err != nil {
-			return err
-		}
-		header.Name = relPath
-
-		if info.IsDir() {
-			header.Name += "/"
-		} else {
-			header.Method = zip.Deflate
-		}
-
-		writer, err := archive.CreateHeader(header)
-		if err != nil {
-			return err
-		}
-
-		if !info.IsDir() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			_, err = io.Copy(writer, file)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-
-	return err
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	flag "github.com/spf13/pflag"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"mongodb_backup/pkg/backup"
+)
+
+// runRetries is how often a failed run is attempted again, after
+// runRetryDelay, with RUN_MAX_RETRIES and RUN_RETRY_DELAY.
+var (
+	runRetries    int
+	runRetryDelay time.Duration
+)
+
+var (
+	runOnce     = flag.Bool("once", false, "run a single backup and exit with a stage-specific exit code")
+	showVersion = flag.Bool("version", false, "print the version and exit")
+	runLabel    = flag.String("label", "", "label for the -once backup, added to its key and exempt from retention")
+)
+
+func main() {
+	parseFlags()
+	if flag.Arg(0) == "dump" || flag.Arg(0) == "diff" {
+		// stdout carries the archive, or the diff table
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+
+	if *showVersion {
+		fmt.Println(backup.Version)
+		return
+	}
+	// verify reads a local file and needs no configuration
+	if flag.Arg(0) == "verify" {
+		os.Exit(runVerify(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "config" {
+		os.Exit(runConfig(flag.Args()[1:]))
+	}
+	logger.Info("starting mongodb backup", "version", backup.Version)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Printf("Configuration error: %v", err)
+		os.Exit(ExitConfigError)
+	}
+	dirs := []string{cfg.Backup.OutputDir, cfg.Backup.StateDir}
+	if cfg.Backup.LocalArchive.Keep {
+		dirs = append(dirs, cfg.Backup.LocalArchive.Dir)
+	}
+	for _, dir := range dirs {
+		if err := backup.CheckWritable(dir, cfg.Backup.DirMode()); err != nil {
+			log.Printf("Configuration error: %v", err)
+			os.Exit(ExitConfigError)
+		}
+	}
+
+	// Root context, cancelled on SIGINT/SIGTERM so in-flight work can stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch flag.Arg(0) {
+	case "dump":
+		os.Exit(runDump(ctx, cfg))
+	case "restore":
+		os.Exit(runRestore(ctx, cfg, flag.Args()[1:]))
+	case "diff":
+		os.Exit(runDiff(ctx, cfg, flag.Args()[1:]))
+	}
+
+	mongoBreaker = newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	healthcheckPingURL = cfg.HealthcheckPingURL
+	runRetries, runRetryDelay = cfg.RunMaxRetries, cfg.RunRetryDelay
+	if cfg.LogTailSize > 0 {
+		runLogTail = newLogTail(cfg.LogTailSize)
+		logger = slog.New(newTailHandler(logger.Handler(), runLogTail))
+	}
+
+	if err := initStorage(ctx, cfg, true); err != nil {
+		log.Printf("Configuration error: %v", err)
+		os.Exit(ExitConfigError)
+	}
+	// Uploads a crashed process left behind are aborted before the first run
+	if err := backup.AbortStaleUploads(ctx, cfg.Backup); err != nil {
+		logger.Warn("stale upload cleanup failed", "error", err)
+	}
+
+	stopTracing, err := startTracing(ctx, cfg)
+	if err != nil {
+		log.Printf("Configuration error: %v", err)
+		os.Exit(ExitConfigError)
+	}
+
+	if flag.Arg(0) == "upload-archive" {
+		code := runUploadArchive(ctx, cfg.Backup, flag.Args()[1:])
+		stopTracing()
+		os.Exit(code)
+	}
+	if *runOnce {
+		onceCfg := cfg.Backup
+		if *runLabel != "" {
+			if err := backup.ValidateLabel(*runLabel); err != nil {
+				log.Printf("Configuration error: %v", err)
+				os.Exit(ExitConfigError)
+			}
+			onceCfg.Label = *runLabel
+		}
+		runID := newRunID()
+		err := runBackupJob(ctx, onceCfg, runID, "once")
+		if err != nil {
+			logger.Error("backup run failed", "run_id", runID, "error", err)
+		}
+		stopTracing()
+		os.Exit(exitCode(err))
+	}
+
+	if created, err := backup.LastUploadedAt(cfg.Backup); err == nil {
+		status.seedLastSuccess(created)
+	}
+	registerHandlers(ctx, cfg)
+	startStorageMetrics(ctx, cfg.Backup, cfg.StorageMetricsInterval)
+
+	// Schedule the job (by default at midnight), never overlapping any
+	// other run. A panicking run is logged and counted instead of
+	// vanishing, and the next scheduled run goes ahead as usual
+	c := cron.New(cron.WithLogger(cronLogger), cron.WithChain(cron.Recover(cronLogger), countPanics))
+	entry, _ := c.AddFunc(cfg.Schedule, func() {
+		if !scheduler.allowRun() {
+			logger.Warn("scheduled backup skipped, scheduler is paused")
+			return
+		}
+		if !acquireScheduledRun(ctx, cfg.OverlapPolicy) {
+			logger.Warn("scheduled backup skipped, another backup is still running")
+			return
+		}
+		defer releaseRun()
+		runID := newRunID()
+		if err := runBackupJob(ctx, cfg.Backup, runID, "schedule"); err != nil {
+			logger.Error("backup run failed", "run_id", runID, "error", err)
+		}
+	})
+	scheduler.cron, scheduler.entry = c, entry
+	c.Start()
+
+	// Start the HTTP server on port 8080
+	port := cfg.Port
+	fmt.Println("Server listening on port ", fmt.Sprint(":", port))
+	server := &http.Server{Addr: fmt.Sprint(":", port)}
+	go func() {
+		<-ctx.Done()
+		fmt.Println("Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	// Wait for a running backup, scheduled or manual, to observe the
+	// cancellation and return
+	<-c.Stop().Done()
+	runSlot <- struct{}{}
+	stopTracing()
+	fmt.Println("Shutdown complete")
+}
+
+// initStorage connects to the destinations and checks that their buckets
+// exist. With configureBuckets, missing buckets are created and the
+// lifecycle rule for incomplete uploads is applied when configured.
+func initStorage(ctx context.Context, cfg appConfig, configureBuckets bool) error {
+	if err := backup.InitializeS3Client(ctx, cfg.Backup.AWS); err != nil {
+		return err
+	}
+	if err := backup.InitializeStorages(cfg.Backup); err != nil {
+		return err
+	}
+	checkCfg := cfg.Backup
+	checkCfg.AWS.CreateBucket = checkCfg.AWS.CreateBucket && configureBuckets
+	if !configureBuckets {
+		checkCfg.AWS.AbortIncompleteDays = 0
+	}
+	return backup.CheckBuckets(ctx, checkCfg)
+}
+
+// runBackupJob runs dump, upload and cleanup in order. Cleanup always runs;
+// the returned error wraps the sentinel of the first stage that failed. A
+// failed run is attempted again up to runRetries times, runRetryDelay
+// apart, before it is reported.
+func runBackupJob(ctx context.Context, cfg backup.Config, runID, trigger string) (err error) {
+	runLogTail.begin(runID)
+	log := logger.With("run_id", runID)
+	ctx = backup.WithLogger(ctx, log)
+	ctx = backup.WithProgress(ctx, func(p backup.Progress) { status.setProgress(runID, p) })
+	var uploadedKey string
+	ctx = backup.WithUploaded(ctx, func(key string) { uploadedKey = key })
+	var (
+		stagesMu sync.Mutex
+		stages   = map[string]time.Duration{}
+	)
+	ctx = backup.WithStageTimings(ctx, func(stage string, d time.Duration) {
+		stagesMu.Lock()
+		stages[stage] += d
+		stagesMu.Unlock()
+		status.addStageTime(runID, stage, d)
+	})
+	ctx, span := tracer.Start(ctx, "backup.run", trace.WithAttributes(
+		attribute.String("backup.run_id", runID), attribute.String("backup.trigger", trigger), attribute.String("backup.label", cfg.Label)))
+
+	status.start(runID, trigger, cfg.Label, cfg.AppVersion)
+	started := time.Now().UTC()
+	var manifest *backup.Manifest
+	defer func() {
+		// A panic is reported as a failed run before it goes on up
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("backup run panicked: %v", r)
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		stagesMu.Lock()
+		if len(stages) > 0 {
+			log.Info("backup run stage timings", stageTimingAttrs(stages)...)
+		}
+		stagesMu.Unlock()
+		span.End()
+		status.finish(runID, err)
+		pingHealthcheck(ctx, err, runLogTail.end(runID))
+		recordCatalog(ctx, cfg, runID, trigger, started, uploadedKey, manifest, err)
+		if r != nil {
+			panic(r)
+		}
+	}()
+	log.Info("backup run started", "trigger", trigger, "label", cfg.Label)
+
+	// Every attempt starts over with an empty dump folder, which the
+	// previous one cleaned
+	for attempt := 1; ; attempt++ {
+		if runRetries > 0 {
+			log.Info("backup run attempt", "attempt", attempt, "max_attempts", runRetries+1)
+		}
+		uploadedKey = ""
+		manifest, err = runBackupAttempt(ctx, cfg, runID, &uploadedKey)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		if attempt > runRetries {
+			if attempt > 1 {
+				err = fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			break
+		}
+		log.Warn("backup run attempt failed, retrying", "attempt", attempt, "wait", runRetryDelay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(runRetryDelay):
+		}
+	}
+	if err == nil {
+		log.Info("backup run finished")
+	}
+	return err
+}
+
+// runBackupAttempt makes one attempt at the run runID: it dumps, uploads
+// and cleans up, and returns the manifest of the dump. uploadedKey is the
+// key the upload reported, set through the context of the run.
+func runBackupAttempt(ctx context.Context, cfg backup.Config, runID string, uploadedKey *string) (manifest *backup.Manifest, err error) {
+	log := backup.LoggerFrom(ctx)
+
+	if ok, until := mongoBreaker.allow(); !ok {
+		log.Warn("circuit breaker open, skipping backup", "open_until", until.Format(time.RFC3339))
+		return nil, fmt.Errorf("%w: circuit breaker open until %s", backup.ErrMongoConnect, until.Format(time.RFC3339))
+	}
+
+	// A pipelined or streamed run uploads while it dumps; see
+	// backup.BackUpAndUpload
+	pipelined := (cfg.Upload.Pipeline || cfg.Upload.Stream) && cfg.Archive.PerDatabase
+	if pipelined {
+		err = backup.BackUpAndUpload(ctx, cfg)
+	} else {
+		err = backup.BackUp(ctx, cfg)
+	}
+	if err == nil {
+		checkSizeAnomaly(runID, cfg)
+	}
+	if errors.Is(err, backup.ErrMongoConnect) {
+		if mongoBreaker.failure() {
+			log.Warn("circuit breaker opened after repeated connection failures")
+		}
+	} else {
+		mongoBreaker.success()
+	}
+
+	if err == nil && !pipelined {
+		err = backup.UploadToS3(ctx, cfg)
+	}
+	if err == nil {
+		if promoteErr := backup.PromoteManifest(cfg); promoteErr != nil {
+			log.Warn("failed to store manifest baseline", "error", promoteErr)
+		}
+	}
+
+	// A backup that does not restore is no reason to prune older ones
+	if err == nil && cfg.RestoreCheck.Enabled && *uploadedKey != "" {
+		err = checkRestore(ctx, runID, cfg, *uploadedKey)
+	}
+
+	// Only prune once a new backup is safely stored
+	if err == nil {
+		if retentionErr := backup.ApplyRetention(ctx, cfg); retentionErr != nil {
+			log.Warn("retention sweep failed", "error", retentionErr)
+		}
+	}
+
+	// Storage grew (or a failed upload left parts behind); update the gauges
+	// without holding up the run
+	go refreshStorageMetrics(context.WithoutCancel(ctx), cfg)
+
+	if abortErr := backup.AbortStaleUploads(ctx, cfg); abortErr != nil {
+		log.Warn("stale upload cleanup failed", "error", abortErr)
+	}
+
+	// The manifest goes with the dump folder
+	if m, readErr := backup.ReadManifest(cfg); readErr == nil {
+		manifest = &m
+	}
+	if cleanErr := backup.CleanExportsFolder(ctx, cfg); cleanErr != nil && err == nil {
+		err = cleanErr
+	}
+
+	return manifest, err
+}
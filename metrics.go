@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"mongodb_backup/pkg/backup"
+)
+
+var (
+	storageBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "backup_storage_bytes_total",
+		Help: "Bytes stored in backup objects, per destination.",
+	}, []string{"destination"})
+	storageObjects = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "backup_storage_objects_total",
+		Help: "Number of backup objects, per destination.",
+	}, []string{"destination"})
+	storageMeasured = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backup_storage_last_measured_timestamp_seconds",
+		Help: "Unix time of the last successful storage measurement.",
+	})
+	jobPanics = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backup_job_panics_total",
+		Help: "Scheduled backup runs that panicked and were recovered.",
+	})
+	sizeAnomalies = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backup_size_anomalies_total",
+		Help: "Backups whose size deviated from the recent average by more than SIZE_DEVIATION_THRESHOLD.",
+	})
+	lastSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backup_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful backup run.",
+	})
+	lastRestoreCheckPassed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backup_last_restore_check_success",
+		Help: "1 when the last backup restored into an ephemeral mongod, 0 when it did not.",
+	})
+	restoreCheckDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backup_last_restore_check_duration_seconds",
+		Help: "Time the last restore check took, including starting the ephemeral mongod.",
+	})
+	lastBackupSuspicious = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backup_last_suspicious",
+		Help: "1 when the last dumped backup was marked suspicious for its size, 0 otherwise.",
+	})
+)
+
+// storageMeasuring ensures one bucket listing at a time; a refresh that
+// finds one in progress is dropped.
+var storageMeasuring sync.Mutex
+
+// storageMetricsServed is set by startStorageMetrics. Without a /metrics
+// endpoint, as in -once mode, nothing is measured.
+var storageMetricsServed atomic.Bool
+
+// refreshStorageMetrics lists the destinations and updates the storage
+// gauges. Scrapes only read the cached gauges.
+func refreshStorageMetrics(ctx context.Context, cfg backup.Config) {
+	if !storageMetricsServed.Load() || !storageMeasuring.TryLock() {
+		return
+	}
+	defer storageMeasuring.Unlock()
+
+	usage, err := backup.MeasureStorage(ctx, cfg)
+	if err != nil {
+		logger.Warn("failed to measure backup storage", "error", err)
+		return
+	}
+	for _, u := range usage {
+		storageBytes.WithLabelValues(u.Destination).Set(float64(u.Bytes))
+		storageObjects.WithLabelValues(u.Destination).Set(float64(u.Objects))
+	}
+	storageMeasured.SetToCurrentTime()
+}
+
+// startStorageMetrics measures storage now and then every interval until
+// ctx is done. An interval of 0 only measures after each run.
+func startStorageMetrics(ctx context.Context, cfg backup.Config, interval time.Duration) {
+	storageMetricsServed.Store(true)
+	go refreshStorageMetrics(ctx, cfg)
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				refreshStorageMetrics(ctx, cfg)
+			}
+		}
+	}()
+}
@@ -0,0 +1,446 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"cmp"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Archive formats selectable with ArchiveConfig.Format.
+const (
+	FormatZip    = "zip"
+	FormatTarGz  = "tar.gz"
+	FormatTarZst = "tar.zst"
+	FormatTarBr  = "tar.br"
+	FormatTar    = "tar"
+)
+
+// CheckArchiveFormat reports whether format is one of the archive formats.
+func CheckArchiveFormat(format string) error {
+	switch format {
+	case FormatZip, FormatTarGz, FormatTarZst, FormatTarBr, FormatTar:
+		return nil
+	default:
+		return fmt.Errorf("unknown archive format %q (expected zip, tar.gz, tar.zst, tar.br or tar)", format)
+	}
+}
+
+// archiveExtension returns the file extension, including the dot, for an
+// archive format.
+func archiveExtension(format string) string {
+	switch format {
+	case FormatTarGz:
+		return ".tar.gz"
+	case FormatTarZst:
+		return ".tar.zst"
+	case FormatTarBr:
+		return ".tar.br"
+	case FormatTar:
+		return ".tar"
+	default:
+		return ".zip"
+	}
+}
+
+// archiveContentType returns the Content-Type for an archive. Plain tar
+// has no magic bytes at the start, so it cannot be sniffed, and
+// http.DetectContentType does not know zstd. A tar.br is served as a tar
+// with the Content-Encoding of archiveContentEncoding.
+func archiveContentType(format, path string) (string, error) {
+	switch format {
+	case FormatTar, FormatTarBr:
+		return "application/x-tar", nil
+	case FormatTarZst:
+		return "application/zstd", nil
+	}
+	return detectContentType(path)
+}
+
+// archiveContentEncoding returns the Content-Encoding for an archive, so
+// that a web client decompresses a tar.br on the fly. The other formats
+// are compressed files in their own right and have none.
+func archiveContentEncoding(format string) string {
+	if format == FormatTarBr {
+		return "br"
+	}
+	return ""
+}
+
+// archiveFolder writes source to target in the configured format, creating
+// target with perm. With enc.Mode EncryptionAge the archive is encrypted as
+// it is written, so it never reaches the disk in the clear.
+func archiveFolder(ctx context.Context, source, target string, perm os.FileMode, cfg ArchiveConfig, enc EncryptionConfig, comment string) (err error) {
+	ctx, span := tracer.Start(ctx, "backup.archive", trace.WithAttributes(
+		attribute.String("backup.source", source), attribute.String("backup.format", cmp.Or(cfg.Format, FormatZip))))
+	defer func() { endSpan(span, err) }()
+	err = writeArchiveFile(target, perm, func(w io.Writer) error {
+		sealed, err := sealWriter(enc, w)
+		if err != nil {
+			return err
+		}
+		if err := writeArchive(ctx, contextWriter{ctx, sealed}, source, cfg, comment); err != nil {
+			return err
+		}
+		return sealed.Close()
+	})
+	if info, statErr := os.Stat(target); err == nil && statErr == nil {
+		span.SetAttributes(attribute.Int64("backup.bytes", info.Size()))
+	}
+	return err
+}
+
+// contextWriter stops writing an archive once ctx is done, since the
+// archive writers do not take a context.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// writeArchive writes source as an archive in the configured format to w,
+// which need not be seekable.
+func writeArchive(ctx context.Context, w io.Writer, source string, cfg ArchiveConfig, comment string) error {
+	cfg = resolveCompressionLevel(ctx, source, cfg)
+	switch cfg.Format {
+	case FormatTarGz:
+		return writeTarGz(w, source, cfg, comment)
+	case FormatTarZst:
+		return writeTarZst(w, source, cfg, comment)
+	case FormatTarBr:
+		return writeTarBr(w, source, cfg, comment)
+	case FormatTar:
+		return writeTar(w, source, cfg, comment)
+	default:
+		return writeZip(w, source, cfg, comment)
+	}
+}
+
+// writeArchiveFile creates target with perm and fills it with write.
+func writeArchiveFile(target string, perm os.FileMode, write func(io.Writer) error) error {
+	out, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := write(out); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// walkArchiveEntries calls fn for every file and directory below source
+// with its portable archive entry name. The source folder itself is skipped.
+func walkArchiveEntries(source string, fn func(name, path string, info os.FileInfo) error) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		name, err := zipEntryName(relPath)
+		if err != nil {
+			return err
+		}
+		return fn(name, path, info)
+	})
+}
+
+// copyFileTo copies the file at path into w through a buffer of bufSize
+// bytes, or io.Copy's default when bufSize is 0.
+func copyFileTo(w io.Writer, path string, bufSize int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if bufSize <= 0 {
+		_, err = io.Copy(w, file)
+		return err
+	}
+	// Hide the file's WriteTo, which would bypass the buffer
+	_, err = io.CopyBuffer(w, struct{ io.Reader }{file}, make([]byte, bufSize))
+	return err
+}
+
+// ZipFolder archives the contents of source into target. A non-empty
+// comment is stored as the zip archive comment.
+func ZipFolder(source, target, comment string) error {
+	return writeArchiveFile(target, 0666, func(w io.Writer) error {
+		return writeZip(w, source, ArchiveConfig{}, comment)
+	})
+}
+
+func writeZip(w io.Writer, source string, cfg ArchiveConfig, comment string) error {
+	archive := zip.NewWriter(w)
+	if cfg.Level != 0 {
+		archive.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, cfg.Level)
+		})
+	}
+	if comment != "" {
+		if err := archive.SetComment(comment); err != nil {
+			return err
+		}
+	}
+
+	err := walkArchiveEntries(source, func(name, path string, info os.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+
+		switch {
+		case info.IsDir():
+			header.Name += "/"
+		case storedEntry(name, cfg.StorePatterns):
+			header.Method = zip.Store
+		default:
+			header.Method = zip.Deflate
+		}
+
+		writer, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return copyFileTo(writer, path, cfg.CopyBufferSize)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// storedEntry reports whether the archive entry name matches one of
+// patterns and is stored in a zip without compression. A pattern with a
+// slash is matched against the whole name, e.g. media/fs.chunks.bson;
+// one without against the file name alone, e.g. *.chunks.bson.
+func storedEntry(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		subject := name
+		if !strings.Contains(pattern, "/") {
+			subject = path.Base(name)
+		}
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// TarGzFolder archives the contents of source into a gzip-compressed tar at
+// target. With parallelism above 1 the gzip stream is compressed by that
+// many goroutines (github.com/klauspost/pgzip); the output is a regular
+// gzip file either way. A non-empty comment is stored in the gzip header.
+func TarGzFolder(source, target string, parallelism int, comment string) error {
+	return writeArchiveFile(target, 0666, func(w io.Writer) error {
+		return writeTarGz(w, source, ArchiveConfig{Parallelism: parallelism}, comment)
+	})
+}
+
+func writeTarGz(out io.Writer, source string, cfg ArchiveConfig, comment string) error {
+	var gz io.WriteCloser
+	if cfg.Parallelism > 1 {
+		blockSize := cfg.BlockSize
+		if blockSize <= 0 {
+			blockSize = pgzipBlockSize
+		}
+		w, err := pgzip.NewWriterLevel(out, compressionLevel(cfg))
+		if err != nil {
+			return err
+		}
+		if err := w.SetConcurrency(blockSize, cfg.Parallelism); err != nil {
+			return err
+		}
+		w.Comment = comment
+		gz = w
+	} else {
+		w, err := gzip.NewWriterLevel(out, compressionLevel(cfg))
+		if err != nil {
+			return err
+		}
+		w.Comment = comment
+		gz = w
+	}
+
+	if err := writeTar(gz, source, cfg, ""); err != nil {
+		gz.Close()
+		return err
+	}
+	return gz.Close()
+}
+
+// writeTarZst writes a zstd-compressed tar on cfg.Parallelism goroutines.
+// zstd frames have no comment field, so a non-empty comment goes into a
+// PAX global header as for a plain tar. With cfg.dictionary set, the
+// frames reference it and only decompress with the same dictionary.
+func writeTarZst(out io.Writer, source string, cfg ArchiveConfig, comment string) error {
+	opts := []zstd.EOption{
+		zstd.WithEncoderLevel(zstdLevel(cfg)),
+		zstd.WithEncoderConcurrency(max(cfg.Parallelism, 1)),
+	}
+	if cfg.dictionary != nil {
+		opts = append(opts, zstd.WithEncoderDict(cfg.dictionary))
+	}
+	zw, err := zstd.NewWriter(out, opts...)
+	if err != nil {
+		return err
+	}
+	if err := writeTar(zw, source, cfg, comment); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// zstdLevel maps cfg.Level onto the encoder's four speeds: 1-2 fastest,
+// 3-5 default, 6-8 better and 9 best compression. 0 is the default.
+func zstdLevel(cfg ArchiveConfig) zstd.EncoderLevel {
+	switch cfg.Level {
+	case 0:
+		return zstd.SpeedDefault
+	case 9:
+		return zstd.SpeedBestCompression
+	}
+	return zstd.EncoderLevelFromZstd(cfg.Level)
+}
+
+// writeTarBr writes a brotli-compressed tar. Brotli compresses on a single
+// core and much slower than gzip or zstd at the same ratio, in exchange
+// for the best ratio a web client decompresses natively. Like zstd, it
+// has no comment field, so a non-empty comment goes into a PAX global
+// header.
+func writeTarBr(out io.Writer, source string, cfg ArchiveConfig, comment string) error {
+	bw := brotli.NewWriterOptions(out, brotli.WriterOptions{Quality: brotliQuality(cfg), LGWin: brotliWindowBits})
+	if err := writeTar(bw, source, cfg, comment); err != nil {
+		bw.Close()
+		return err
+	}
+	return bw.Close()
+}
+
+// brotliWindowBits is the largest window every brotli decoder, browsers
+// included, has to support: 16 MiB.
+const brotliWindowBits = 24
+
+// brotliQuality maps cfg.Level onto the brotli qualities: 1 to 8 as they
+// are and 9 the best, 11. 0 is brotli's default, 6.
+func brotliQuality(cfg ArchiveConfig) int {
+	switch cfg.Level {
+	case 0:
+		return brotli.DefaultCompression
+	case 9:
+		return brotli.BestCompression
+	}
+	return cfg.Level
+}
+
+// compressionLevel is cfg.Level, or the default level when it is 0.
+func compressionLevel(cfg ArchiveConfig) int {
+	if cfg.Level == 0 {
+		return gzip.DefaultCompression
+	}
+	return cfg.Level
+}
+
+// pgzipBlockSize is the default amount of input each pgzip goroutine
+// compresses at a time.
+const pgzipBlockSize = 1 << 20
+
+// TarFolder archives the contents of source into an uncompressed tar at
+// target, which restore tooling can extract while streaming. A non-empty
+// comment is stored in a leading PAX global header.
+func TarFolder(source, target, comment string) error {
+	return writeArchiveFile(target, 0666, func(w io.Writer) error {
+		return writeTar(w, source, ArchiveConfig{}, comment)
+	})
+}
+
+// writeTar writes the contents of source as a tar stream to w. A non-empty
+// comment is written as the "comment" record of a PAX global header.
+func writeTar(w io.Writer, source string, cfg ArchiveConfig, comment string) error {
+	tw := tar.NewWriter(w)
+	if comment != "" {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			Name:       "pax_global_header",
+			PAXRecords: map[string]string{"comment": comment},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err := walkArchiveEntries(source, func(name, path string, info os.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			return copyFileTo(tw, path, cfg.CopyBufferSize)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// zipEntryName turns a path relative to the backup folder into a portable
+// zip entry name: forward slashes only, no leading slash and no ".."
+// segments that could escape the extraction directory. Drive letters and
+// backslashes are only path syntax on Windows; elsewhere they are part of
+// a name, as in a database called c:orders or a collection called a\b.
+func zipEntryName(relPath string) (string, error) {
+	name := filepath.ToSlash(strings.TrimPrefix(relPath, filepath.VolumeName(relPath)))
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("zip entry %q contains a parent directory reference", relPath)
+		}
+	}
+
+	name = strings.TrimLeft(path.Clean("/"+name), "/")
+	if name == "" {
+		return "", fmt.Errorf("invalid zip entry name %q", relPath)
+	}
+	return name, nil
+}
@@ -0,0 +1,180 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveFormatOf derives the archive format from a file name or key.
+func archiveFormatOf(name string) (string, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"):
+		return FormatTarGz, nil
+	case strings.HasSuffix(name, ".tar.zst"):
+		return FormatTarZst, nil
+	case strings.HasSuffix(name, ".tar.br"):
+		return FormatTarBr, nil
+	case strings.HasSuffix(name, ".tar"):
+		return FormatTar, nil
+	case strings.HasSuffix(name, ".zip"):
+		return FormatZip, nil
+	default:
+		return "", fmt.Errorf("unknown archive format for %q", name)
+	}
+}
+
+// extractArchive unpacks the archive at path into dir, choosing the format
+// from the file name. dict is the zstd dictionary of the run the archive
+// belongs to, or nil. Folders and files are created with dirMode and
+// fileMode.
+func extractArchive(path, dir string, dict []byte, dirMode, fileMode os.FileMode) error {
+	format, err := archiveFormatOf(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatZip:
+		return extractZip(path, dir, dirMode, fileMode)
+	default:
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		var r io.Reader = file
+		switch format {
+		case FormatTarGz:
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			r = gz
+		case FormatTarZst:
+			zr, err := newZstdReader(file, dict)
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			r = zr
+		case FormatTarBr:
+			r = brotli.NewReader(file)
+		}
+		return extractTar(r, dir, dirMode, fileMode)
+	}
+}
+
+// newZstdReader decompresses the zstd stream r, with dict when the frames
+// were compressed with a dictionary.
+func newZstdReader(r io.Reader, dict []byte) (*zstd.Decoder, error) {
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if dict != nil {
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+	return zstd.NewReader(r, opts...)
+}
+
+// extractTarget returns where an archive entry is written, refusing names
+// that would land outside dir.
+func extractTarget(dir, name string) (string, error) {
+	clean, err := zipEntryName(strings.TrimSuffix(name, "/"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+func extractZip(path, dir string, dirMode, fileMode os.FileMode) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		target, err := extractTarget(dir, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, dirMode); err != nil {
+				return err
+			}
+			continue
+		}
+		src, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = writeExtractedFile(target, src, dirMode, fileMode)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTar(r io.Reader, dir string, dirMode, fileMode os.FileMode) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			target, err := extractTarget(dir, header.Name)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, dirMode); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			target, err := extractTarget(dir, header.Name)
+			if err != nil {
+				return err
+			}
+			if err := writeExtractedFile(target, tr, dirMode, fileMode); err != nil {
+				return err
+			}
+		default:
+			// The PAX global header carrying the archive comment, and
+			// anything else a dump never contains, is skipped
+		}
+	}
+}
+
+func writeExtractedFile(target string, src io.Reader, dirMode, fileMode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), dirMode); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
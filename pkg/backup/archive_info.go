@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Version is the version of the tool, set at build time with
+// -ldflags "-X mongodb_backup/pkg/backup.Version=v1.2.3". It is recorded in
+// the archive comment and as metadata on every uploaded object.
+var Version = "dev"
+
+// maxZipComment is the largest comment the zip format can hold.
+const maxZipComment = 1<<16 - 1
+
+// ArchiveInfo is stored as JSON in the zip archive comment so that an
+// archive describes itself without being extracted.
+type ArchiveInfo struct {
+	Cluster     string    `json:"cluster"`
+	CreatedAt   time.Time `json:"created_at"`
+	Databases   []string  `json:"databases,omitempty"`
+	ToolVersion string    `json:"tool_version"`
+	// Truncated is set when the database list did not fit in the comment
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// archiveComment builds the comment for the archive of cfg.OutputDir from
+// the manifest written by BackUp. Failures are logged and yield no comment.
+func archiveComment(ctx context.Context, cfg Config) string {
+	info := ArchiveInfo{
+		Cluster:     cfg.Mongo.ClusterURI,
+		CreatedAt:   time.Now().UTC(),
+		ToolVersion: Version,
+	}
+	if m, err := readManifest(filepath.Join(cfg.OutputDir, manifestFileName)); err == nil {
+		info.CreatedAt = m.CreatedAt
+		for _, db := range m.Databases {
+			info.Databases = append(info.Databases, db.Name)
+		}
+	}
+
+	data, err := json.Marshal(info)
+	if err == nil && len(data) > maxZipComment {
+		info.Databases, info.Truncated = nil, true
+		data, err = json.Marshal(info)
+	}
+	if err != nil {
+		LoggerFrom(ctx).Warn("failed to build archive comment", "error", err)
+		return ""
+	}
+	return asciiJSON(data)
+}
+
+// asciiJSON escapes non-ASCII characters as \uXXXX. gzip header comments
+// must be Latin-1, and database names may be any UTF-8.
+func asciiJSON(data []byte) string {
+	var b strings.Builder
+	for _, r := range string(data) {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+			continue
+		}
+		if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+			fmt.Fprintf(&b, "\\u%04x\\u%04x", r1, r2)
+		} else {
+			fmt.Fprintf(&b, "\\u%04x", r)
+		}
+	}
+	return b.String()
+}
+
+// ReadArchiveInfo returns the metadata stored in the comment of a zip, tar,
+// tar.gz, tar.zst or tar.br archive. ok is false when the archive has no such
+// comment, e.g. because it was created by an older version.
+func ReadArchiveInfo(path string) (info ArchiveInfo, ok bool, err error) {
+	var comment string
+	switch {
+	case strings.HasSuffix(path, ".tar"):
+		file, err := os.Open(path)
+		if err != nil {
+			return info, false, err
+		}
+		defer file.Close()
+		header, err := tar.NewReader(file).Next()
+		if err != nil {
+			return info, false, err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			comment = header.PAXRecords["comment"]
+		}
+	case strings.HasSuffix(path, ".tar.zst"):
+		file, err := os.Open(path)
+		if err != nil {
+			return info, false, err
+		}
+		defer file.Close()
+		zr, err := newZstdReader(file, nil)
+		if err != nil {
+			return info, false, err
+		}
+		defer zr.Close()
+		header, err := tar.NewReader(zr).Next()
+		if err != nil {
+			return info, false, err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			comment = header.PAXRecords["comment"]
+		}
+	case strings.HasSuffix(path, ".tar.br"):
+		file, err := os.Open(path)
+		if err != nil {
+			return info, false, err
+		}
+		defer file.Close()
+		header, err := tar.NewReader(brotli.NewReader(file)).Next()
+		if err != nil {
+			return info, false, err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			comment = header.PAXRecords["comment"]
+		}
+	case strings.HasSuffix(path, ".tar.gz"):
+		file, err := os.Open(path)
+		if err != nil {
+			return info, false, err
+		}
+		defer file.Close()
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return info, false, err
+		}
+		comment = gz.Comment
+	default:
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return info, false, err
+		}
+		defer r.Close()
+		comment = r.Comment
+	}
+
+	if comment == "" || json.Unmarshal([]byte(comment), &info) != nil {
+		return ArchiveInfo{}, false, nil
+	}
+	return info, true, nil
+}
@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestZipEntryName(t *testing.T) {
+	type test struct {
+		relPath string
+		want    string
+		wantErr bool
+	}
+	tests := []test{
+		{relPath: "orders/items.bson", want: "orders/items.bson"},
+		{relPath: "/orders/items.bson", want: "orders/items.bson"},
+		{relPath: "//orders//items.bson", want: "orders/items.bson"},
+		{relPath: "./orders/./items.bson", want: "orders/items.bson"},
+		{relPath: "orders/a..b.bson", want: "orders/a..b.bson"},
+		{relPath: "..orders/items..bson", want: "..orders/items..bson"},
+		{relPath: "../items.bson", wantErr: true},
+		{relPath: "orders/../../items.bson", wantErr: true},
+		{relPath: "orders/..", wantErr: true},
+		{relPath: "/", wantErr: true},
+		{relPath: "", wantErr: true},
+	}
+	if filepath.Separator == '\\' {
+		tests = append(tests, []test{
+			{relPath: `orders\items.bson`, want: "orders/items.bson"},
+			{relPath: `\orders\items.bson`, want: "orders/items.bson"},
+			{relPath: `C:\orders\items.bson`, want: "orders/items.bson"},
+			{relPath: `orders\..\..\items.bson`, wantErr: true},
+		}...)
+	} else {
+		// A database called c:orders and a collection called a\b are
+		// names, not a drive letter and a folder
+		tests = append(tests, []test{
+			{relPath: "c:orders/items.bson", want: "c:orders/items.bson"},
+			{relPath: "C:/orders/items.bson", want: "C:/orders/items.bson"},
+			{relPath: `orders/a\b.bson`, want: `orders/a\b.bson`},
+			{relPath: `orders/..\items.bson`, want: `orders/..\items.bson`},
+		}...)
+	}
+	for _, tt := range tests {
+		got, err := zipEntryName(tt.relPath)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("zipEntryName(%q) error = %v, want error: %v", tt.relPath, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("zipEntryName(%q) = %q, want %q", tt.relPath, got, tt.want)
+		}
+	}
+}
+
+func TestExtractTargetKeepsDatabaseNames(t *testing.T) {
+	if filepath.Separator == '\\' {
+		t.Skip("drive letters and backslashes are path syntax on Windows")
+	}
+	dir := t.TempDir()
+	for name, want := range map[string]string{
+		"c:orders/items.bson": filepath.Join(dir, "c:orders", "items.bson"),
+		`orders/a\b.bson`:     filepath.Join(dir, "orders", `a\b.bson`),
+	} {
+		got, err := extractTarget(dir, name)
+		if err != nil {
+			t.Errorf("extractTarget(%q): %v", name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("extractTarget(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExtractArchiveAppliesUmask(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no such mode bits")
+	}
+	cfg := uploadTestConfig(t)
+	cfg.Archive.Format = FormatTar
+	archivePath := archiveName(time.Now(), "", FormatTar)
+	out, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeArchive(context.Background(), out, cfg.OutputDir, cfg.Archive, ""); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	dir := filepath.Join(t.TempDir(), "restore")
+	if err := extractArchive(archivePath, dir, nil, cfg.DirMode(), cfg.FileMode()); err != nil {
+		t.Fatalf("extractArchive: %v", err)
+	}
+	for path, want := range map[string]os.FileMode{
+		filepath.Join(dir, "orders"):                         0o700,
+		filepath.Join(dir, "orders", "orders", "items.bson"): 0o600,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s has mode %o, want %o", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditEntry records an operator action, such as a manual backup or a
+// restore, for compliance audits.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Principal is who acted: the identity a proxy authenticated, the
+	// basic auth user, or the OS user of a command.
+	Principal string `json:"principal"`
+	// Source is the client address of an HTTP request or the host a
+	// command ran on.
+	Source    string   `json:"source,omitempty"`
+	RunID     string   `json:"run_id,omitempty"`
+	Label     string   `json:"label,omitempty"`
+	Key       string   `json:"key,omitempty"`
+	Databases []string `json:"databases,omitempty"`
+	// Outcome is e.g. "accepted", "rejected", "succeeded" or "failed".
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// StoreAuditEntry writes entry to every destination as its own object
+// below cfg.AuditPrefix, <prefix>/2006/01/02/<time>-<action>.json. Objects
+// are never rewritten, so versioning or object lock on the prefix keeps
+// every entry. Nothing is stored without an AuditPrefix.
+func StoreAuditEntry(ctx context.Context, cfg Config, entry AuditEntry) error {
+	if cfg.AuditPrefix == "" {
+		return nil
+	}
+	if len(destinations) == 0 {
+		return errors.New("no storage destination configured")
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	t := entry.Time.UTC()
+	name := fmt.Sprintf("%s/%s-%s", t.Format("2006/01/02"), t.Format("20060102T150405.000000000Z"), entry.Action)
+	if entry.RunID != "" {
+		name += "-" + entry.RunID
+	}
+	key := cfg.clusterKey(strings.TrimSuffix(cfg.AuditPrefix, "/") + "/" + name + ".json")
+
+	var errs []error
+	for _, dest := range destinations {
+		err := dest.Upload(ctx, Object{
+			Key:         key,
+			Body:        bytes.NewReader(data),
+			ContentType: "application/json",
+			Metadata:    map[string]string{toolVersionMetadata: Version},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dest.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
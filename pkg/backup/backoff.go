@@ -0,0 +1,36 @@
+package backup
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"time"
+)
+
+// Defaults of Backoff.Base and Backoff.Max.
+const (
+	defaultRetryBase     = 5 * time.Second
+	defaultRetryMaxDelay = time.Minute
+)
+
+// Backoff is the wait before an upload is retried. It doubles from Base
+// with every failed attempt up to Max. With Jitter, a random wait between
+// zero and that is taken instead ("full jitter"), so that uploads failing
+// together, e.g. every cluster in an S3 outage, do not retry together.
+type Backoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter bool
+}
+
+// delay is the wait after the attempt-th failed attempt, counting from 1.
+func (b Backoff) delay(attempt int) time.Duration {
+	limit := cmp.Or(b.Max, defaultRetryMaxDelay)
+	wait := min(cmp.Or(b.Base, defaultRetryBase), limit)
+	for i := 1; i < attempt && wait < limit; i++ {
+		wait = min(wait*2, limit)
+	}
+	if b.Jitter {
+		wait = rand.N(wait + 1).Truncate(time.Millisecond)
+	}
+	return wait
+}
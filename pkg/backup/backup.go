@@ -0,0 +1,466 @@
+// Package backup dumps MongoDB databases with mongodump, archives the dump
+// and uploads it to one or more storage destinations.
+package backup
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Default deadlines for reaching the cluster and listing its databases.
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultListTimeout    = time.Minute
+)
+
+// BackUp dumps every selected database into OutputDir and writes the
+// backup manifest next to the dumps. With cfg.ExternalArchive, that file
+// is staged instead and the cluster is not contacted.
+func BackUp(ctx context.Context, cfg Config) (err error) {
+	ctx, span := tracer.Start(ctx, "backup.dump")
+	defer func() { endSpan(span, err) }()
+	log := LoggerFrom(ctx)
+
+	outputDir := cfg.OutputDir
+	warnLoosePermissions(ctx, cfg, outputDir)
+	if err := os.MkdirAll(outputDir, cfg.DirMode()); err != nil {
+		return fmt.Errorf("%w: failed to create output directory: %w", ErrDumpFailed, err)
+	}
+	if cfg.ExternalArchive != "" {
+		return stageArchive(ctx, cfg)
+	}
+
+	connectStarted := time.Now()
+	client, err := connectCluster(ctx, cfg.Mongo)
+	recordStage(ctx, StageConnect, connectStarted)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	// Listing and dumping the databases make up the dump stage
+	defer recordStage(ctx, StageDump, time.Now())
+	ctx, cancelStage := withStageDeadline(ctx, StageDump, cfg.Timeouts.Dump)
+	defer cancelStage()
+
+	// Get list of database names, which gets its own deadline
+	listCtx, cancel := context.WithTimeout(ctx, cmp.Or(cfg.Mongo.ListTimeout, defaultListTimeout))
+	defer cancel()
+	var dbs []string
+	err = retryFailover(listCtx, cfg.FailoverGrace, "list databases", func() (err error) {
+		dbs, err = listDatabases(listCtx, cfg, client)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%w: failed to list databases: %w", ErrMongoConnect, stageError(ctx, err))
+	}
+
+	// A sharded cluster is only dumped through the coordinated path
+	var sharded bool
+	err = retryFailover(listCtx, cfg.FailoverGrace, "detect cluster topology", func() (err error) {
+		sharded, err = isShardedCluster(listCtx, client)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%w: failed to detect cluster topology: %w", ErrMongoConnect, err)
+	}
+	if sharded {
+		release, err := prepareShardedDump(ctx, cfg, client)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	var selected []string
+	limited := 0
+	for _, dbName := range dbs {
+		// Skip internal databases (optional)
+		if dbName == "admin" || dbName == "local" || dbName == "config" {
+			continue
+		}
+		if !cfg.databaseSelected(dbName) {
+			log.Info("skipping database, filtered out", "db", dbName)
+			continue
+		}
+		if cfg.MaxDatabases > 0 && len(selected) == cfg.MaxDatabases {
+			limited++
+			continue
+		}
+		if cfg.SkipEmpty {
+			empty, err := emptyDatabase(listCtx, client, dbName)
+			if err != nil {
+				log.Warn("failed to list collections, dumping anyway", "db", dbName, "error", err)
+			} else if empty {
+				log.Info("skipping database, no collections", "db", dbName)
+				continue
+			}
+		}
+		selected = append(selected, dbName)
+	}
+	if limited > 0 {
+		log.Warn("database limit reached, skipping the remaining databases", "max_databases", cfg.MaxDatabases, "skipped", limited)
+	}
+	progress := newProgressTracker(ctx, selected)
+
+	var collStats map[string]collectionStats
+	if cfg.Manifest.CollectionStats {
+		collStats = reportCollectionStats(ctx, client, selected)
+	}
+
+	// Dump the databases, up to cfg.DumpConcurrency at a time
+	manifest := Manifest{CreatedAt: time.Now().UTC(), Label: cfg.Label, AppVersion: cfg.AppVersion, ViewsAsCollections: viewsAsCollections(cfg.DumpArgs)}
+	if cfg.Engine == EngineNative {
+		manifest.Engine = EngineNative
+	} else if manifest.DumpVersion, err = toolsVersion(ctx, "mongodump"); err != nil {
+		log.Warn("unable to record the mongodump version", "error", err)
+	}
+	var previous map[string]DatabaseManifest
+	if cfg.ChangedOnly {
+		previous = previousDatabases(cfg.StateDir)
+	}
+	dumped, _ := ctx.Value(dumpedKey{}).(func(string))
+
+	// Entries keep the order of selected whatever order the dumps end in
+	entries := make([]DatabaseManifest, len(selected))
+	var (
+		mu        sync.Mutex
+		attempted int
+		failed    int
+	)
+	dumpDatabase := func(ctx context.Context, i int, dbName string) error {
+		ctx, span := tracer.Start(ctx, "backup.dump_database", trace.WithAttributes(attribute.String("db.name", dbName)))
+		defer span.End()
+		log.Info("backing up database", "db", dbName)
+
+		var marker string
+		if cfg.ChangedOnly {
+			var err error
+			marker, err = changeMarker(ctx, client, dbName)
+			if err != nil {
+				log.Warn("failed to read change marker, dumping anyway", "db", dbName, "error", err)
+			} else if prev, ok := previous[dbName]; ok && prev.ChangeMarker == marker {
+				log.Info("skipping unchanged database", "db", dbName, "backed_up_at", prev.BackedUpAt)
+				prev.Unchanged = true
+				entries[i] = prev
+				progress.set(dbName, "unchanged")
+				span.SetAttributes(attribute.Bool("backup.unchanged", true))
+				return nil
+			}
+		}
+
+		dbManifest := collectDatabaseManifest(ctx, client, dbName)
+		if dbManifest.Error != "" {
+			log.Warn("failed to collect manifest", "db", dbName, "error", dbManifest.Error)
+		}
+		for c, coll := range dbManifest.Collections {
+			dbManifest.Collections[c].StorageSize = collStats[dbName+"."+coll.Name].StorageSize
+		}
+		dbManifest.ChangeMarker = marker
+		dbManifest.BackedUpAt = manifest.CreatedAt
+		if cfg.IndexSpecs && dbManifest.Error == "" {
+			if err := writeIndexSpecs(ctx, client, dbManifest, filepath.Join(outputDir, indexSpecsName(dbName)), cfg.FileMode()); err != nil {
+				log.Warn("failed to export index specs", "db", dbName, "error", err)
+			}
+		}
+
+		// Throttle: give the cluster a breather between dumps
+		mu.Lock()
+		throttle := attempted > 0 && cfg.DBDelay > 0
+		attempted++
+		mu.Unlock()
+		if throttle {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(cfg.DBDelay):
+			}
+		}
+
+		// Collections with a query are left out of the database dump and
+		// dumped one by one afterwards, since --query needs --collection
+		target := []string{
+			"--uri", cfg.Mongo.uri(dbName),
+			"--out", fmt.Sprintf("%s/%s", outputDir, dbName),
+		}
+		queried := cfg.queriedCollections(dbName)
+		dumps := [][]string{slices.Concat(target, excludeCollectionArgs(queried), cfg.DumpArgs)}
+		for _, coll := range queried {
+			dumps = append(dumps, slices.Concat(target,
+				[]string{"--collection", coll, "--query", cfg.DumpQueries[dbName+"."+coll]}, cfg.DumpArgs))
+		}
+
+		stdout, stderr := commandOutput(ctx), io.Writer(os.Stderr)
+
+		// Keep a copy of what mongodump reported inside the archive
+		var dumpLog *os.File
+		if cfg.DumpLogs {
+			var createErr error
+			dumpLog, createErr = os.OpenFile(filepath.Join(outputDir, dumpLogName(dbName)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, cfg.FileMode())
+			if createErr != nil {
+				log.Warn("failed to create mongodump log", "db", dbName, "error", createErr)
+			} else {
+				stdout = io.MultiWriter(stdout, dumpLog)
+				stderr = io.MultiWriter(stderr, dumpLog)
+			}
+		}
+
+		progress.set(dbName, "dumping")
+		var (
+			err   error
+			parts map[string]int
+		)
+		// A failover mid-dump is retried with the database dumped again
+		// from scratch
+		err = retryFailover(ctx, cfg.FailoverGrace, "dump "+dbName, func() error {
+			if err := os.RemoveAll(filepath.Join(outputDir, dbName)); err != nil {
+				return err
+			}
+			if cfg.Engine == EngineNative {
+				// The layout of mongodump --out dir/db: dir/db/db/*.bson
+				var err error
+				parts, err = dumpNative(ctx, client, cfg, dbName, filepath.Join(outputDir, dbName, dbName), stderr)
+				return err
+			}
+			for _, args := range dumps {
+				output := &outputTail{limit: 4 << 10}
+				cmd := exec.CommandContext(ctx, "mongodump", args...)
+				cmd.Stdout, cmd.Stderr = stdout, io.MultiWriter(stderr, output)
+				if err := cmd.Run(); err != nil {
+					return mongodumpFailover(err, output.String())
+				}
+			}
+			return nil
+		})
+		if dumpLog != nil {
+			dumpLog.Close()
+		}
+		if err != nil {
+			mu.Lock()
+			failed++
+			mu.Unlock()
+			progress.set(dbName, "failed")
+			log.Error("failed to dump database", "db", dbName, "error", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			// Never let a failed dump be treated as unchanged next time
+			dbManifest.ChangeMarker = ""
+			if cfg.Upload.Stream {
+				// A streamed run never uploads a partial dump
+				removeStreamedDump(ctx, cfg, dbName)
+			}
+			entries[i] = dbManifest
+			if cfg.Strict {
+				return fmt.Errorf("%w: %s: %w", ErrDumpFailed, dbName, err)
+			}
+			return nil
+		}
+
+		log.Info("database backed up", "db", dbName)
+		progress.set(dbName, "dumped")
+		for c, coll := range dbManifest.Collections {
+			dbManifest.Collections[c].Parts = parts[coll.Name]
+		}
+		if size, err := dirSize(filepath.Join(outputDir, dbName)); err != nil {
+			log.Warn("failed to measure dump", "db", dbName, "error", err)
+		} else {
+			dbManifest.Size = size
+			span.SetAttributes(attribute.Int64("backup.bytes", size))
+		}
+		entries[i] = dbManifest
+		if cfg.Verify && len(dbManifest.GridFSBuckets) > 0 {
+			// mongodump --uri .../db --out dir/db writes dir/db/db/*.bson
+			verifyGridFS(ctx, filepath.Join(outputDir, dbName, dbName), dbName, dbManifest.GridFSBuckets)
+		}
+		if cfg.Verify && len(dbManifest.Views) > 0 && !manifest.ViewsAsCollections {
+			verifyViews(ctx, filepath.Join(outputDir, dbName, dbName), dbName, dbManifest.Views)
+		}
+		if dumped != nil {
+			dumped(dbName)
+		}
+		return nil
+	}
+
+	// The first error (a failed dump in strict mode) stops the others
+	dumpCtx, stopDumps := context.WithCancel(ctx)
+	defer stopDumps()
+	var (
+		wg      sync.WaitGroup
+		stopErr error
+	)
+	slots := make(chan struct{}, max(cfg.DumpConcurrency, 1))
+	for i, dbName := range selected {
+		select {
+		case slots <- struct{}{}:
+		case <-dumpCtx.Done():
+		}
+		if dumpCtx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := dumpDatabase(dumpCtx, i, dbName); err != nil {
+				mu.Lock()
+				if stopErr == nil {
+					stopErr = err
+				}
+				mu.Unlock()
+				stopDumps()
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		var timeout *StageTimeoutError
+		if errors.As(context.Cause(ctx), &timeout) {
+			return fmt.Errorf("%w: %w", ErrDumpFailed, timeout)
+		}
+		return fmt.Errorf("%w: backup cancelled: %w", ErrDumpFailed, err)
+	}
+	if stopErr != nil {
+		return stopErr
+	}
+	manifest.Databases = entries
+
+	// Outside strict mode a partial dump is still uploaded; only fail when
+	// nothing was dumped
+	if attempted > 0 && failed == attempted {
+		return fmt.Errorf("%w: all %d database dumps failed", ErrDumpFailed, attempted)
+	}
+
+	// A suspicious backup is still uploaded, with the anomaly in its manifest
+	manifest.SizeAnomaly = checkBackupSize(ctx, cfg, manifest)
+	if err := writeManifest(cfg, filepath.Join(outputDir, manifestFileName), manifest); err != nil {
+		log.Warn("failed to write manifest", "error", err)
+	} else {
+		compareWithPreviousManifest(ctx, cfg, manifest)
+	}
+	if manifest.SizeAnomaly != nil {
+		postSizeAlert(ctx, cfg, manifest, *manifest.SizeAnomaly)
+	}
+	if cfg.RestoreScripts {
+		if err := writeRestoreScripts(cfg, outputDir, manifest); err != nil {
+			log.Warn("failed to write restore scripts", "error", err)
+		}
+	}
+
+	span.SetAttributes(attribute.Int("backup.databases", attempted), attribute.Int("backup.failed_databases", failed),
+		attribute.Int64("backup.bytes", manifestSize(manifest)))
+	log.Info("all backups completed", "databases", attempted, "failed", failed)
+	return nil
+}
+
+// connectCluster connects to m and pings it within m.ConnectTimeout, the
+// deadline of the connect stage. The error wraps ErrMongoConnect.
+func connectCluster(ctx context.Context, m MongoConfig) (*mongo.Client, error) {
+	connectCtx, cancel := withStageDeadline(ctx, StageConnect, cmp.Or(m.ConnectTimeout, defaultConnectTimeout))
+	defer cancel()
+	client, err := mongo.Connect(connectCtx, options.Client().ApplyURI(m.uri("")))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMongoConnect, stageError(connectCtx, err))
+	}
+	if err := client.Ping(connectCtx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("%w: %w", ErrMongoConnect, stageError(connectCtx, err))
+	}
+	return client, nil
+}
+
+// emptyDatabase reports whether dbName holds no collections or views.
+func emptyDatabase(ctx context.Context, client *mongo.Client, dbName string) (bool, error) {
+	names, err := client.Database(dbName).ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return false, err
+	}
+	return len(names) == 0, nil
+}
+
+// dumpLogSuffix marks the per-database mongodump logs written with
+// Config.DumpLogs.
+const dumpLogSuffix = ".mongodump.log"
+
+func dumpLogName(dbName string) string {
+	return dbName + dumpLogSuffix
+}
+
+// CleanExportsFolder removes everything inside cfg.OutputDir. Removals that
+// fail with a transient error, such as a file still locked by a virus
+// scanner or a network share, are retried up to cfg.CleanupAttempts times.
+func CleanExportsFolder(ctx context.Context, cfg Config) error {
+	dir := cfg.OutputDir
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		// Nothing was dumped, so there is nothing to clean
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("%w: %w", ErrCleanup, err)
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if err := removeWithRetry(ctx, path, cfg.CleanupAttempts); err != nil {
+			return fmt.Errorf("%w: %w", ErrCleanup, err)
+		}
+	}
+
+	return nil
+}
+
+// CheckWritable creates dir with perm if needed and verifies that files
+// can be created in it, so a misconfigured directory is reported at startup
+// rather than by the first run.
+func CheckWritable(dir string, perm os.FileMode) error {
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+func removeWithRetry(ctx context.Context, path string, attempts int) error {
+	attempts = max(attempts, 1)
+	wait := 500 * time.Millisecond
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = os.RemoveAll(path) // Removes both files and directories
+		if err == nil || !isTransientRemoveError(err) {
+			return err
+		}
+		if attempt < attempts {
+			LoggerFrom(ctx).Warn("cleanup failed, retrying", "path", path, "attempt", attempt, "wait", wait, "error", err)
+			// Cleanup also runs after shutdown was requested, so the wait
+			// deliberately ignores ctx
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultCatalogTimeout bounds writing a catalog entry when
+// CatalogConfig.Timeout is unset.
+const defaultCatalogTimeout = 30 * time.Second
+
+// Catalog entry statuses.
+const (
+	CatalogSucceeded = "succeeded"
+	CatalogFailed    = "failed"
+)
+
+// CatalogEntry is the document StoreCatalogEntry writes for a backup run,
+// one per run, so the backup history can be queried instead of listed.
+type CatalogEntry struct {
+	RunID      string    `bson:"run_id"`
+	Trigger    string    `bson:"trigger,omitempty"`
+	Label      string    `bson:"label,omitempty"`
+	AppVersion string    `bson:"app_version,omitempty"`
+	Cluster    string    `bson:"cluster,omitempty"`
+	StartedAt  time.Time `bson:"started_at"`
+	FinishedAt time.Time `bson:"finished_at"`
+	// Status is CatalogSucceeded or CatalogFailed.
+	Status string `bson:"status"`
+	Error  string `bson:"error,omitempty"`
+	// Key is the uploaded archive, or the index.json of a per-database
+	// run; empty when nothing was uploaded.
+	Key          string   `bson:"key,omitempty"`
+	Format       string   `bson:"format,omitempty"`
+	Destinations []string `bson:"destinations,omitempty"`
+	// Size is the uploaded archive, or the sum of the database archives
+	// of a per-database run.
+	Size int64 `bson:"size,omitempty"`
+	// Checksum is the content checksum, with DEDUP_UPLOADS, and
+	// ArchiveSHA256 the SHA-256 of the uploaded object, with
+	// CHECKSUM_SIDECAR.
+	Checksum      string            `bson:"checksum,omitempty"`
+	ArchiveSHA256 string            `bson:"archive_sha256,omitempty"`
+	ToolVersion   string            `bson:"tool_version"`
+	DumpVersion   string            `bson:"mongodump_version,omitempty"`
+	Databases     []CatalogDatabase `bson:"databases,omitempty"`
+	Suspicious    bool              `bson:"suspicious,omitempty"`
+}
+
+// CatalogDatabase summarizes a database of the run's manifest.
+type CatalogDatabase struct {
+	Name        string `bson:"name"`
+	Collections int    `bson:"collections"`
+	Documents   int64  `bson:"documents"`
+	Size        int64  `bson:"size"`
+	Unchanged   bool   `bson:"unchanged,omitempty"`
+	Error       string `bson:"error,omitempty"`
+}
+
+// NewCatalogEntry describes the backup uploaded as key, which may be
+// empty, and the run's manifest m, which may be nil. The size and
+// checksums of key are read from the first destination; what cannot be
+// read is left out. The caller fills in the run itself.
+func NewCatalogEntry(ctx context.Context, cfg Config, key string, m *Manifest) CatalogEntry {
+	entry := CatalogEntry{
+		Cluster:     cfg.ClusterName,
+		AppVersion:  cfg.AppVersion,
+		Key:         key,
+		ToolVersion: Version,
+	}
+	for _, dest := range destinations {
+		entry.Destinations = append(entry.Destinations, dest.Name())
+	}
+	if m != nil {
+		entry.DumpVersion = m.DumpVersion
+		entry.Suspicious = m.SizeAnomaly != nil
+		for _, db := range m.Databases {
+			c := CatalogDatabase{Name: db.Name, Collections: len(db.Collections), Size: db.Size, Unchanged: db.Unchanged, Error: db.Error}
+			for _, coll := range db.Collections {
+				c.Documents += coll.Documents
+			}
+			entry.Databases = append(entry.Databases, c)
+		}
+	}
+	if key == "" || len(destinations) == 0 {
+		return entry
+	}
+
+	log := LoggerFrom(ctx)
+	src := destinations[0]
+	info, err := src.Stat(ctx, key)
+	if err != nil {
+		log.Warn("unable to describe the backup for the catalog", "key", key, "error", err)
+		return entry
+	}
+	entry.Size = info.Size
+	entry.Checksum = info.Metadata[checksumMetadata]
+	entry.ArchiveSHA256 = info.Metadata[archiveSHA256Metadata]
+	if !isRunIndexKey(key) {
+		entry.Format, _ = archiveFormatOf(key)
+		return entry
+	}
+	index, err := readRunIndex(ctx, src, key)
+	if err != nil {
+		log.Warn("unable to describe the backup for the catalog", "key", key, "error", err)
+		return entry
+	}
+	entry.Format, entry.Size = index.Format, 0
+	for _, db := range index.Databases {
+		entry.Size += db.Size
+	}
+	return entry
+}
+
+// StoreCatalogEntry writes entry to cfg.Catalog.Collection, replacing an
+// earlier entry of the same run, and makes sure the collection is indexed
+// by run and by cluster and finish time. Nothing is written without a
+// collection.
+func StoreCatalogEntry(ctx context.Context, cfg Config, entry CatalogEntry) error {
+	if cfg.Catalog.Collection == "" {
+		return nil
+	}
+	dbName, collName, ok := strings.Cut(cfg.Catalog.Collection, ".")
+	if !ok {
+		return fmt.Errorf("invalid catalog collection %q", cfg.Catalog.Collection)
+	}
+	if entry.RunID == "" {
+		return errors.New("catalog entry without a run id")
+	}
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(cfg.Catalog.Timeout, defaultCatalogTimeout))
+	defer cancel()
+
+	target := cfg.Mongo
+	if cfg.Catalog.URI != "" {
+		target = MongoConfig{ClusterURI: cfg.Catalog.URI, ConnectTimeout: cfg.Mongo.ConnectTimeout}
+	}
+	client, err := connectCluster(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	coll := client.Database(dbName).Collection(collName)
+	_, err = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "run_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "cluster", Value: 1}, {Key: "finished_at", Value: -1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index %s: %w", cfg.Catalog.Collection, err)
+	}
+	_, err = coll.ReplaceOne(ctx, bson.D{{Key: "run_id", Value: entry.RunID}}, entry, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to write to %s: %w", cfg.Catalog.Collection, err)
+	}
+	LoggerFrom(ctx).Info("catalog entry stored", "collection", cfg.Catalog.Collection, "key", entry.Key, "status", entry.Status)
+	return nil
+}
@@ -0,0 +1,43 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// changeMarker summarises a database from dbStats. Two equal markers mean
+// "probably unchanged": the collection, document and index counts and the
+// total data size all match. Updates that do not change any of those (for
+// example overwriting a field with a value of the same size) go unnoticed.
+func changeMarker(ctx context.Context, client *mongo.Client, dbName string) (string, error) {
+	var stats struct {
+		Collections float64 `bson:"collections"`
+		Objects     float64 `bson:"objects"`
+		DataSize    float64 `bson:"dataSize"`
+		Indexes     float64 `bson:"indexes"`
+	}
+	err := client.Database(dbName).RunCommand(ctx, bson.D{{Key: "dbStats", Value: 1}}).Decode(&stats)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("collections=%.0f objects=%.0f dataSize=%.0f indexes=%.0f",
+		stats.Collections, stats.Objects, stats.DataSize, stats.Indexes), nil
+}
+
+// previousDatabases returns the per-database entries of the last
+// successfully uploaded manifest, keyed by database name.
+func previousDatabases(stateDir string) map[string]DatabaseManifest {
+	previous, err := readManifest(filepath.Join(stateDir, lastManifestFileName))
+	if err != nil {
+		return nil
+	}
+	entries := make(map[string]DatabaseManifest, len(previous.Databases))
+	for _, db := range previous.Databases {
+		entries[db.Name] = db
+	}
+	return entries
+}
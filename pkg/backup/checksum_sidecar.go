@@ -0,0 +1,207 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With UploadConfig.ChecksumSidecar, every archive is followed by
+// <key>.sha256, a sha256sum line for the stored bytes, and the same hash
+// is recorded in the archive's sha256 metadata.
+const (
+	checksumSidecarSuffix = ".sha256"
+	archiveSHA256Metadata = "sha256"
+)
+
+// Results of the sidecar check of ListBackups.
+const (
+	ChecksumOK = "ok"
+	// ChecksumMissing is an archive without a sidecar.
+	ChecksumMissing = "missing"
+	// ChecksumMismatch is an archive whose sidecar names another hash
+	// than the one recorded when it was uploaded.
+	ChecksumMismatch = "mismatch"
+	// ChecksumOrphan is a sidecar whose archive is gone.
+	ChecksumOrphan = "orphan"
+	// ChecksumUnverified is an archive with a sidecar but no recorded
+	// hash to compare it with, such as on a file:// destination.
+	ChecksumUnverified = "unverified"
+)
+
+// checksumCheckConcurrency bounds the objects checked at once by
+// ListBackups, two small requests each.
+const checksumCheckConcurrency = 8
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadChecksumSidecar stores sum, the hash of the archive key, as
+// <key>.sha256 on uploaded, the destinations that received the archive. It
+// uses the format of sha256sum, so that a downloaded archive can be checked
+// with sha256sum -c. The upload quorum applies.
+func uploadChecksumSidecar(ctx context.Context, cfg Config, uploaded []Storage, key, sum string) error {
+	line := fmt.Sprintf("%s  %s\n", sum, path.Base(key))
+	sidecar := key + checksumSidecarSuffix
+	succeeded := 0
+	var errs []string
+	for _, dest := range uploaded {
+		err := dest.Upload(ctx, Object{
+			Key:         sidecar,
+			Body:        strings.NewReader(line),
+			ContentType: "text/plain; charset=utf-8",
+			Metadata:    map[string]string{toolVersionMetadata: Version},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", dest.Name(), err))
+			continue
+		}
+		succeeded++
+	}
+	if quorum := min(uploadQuorum(cfg.Upload.Quorum), len(uploaded)); succeeded < quorum {
+		return fmt.Errorf("failed to upload %s: %d of %d destinations succeeded, %d required (%s)",
+			sidecar, succeeded, len(uploaded), quorum, strings.Join(errs, "; "))
+	}
+	LoggerFrom(ctx).Info("checksum sidecar uploaded", "key", sidecar)
+	return nil
+}
+
+// BackupObject is an archive listed by ListBackups.
+type BackupObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	// Checksum is the result of the sidecar check, one of the Checksum
+	// constants, or empty when it was not asked for.
+	Checksum string `json:"checksum,omitempty"`
+	// Error explains a failed check.
+	Error string `json:"error,omitempty"`
+}
+
+// ListBackups lists the archives of cfg's cluster on the first
+// destination, including the database archives of per-database runs,
+// oldest first. With checkSidecars, every archive is matched with its
+// <key>.sha256 sidecar and the hash in it is compared with the one recorded
+// in the archive's metadata; sidecars without an archive are reported as
+// ChecksumOrphan. Nothing is downloaded apart from the sidecars.
+func ListBackups(ctx context.Context, cfg Config, checkSidecars bool) ([]BackupObject, error) {
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("no storage destination configured")
+	}
+	src := destinations[0]
+
+	archives := []BackupObject{}
+	sidecars := map[string]ObjectInfo{}
+	err := src.List(ctx, cfg.clusterKey(archivePrefix), func(info ObjectInfo) error {
+		switch {
+		case strings.HasSuffix(info.Key, checksumSidecarSuffix):
+			sidecars[strings.TrimSuffix(info.Key, checksumSidecarSuffix)] = info
+		case isArchiveKey(info.Key):
+			archives = append(archives, BackupObject{Key: info.Key, Size: info.Size, LastModified: info.LastModified})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src.Name(), err)
+	}
+	if !checkSidecars {
+		sortBackups(archives)
+		return archives, nil
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range checksumCheckConcurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				a := &archives[i]
+				if _, ok := sidecars[a.Key]; !ok {
+					a.Checksum = ChecksumMissing
+					continue
+				}
+				a.Checksum, a.Error = checkSidecar(ctx, src, a.Key)
+			}
+		}()
+	}
+	present := map[string]bool{}
+	for i, a := range archives {
+		present[a.Key] = true
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for key, info := range sidecars {
+		if !present[key] {
+			archives = append(archives, BackupObject{Key: info.Key, Size: info.Size, LastModified: info.LastModified, Checksum: ChecksumOrphan})
+		}
+	}
+	sortBackups(archives)
+	return archives, nil
+}
+
+// checkSidecar compares the sidecar of key with the hash in the metadata of
+// key.
+func checkSidecar(ctx context.Context, src Storage, key string) (string, string) {
+	info, err := src.Stat(ctx, key)
+	if err != nil {
+		return ChecksumUnverified, err.Error()
+	}
+	body, err := src.Open(ctx, key+checksumSidecarSuffix)
+	if err != nil {
+		return ChecksumUnverified, err.Error()
+	}
+	defer body.Close()
+	line, err := io.ReadAll(io.LimitReader(body, 1024))
+	if err != nil {
+		return ChecksumUnverified, err.Error()
+	}
+	sum, _, _ := bytes.Cut(bytes.TrimSpace(line), []byte(" "))
+
+	recorded := info.Metadata[archiveSHA256Metadata]
+	switch {
+	case recorded == "":
+		return ChecksumUnverified, ""
+	case !strings.EqualFold(recorded, string(sum)):
+		return ChecksumMismatch, fmt.Sprintf("sidecar has %s, archive was uploaded with %s", sum, recorded)
+	}
+	return ChecksumOK, ""
+}
+
+// isArchiveKey reports whether key names an archive rather than one of the
+// JSON, log or script objects next to it.
+func isArchiveKey(key string) bool {
+	_, err := archiveFormatOf(key)
+	return err == nil
+}
+
+func sortBackups(backups []BackupObject) {
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].LastModified.Equal(backups[j].LastModified) {
+			return backups[i].LastModified.Before(backups[j].LastModified)
+		}
+		return backups[i].Key < backups[j].Key
+	})
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package backup
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isTransientRemoveError reports whether a failed removal is worth
+// retrying. Busy files and directories that refill while being removed
+// (NFS silly-renames) usually clear up; permission errors do not.
+func isTransientRemoveError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.EBUSY, syscall.ETXTBSY, syscall.EAGAIN, syscall.EINTR, syscall.ENOTEMPTY, syscall.ESTALE:
+		return true
+	}
+	return false
+}
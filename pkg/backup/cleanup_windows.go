@@ -0,0 +1,30 @@
+//go:build windows
+
+package backup
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Windows error codes for files held open by another process.
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+	errorDirNotEmpty      syscall.Errno = 145
+)
+
+// isTransientRemoveError reports whether a failed removal is worth
+// retrying. "File in use" errors usually clear once an antivirus or
+// indexing service lets go of the file; access denied does not.
+func isTransientRemoveError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case errorSharingViolation, errorLockViolation, errorDirNotEmpty:
+		return true
+	}
+	return false
+}
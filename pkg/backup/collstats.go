@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// collectionStats is the collStats summary of one collection.
+type collectionStats struct {
+	Database    string
+	Collection  string
+	StorageSize int64
+	Documents   int64
+}
+
+// reportCollectionStats reads collStats for every collection of the given
+// databases and logs them largest first. The result is keyed by
+// "db.collection". Databases that cannot be read are logged and left out.
+func reportCollectionStats(ctx context.Context, client *mongo.Client, databases []string) map[string]collectionStats {
+	log := LoggerFrom(ctx)
+
+	var all []collectionStats
+	for _, dbName := range databases {
+		stats, err := databaseCollectionStats(ctx, client, dbName)
+		if err != nil {
+			log.Warn("failed to read collection stats", "db", dbName, "error", err)
+		}
+		all = append(all, stats...)
+	}
+	slices.SortFunc(all, func(a, b collectionStats) int {
+		return cmp.Compare(b.StorageSize, a.StorageSize)
+	})
+
+	var total int64
+	byName := make(map[string]collectionStats, len(all))
+	for i, s := range all {
+		log.Info("collection stats", "rank", i+1, "db", s.Database, "collection", s.Collection,
+			"storage_size", s.StorageSize, "documents", s.Documents)
+		byName[s.Database+"."+s.Collection] = s
+		total += s.StorageSize
+	}
+	log.Info("collection stats collected", "collections", len(all), "storage_size", total)
+	return byName
+}
+
+func databaseCollectionStats(ctx context.Context, client *mongo.Client, dbName string) ([]collectionStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, manifestCountTimeout)
+	defer cancel()
+
+	db := client.Database(dbName)
+	names, err := db.ListCollectionNames(ctx, bson.D{{Key: "type", Value: "collection"}})
+	if err != nil {
+		return nil, err
+	}
+	var out []collectionStats
+	for _, name := range names {
+		// Sizes come back as int32, int64 or double depending on the server
+		var stats struct {
+			StorageSize float64 `bson:"storageSize"`
+			Count       float64 `bson:"count"`
+		}
+		err := db.RunCommand(ctx, bson.D{{Key: "collStats", Value: name}}).Decode(&stats)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, collectionStats{
+			Database:    dbName,
+			Collection:  name,
+			StorageSize: int64(stats.StorageSize),
+			Documents:   int64(stats.Count),
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"time"
+)
+
+const (
+	// autoLevelSampleSize is how much of the dump is compressed to pick
+	// a level, read in pieces of autoLevelChunk from as many files.
+	autoLevelSampleSize = 8 << 20
+	autoLevelChunk      = 1 << 20
+	// autoLevelTargetRate is the compression throughput, in bytes per
+	// second over all cores, below which a higher level is not worth it:
+	// the archive would be written slower than a disk or uplink takes it.
+	autoLevelTargetRate = 64 << 20
+	// autoLevelMinGain is the share of the archive size a higher level
+	// must save over the one below it to be picked.
+	autoLevelMinGain = 0.02
+	// autoLevelIncompressible is the compressed share of the sample above
+	// which the data is taken as already compressed.
+	autoLevelIncompressible = 0.9
+)
+
+// autoLevelCandidates are the levels tried, cheapest first.
+var autoLevelCandidates = []int{flate.BestSpeed, 3, 6, flate.BestCompression}
+
+// resolveCompressionLevel returns cfg with Level set for the archive of
+// source when cfg.AutoLevel is set: it compresses a sample of the dump at
+// every candidate level and picks the highest one that still compresses
+// at autoLevelTargetRate on the cores the format uses, as long as it
+// saves enough over the level below. The choice is logged with its
+// reasons. Failing to sample leaves the default level.
+func resolveCompressionLevel(ctx context.Context, source string, cfg ArchiveConfig) ArchiveConfig {
+	// The sample is deflated, which says little about zstd or brotli
+	if !cfg.AutoLevel || cfg.Format == FormatTar || cfg.Format == FormatTarZst || cfg.Format == FormatTarBr {
+		return cfg
+	}
+	log := LoggerFrom(ctx)
+	cfg.Level = 0
+
+	var skip []string
+	if cfg.Format == FormatZip {
+		skip = cfg.StorePatterns
+	}
+	sample, err := sampleDump(source, skip)
+	if err != nil {
+		log.Warn("unable to sample the dump for COMPRESSION_LEVEL=auto, using the default level", "source", source, "error", err)
+		return cfg
+	}
+	if len(sample) == 0 {
+		return cfg
+	}
+
+	// Zip and single-threaded gzip compress on one core
+	cores := 1
+	if cfg.Format == FormatTarGz && cfg.Parallelism > 1 {
+		cores = min(cfg.Parallelism, runtime.NumCPU())
+	}
+
+	type trial struct {
+		level int
+		size  int
+		rate  float64
+	}
+	var trials []trial
+	for _, level := range autoLevelCandidates {
+		start := time.Now()
+		size, err := deflatedSize(sample, level)
+		if err != nil {
+			log.Warn("unable to sample the dump for COMPRESSION_LEVEL=auto, using the default level", "source", source, "error", err)
+			return cfg
+		}
+		elapsed := max(time.Since(start).Seconds(), 1e-6)
+		trials = append(trials, trial{level: level, size: size, rate: float64(len(sample)) / elapsed * float64(cores)})
+	}
+
+	chosen := trials[0]
+	reason := "data is already compressed"
+	ratio := float64(chosen.size) / float64(len(sample))
+	if ratio <= autoLevelIncompressible {
+		reason = "fastest level that still saves space"
+		for _, t := range trials[1:] {
+			if t.rate < autoLevelTargetRate {
+				reason = "next level compresses too slowly on the available cores"
+				break
+			}
+			if gain := float64(chosen.size-t.size) / float64(chosen.size); gain < autoLevelMinGain {
+				reason = "next level saves too little space"
+				break
+			}
+			chosen = t
+			reason = "highest level fast enough on the available cores"
+		}
+	}
+	cfg.Level = chosen.level
+
+	log.Info("compression level chosen", "source", source, "level", chosen.level, "reason", reason,
+		"sample_bytes", len(sample), "ratio", float64(chosen.size)/float64(len(sample)),
+		"throughput_mb_s", int(chosen.rate/(1<<20)), "cores", cores, "cpus", runtime.NumCPU())
+	return cfg
+}
+
+// sampleDump reads up to autoLevelSampleSize bytes from the files below
+// source, at most autoLevelChunk from each file, so that the sample spans
+// several collections. Files matching skip are left out, since they are
+// not deflated.
+func sampleDump(source string, skip []string) ([]byte, error) {
+	var sample bytes.Buffer
+	err := walkArchiveEntries(source, func(name, path string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() || sample.Len() >= autoLevelSampleSize || storedEntry(name, skip) {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		n := min(autoLevelChunk, autoLevelSampleSize-sample.Len())
+		_, err = io.CopyN(&sample, file, int64(n))
+		if err == io.EOF {
+			err = nil
+		}
+		return err
+	})
+	return sample.Bytes(), err
+}
+
+// deflatedSize returns the size of data compressed at level.
+func deflatedSize(data []byte, level int) (int, error) {
+	var counter countingWriter
+	w, err := flate.NewWriter(&counter, level)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return int(counter), nil
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
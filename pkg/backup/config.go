@@ -0,0 +1,617 @@
+package backup
+
+import (
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// Config holds everything the backup pipeline needs. Start from
+// DefaultConfig and override what differs.
+type Config struct {
+	Mongo MongoConfig
+	AWS   AWSConfig
+	SFTP  SFTPConfig
+
+	// OutputDir is the folder mongodump writes into. It is emptied after
+	// every run.
+	OutputDir string
+	// StateDir keeps state between runs, such as the last manifest.
+	StateDir string
+	// Umask is cleared from the modes of the folders and files that hold
+	// dumps: OutputDir, the archives, staging and local archive folders and
+	// restore downloads. See DirMode and FileMode.
+	Umask os.FileMode
+
+	// Database name filters; nil means no filter. Exclude wins.
+	IncludeDatabases *regexp.Regexp
+	ExcludeDatabases *regexp.Regexp
+	// DatabaseRegistry, as database.collection, makes the databases to
+	// back up the values of DatabaseRegistryField (default "database") in
+	// that collection instead of every database of the cluster. The
+	// filters still apply.
+	DatabaseRegistry      string
+	DatabaseRegistryField string
+
+	// ClusterName namespaces the backups of one cluster in a shared
+	// bucket: every key, including the latest pointer and copy, is put
+	// under <ClusterName>/ and retention only sees that folder. It must
+	// already be sanitized; see SanitizeClusterName.
+	ClusterName string
+
+	// AuditPrefix is the folder audit entries are stored in with
+	// StoreAuditEntry, e.g. "audit"; empty only logs them.
+	AuditPrefix string
+
+	// Label names an ad-hoc backup, e.g. "pre-migration-v2". It is added
+	// to the archive key and recorded in the manifest and object metadata.
+	// Set it per run; see ValidateLabel.
+	Label string
+
+	// AppVersion is the version of the application using the cluster,
+	// such as a release tag or commit hash, recorded in the manifest and
+	// object metadata of every backup; see ValidateAppVersion.
+	AppVersion string
+
+	// ExternalArchive is a mongodump --archive file written elsewhere,
+	// which BackUp stages in place of a dump; see stageArchive. Set it
+	// per run.
+	ExternalArchive string
+
+	// ChangedOnly skips databases whose change marker matches the last
+	// uploaded manifest.
+	ChangedOnly bool
+
+	// SkipEmpty leaves out databases without any collection, which would
+	// only add empty folders to the archive.
+	SkipEmpty bool
+
+	// MaxDatabases stops a run after the first MaxDatabases selected
+	// databases, to try a configuration on a large cluster without a full
+	// run; 0 dumps them all.
+	MaxDatabases int
+
+	// Verify checks each dump after it was written. It cross-checks GridFS
+	// buckets, where every file must have all of its chunks, and checks
+	// that every view is in the dump's metadata.
+	Verify bool
+
+	// DumpLogs writes each database's mongodump output to
+	// <db>.mongodump.log at the root of the archive, in addition to
+	// the process output.
+	DumpLogs bool
+
+	// IndexSpecs writes the index specs of every collection of a database,
+	// as listed by the driver, to <db>.indexes.json at the root of the
+	// archive, for a readable inventory next to mongodump's metadata.
+	IndexSpecs bool
+
+	// RestoreScripts writes restore.sh and restore.ps1 at the root of the
+	// archive, with the mongorestore commands for the dumped databases.
+	RestoreScripts bool
+
+	// Strict fails the run as soon as one database dump fails, so that
+	// no partial backup is uploaded. By default the remaining databases
+	// are still dumped and uploaded, and the run only fails when every
+	// dump failed.
+	Strict bool
+
+	// Engine is how the databases are dumped: EngineMongodump (the
+	// default) or EngineNative. DumpArgs only apply to mongodump.
+	Engine string
+	// Split writes large collections in parts, with EngineNative.
+	Split SplitConfig
+
+	// FailoverGrace is how long listing the databases and dumping one are
+	// retried after failing with an error of a replica set failover, such
+	// as "not primary" or a server selection error; 0 fails at once.
+	FailoverGrace time.Duration
+
+	// DumpArgs are extra mongodump flags, e.g. --forceTableScan, appended
+	// to every database dump. See ParseDumpArgs.
+	DumpArgs []string
+
+	// DumpQueries maps "db.collection" to the Extended JSON query that
+	// selects the documents of that collection worth backing up. Such a
+	// collection is dumped on its own with --query. See ParseDumpQueries.
+	DumpQueries map[string]string
+
+	// DumpConcurrency is the number of databases dumped at the same time;
+	// 0 or 1 dumps them one after another.
+	DumpConcurrency int
+
+	// DBDelay is slept between two database dumps to spread the load on
+	// the cluster. 0 dumps back-to-back.
+	DBDelay time.Duration
+
+	// CleanupAttempts is how often a removal that failed with a transient
+	// error (a file in use, a busy network mount) is tried.
+	CleanupAttempts int
+
+	// Timeouts bound the dump, archive and upload stages of a run; the
+	// connect stage is bounded by Mongo.ConnectTimeout.
+	Timeouts StageTimeouts
+
+	Archive      ArchiveConfig
+	LocalArchive LocalArchiveConfig
+	Encryption   EncryptionConfig
+	Manifest     ManifestConfig
+	Upload       UploadConfig
+	Sharded      ShardedConfig
+	Restore      RestoreConfig
+	RestoreCheck RestoreCheckConfig
+	Retention    RetentionConfig
+	Catalog      CatalogConfig
+}
+
+type MongoConfig struct {
+	Username   string
+	Password   string
+	ClusterURI string
+	// ConnectTimeout bounds reaching the cluster; ListTimeout bounds
+	// listing its databases, which is slow on clusters with many of them.
+	// Zero uses 10s and 1m respectively.
+	ConnectTimeout time.Duration
+	ListTimeout    time.Duration
+}
+
+type AWSConfig struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Bucket          string
+	// Timeout bounds every single S3 request; for multipart uploads that is
+	// each part rather than the whole archive.
+	Timeout time.Duration
+
+	// PartSize is the multipart part size in bytes. Larger archives are
+	// uploaded in parts that survive a failed attempt; 0 disables
+	// multipart uploads.
+	PartSize int64
+	// UploadAttempts is how often a multipart upload is resumed before
+	// giving up.
+	UploadAttempts int
+	// StaleUploadAge is the age after which an unfinished multipart upload
+	// is aborted during cleanup; 0 never aborts.
+	StaleUploadAge time.Duration
+	// AbortIncompleteDays makes CheckBuckets apply a lifecycle rule that
+	// lets S3 itself abort incomplete multipart uploads of archives after
+	// this many days; 0 leaves the lifecycle configuration alone.
+	AbortIncompleteDays int
+	// UploadBufferSize, when set, streams every multipart part from disk
+	// through a buffer of this many bytes instead of holding the whole
+	// part in memory. The part is then read twice: to hash it and to send
+	// it.
+	UploadBufferSize int
+	// ObjectACL is the canned ACL set on every uploaded object, e.g.
+	// bucket-owner-full-control for cross-account buckets. Empty leaves
+	// access to the bucket policy.
+	ObjectACL string
+	// ContentMD5 sends the base64 MD5 of every object, or of every part
+	// of a multipart upload, as Content-MD5, so the store rejects a body
+	// corrupted in transit. A single-request upload reads the file once
+	// more to hash it; multipart parts are hashed anyway.
+	ContentMD5 bool
+	// CreateBucket makes CheckBuckets create a bucket that does not
+	// exist instead of failing.
+	CreateBucket bool
+}
+
+// SFTPConfig holds the SSH settings of SFTP destinations: the server of
+// Upload.Backend BackendSFTP and the credentials of sftp:// destinations.
+type SFTPConfig struct {
+	// Host is host or host:port, port 22 by default. Path is the remote
+	// folder, relative to the login directory unless absolute.
+	Host string
+	User string
+	Path string
+	// Password and PrivateKeyFile, an OpenSSH or PEM key, authenticate;
+	// at least one must be set. PrivateKeyPassphrase decrypts the key.
+	Password             string
+	PrivateKeyFile       string
+	PrivateKeyPassphrase string
+	// KnownHostsFile holds the server's host key, which must match;
+	// empty uses ~/.ssh/known_hosts.
+	KnownHostsFile string
+	// Timeout bounds connecting and the SSH handshake.
+	Timeout time.Duration
+}
+
+type ArchiveConfig struct {
+	// Format is FormatZip (the default), FormatTarGz, FormatTarZst,
+	// FormatTarBr or FormatTar.
+	Format string
+	// Parallelism is the number of goroutines compressing a tar.gz or
+	// tar.zst archive; for tar.gz, 1 uses the standard library's
+	// single-threaded gzip. Zip archives are always compressed on one
+	// core.
+	Parallelism int
+	// Comment stores an ArchiveInfo JSON blob in the archive: as the zip
+	// comment, in the gzip header of a tar.gz, or in a PAX global header
+	// of a tar.
+	Comment bool
+	// BlockSize is the input each tar.gz compression goroutine works on at
+	// a time, in bytes. Memory use grows with BlockSize × Parallelism; 0
+	// uses 1 MiB.
+	BlockSize int
+	// CopyBufferSize is the buffer dump files are read through while they
+	// are archived, in bytes; 0 uses io.Copy's 32 KiB.
+	CopyBufferSize int
+	// Level is the deflate level of zip and tar.gz archives, from 1
+	// (fastest) to 9 (smallest); 0 uses the default, 6. tar.zst maps it
+	// onto the zstd speeds, see zstdLevel, and tar.br onto the brotli
+	// qualities, see brotliQuality.
+	Level int
+	// StorePatterns lists path.Match patterns of zip entries stored
+	// without compression, such as collections of already compressed
+	// blobs; see storedEntry. Everything else is deflated.
+	StorePatterns []string
+	// AutoLevel picks Level for every archive from a sample of its dump
+	// and the cores available. See resolveCompressionLevel.
+	AutoLevel bool
+	// PerDatabase archives every database on its own and uploads the
+	// archives into a folder per run, next to an index.json listing them.
+	PerDatabase bool
+	// Dictionary trains a zstd dictionary on samples of every database of
+	// a per-database tar.zst run, compresses the archives with it and
+	// uploads it into the run's folder. See trainDictionary.
+	Dictionary bool
+	// DictionarySize is the largest dictionary trained, in bytes; 0 uses
+	// defaultDictionarySize.
+	DictionarySize int
+
+	// dictionary is the trained dictionary of the current run.
+	dictionary []byte
+}
+
+type LocalArchiveConfig struct {
+	// Keep moves every uploaded archive into Dir instead of deleting it,
+	// for a secondary copy. The dump folder is cleaned either way.
+	Keep bool
+	Dir  string
+	// Count is the number of archives kept in Dir, newest first; 0 keeps
+	// every archive.
+	Count int
+}
+
+type EncryptionConfig struct {
+	// Mode is EncryptionNone (the default), EncryptionKMSEnvelope, which
+	// encrypts every uploaded archive with a data key of its own from KMS,
+	// or EncryptionAge, which encrypts every archive to AgeRecipients as it
+	// is written. Restores decrypt any such archive whatever the mode.
+	Mode string
+	// KMSKeyID is the KMS key the data keys are generated under: a key
+	// ID, key ARN or alias/<name>.
+	KMSKeyID string
+	// AgeRecipients are the public keys archives are encrypted to. The
+	// backup host needs no private key: only AgeIdentities, given to
+	// restores, decrypt the archives.
+	AgeRecipients []age.Recipient
+	AgeIdentities []age.Identity
+}
+
+type RestoreConfig struct {
+	// Dir is the scratch folder archives are downloaded and extracted into.
+	Dir string
+	// Concurrency is the number of databases restored at the same time.
+	Concurrency int
+	// ParallelCollections is passed to mongorestore as
+	// --numParallelCollections.
+	ParallelCollections int
+	// Drop passes --drop, replacing existing collections, to every
+	// mongorestore.
+	Drop bool
+	// Collection limits the restore to one collection of the one database
+	// restored. RenameTo, a "db.collection" namespace, restores it under
+	// that name instead of its own.
+	Collection string
+	RenameTo   string
+	// DownloadChunkSize is the size of the ranged requests an archive is
+	// downloaded in, in bytes; 0 downloads it in one request that starts
+	// over when it fails. DownloadAttempts is how often a chunk is tried.
+	DownloadChunkSize int64
+	DownloadAttempts  int
+	// ToolsCheck is what happens when the local mongorestore may not read
+	// the archive's dump: ToolsCheckWarn (the default), ToolsCheckRefuse
+	// or ToolsCheckOff.
+	ToolsCheck string
+
+	// Target is the cluster mongorestore writes to, e.g. a staging cluster
+	// for disaster recovery drills. An empty ClusterURI restores into
+	// Mongo, the backup source. Its credentials are its own: Mongo's are
+	// only sent to it with ReuseCredentials.
+	Target           MongoConfig
+	ReuseCredentials bool
+	// Confirm must repeat the target's ClusterURI before an archive is
+	// restored into the cluster it was taken from.
+	Confirm string
+}
+
+type RestoreCheckConfig struct {
+	// Enabled restores every uploaded backup into a throwaway mongod after
+	// the upload; see VerifyRestore. It needs Docker on the host.
+	Enabled bool
+	// Docker is the container CLI, e.g. docker or podman, and Image the
+	// MongoDB image it runs, best the major version of the cluster.
+	Docker string
+	Image  string
+	// StartTimeout bounds pulling the image and waiting for mongod.
+	StartTimeout time.Duration
+}
+
+type CatalogConfig struct {
+	// Collection, as database.collection, receives a CatalogEntry for
+	// every run; empty keeps no catalog. See StoreCatalogEntry.
+	Collection string
+	// URI is the MongoDB deployment holding the catalog; empty uses the
+	// cluster being backed up.
+	URI string
+	// Timeout bounds connecting and writing an entry; 0 uses 30s.
+	Timeout time.Duration
+}
+
+type RetentionConfig struct {
+	// MaxAge is the age after which an archive is deleted; 0 keeps every
+	// archive. Labeled backups are always kept.
+	MaxAge time.Duration
+	// Concurrency is the number of delete batches in flight per
+	// destination.
+	Concurrency int
+	// DeleteAttempts is how often a batch is sent; a retry only carries
+	// the keys the previous attempt failed to delete.
+	DeleteAttempts int
+}
+
+type ShardedConfig struct {
+	// Enabled allows dumping a sharded cluster through mongos. The
+	// balancer is stopped for the duration of the dump. Without it, a
+	// sharded cluster is refused.
+	Enabled bool
+	// FsyncLock also blocks writes on all shards while dumping, which
+	// gives a consistent backup at the cost of downtime for writers.
+	// Requires MongoDB 7.1 or later.
+	FsyncLock bool
+}
+
+type ManifestConfig struct {
+	// DropThreshold is the percentage drop in a collection's document
+	// count, compared to the previous backup, that triggers a warning.
+	DropThreshold float64
+	// Sidecar also uploads the manifest next to the archive.
+	Sidecar bool
+	// CollectionStats logs every collection's storage size and document
+	// count, largest first, before the dumps start and records the sizes
+	// in the manifest. It costs one collStats call per collection.
+	CollectionStats bool
+	// WebhookURL receives an UploadReport as a JSON POST after every
+	// successful upload; empty disables the webhook.
+	WebhookURL string
+	// SizeDeviation is the percentage by which a backup's dump size may
+	// differ from the average of the last SizeHistory uploaded backups
+	// before it is marked suspicious; 0 disables the check.
+	SizeDeviation float64
+	SizeHistory   int
+	// AlertWebhookURL receives a SizeAlert as a JSON POST for every
+	// suspicious backup; empty only logs it.
+	AlertWebhookURL string
+}
+
+type UploadConfig struct {
+	// Destinations are s3://bucket[?region=...], file:///path and
+	// sftp://user@host[:port]/path URLs. When empty, Backend is used.
+	Destinations []string
+	// Backend is the single destination without Destinations: BackendS3,
+	// the default, uploads to AWS.Bucket and BackendSFTP to SFTP.Path on
+	// SFTP.Host.
+	Backend string
+	// Quorum is the number of destinations that must succeed; 0 means all.
+	Quorum int
+
+	// ContentDisposition may contain {filename}, replaced by the archive
+	// name. Empty values omit the header.
+	ContentDisposition string
+	CacheControl       string
+
+	// Dedup skips the upload when the dump matches the previous upload.
+	Dedup bool
+
+	// PreUploadCommand is run on every archive before it is uploaded, such
+	// as a signing step or a malware scan; the archive is only uploaded
+	// when it exits zero. See runPreUploadCommand. Empty runs nothing.
+	PreUploadCommand []string
+
+	// ChecksumSidecar uploads <key>.sha256 after every archive and records
+	// the same hash in the archive's metadata, for ListBackups to check.
+	ChecksumSidecar bool
+
+	// LatestPointer is the key of a small JSON object that names the newest
+	// archive; empty disables it. LatestCopy, when set, is a fixed key that
+	// the newest archive is copied to server-side.
+	LatestPointer string
+	LatestCopy    string
+
+	// Pipeline makes BackUpAndUpload upload every database as soon as its
+	// dump is done instead of after the last dump, with up to Concurrency
+	// uploads at a time. It needs Archive.PerDatabase.
+	Pipeline    bool
+	Concurrency int
+
+	// Stream makes BackUpAndUpload archive and upload every database right
+	// after its dump and delete the dump before the next one starts, so the
+	// dump folder holds one database at a time. It needs
+	// Archive.PerDatabase and a DumpConcurrency of 1.
+	Stream bool
+
+	// BandwidthLimit caps the bytes per second read for uploads, across
+	// all destinations and concurrent uploads; 0 is unlimited.
+	BandwidthLimit int64
+
+	// DatabaseAttempts is the number of times a per-database archive is
+	// uploaded before the database is given up and left out of the run.
+	DatabaseAttempts int
+
+	// Retry is the wait before a per-database upload is retried or a
+	// multipart upload resumed.
+	Retry Backoff
+}
+
+// SplitConfig splits the dump of a collection into parts of at most
+// Documents documents or Bytes bytes, whichever comes first. A part may end
+// up to one document past Bytes. 0 disables a limit; both 0 write every
+// collection to a single file.
+type SplitConfig struct {
+	Documents int64
+	Bytes     int64
+}
+
+func (s SplitConfig) enabled() bool {
+	return s.Documents > 0 || s.Bytes > 0
+}
+
+// reached reports whether a part of n documents and size bytes is full.
+func (s SplitConfig) reached(n, size int64) bool {
+	return (s.Documents > 0 && n >= s.Documents) || (s.Bytes > 0 && size >= s.Bytes)
+}
+
+// StageTimeouts are the deadlines of the stages of a run. A stage that runs
+// past its deadline is cancelled and fails the run with a
+// *StageTimeoutError. 0 leaves a stage unbounded.
+type StageTimeouts struct {
+	// Dump bounds listing and dumping the databases.
+	Dump time.Duration
+	// Archive bounds writing the archive, or each database's archive with
+	// Archive.PerDatabase.
+	Archive time.Duration
+	// Upload bounds uploading the archive to every destination, or each
+	// attempt at a database's archive with Archive.PerDatabase.
+	Upload time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		OutputDir: "./backup",
+		StateDir:  "./state",
+		Umask:     defaultUmask,
+		Engine:    EngineMongodump,
+		Mongo: MongoConfig{
+			ConnectTimeout: defaultConnectTimeout,
+			ListTimeout:    defaultListTimeout,
+		},
+		AWS: AWSConfig{
+			Timeout:        30 * time.Minute,
+			PartSize:       64 << 20,
+			UploadAttempts: 3,
+			StaleUploadAge: 24 * time.Hour,
+		},
+		CleanupAttempts: 3,
+		FailoverGrace:   defaultFailoverGrace,
+		Archive: ArchiveConfig{
+			Format:      FormatZip,
+			Parallelism: runtime.NumCPU(),
+			Comment:     true,
+		},
+		Manifest: ManifestConfig{
+			DropThreshold: 20,
+			SizeHistory:   7,
+		},
+		Restore: RestoreConfig{
+			Dir:                 "./restore",
+			Concurrency:         2,
+			ParallelCollections: 4,
+			ToolsCheck:          ToolsCheckWarn,
+			DownloadChunkSize:   64 << 20,
+			DownloadAttempts:    5,
+		},
+		RestoreCheck: RestoreCheckConfig{
+			Docker:       defaultRestoreCheckDocker,
+			Image:        defaultRestoreCheckImage,
+			StartTimeout: defaultRestoreCheckTimeout,
+		},
+		LocalArchive: LocalArchiveConfig{
+			Dir:   "./archives",
+			Count: 7,
+		},
+		Encryption: EncryptionConfig{
+			Mode: EncryptionNone,
+		},
+		Retention: RetentionConfig{
+			Concurrency:    4,
+			DeleteAttempts: 3,
+		},
+		Upload: UploadConfig{
+			ContentDisposition: `attachment; filename="{filename}"`,
+			CacheControl:       "no-cache",
+			LatestPointer:      "latest.json",
+			Concurrency:        2,
+			DatabaseAttempts:   3,
+			Retry:              Backoff{Base: defaultRetryBase, Max: defaultRetryMaxDelay, Jitter: true},
+		},
+	}
+}
+
+// clusterKey puts key into the folder of c.ClusterName, if any.
+func (c Config) clusterKey(key string) string {
+	if c.ClusterName == "" {
+		return key
+	}
+	return c.ClusterName + "/" + key
+}
+
+// uri builds the connection string for m, pointed at db when it is not
+// empty. ClusterURI may carry a path and connection options, as in
+// cluster0.example.net/?retryWrites=true; db replaces the path, and the
+// options are kept after it. A ClusterURI without a scheme is a
+// mongodb+srv one; one with its own, such as the mongodb://127.0.0.1:27017
+// of a local server, keeps it. Username and Password are escaped into the
+// URI unless it carries credentials of its own.
+func (m MongoConfig) uri(db string) string {
+	raw := m.ClusterURI
+	if !strings.Contains(raw, "://") {
+		raw = "mongodb+srv://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		// Left for the driver to report, with its own explanation
+		return raw
+	}
+	if m.Username != "" && u.User == nil {
+		u.User = url.UserPassword(m.Username, m.Password)
+	}
+	if db != "" {
+		u.Path, u.RawPath = "/"+db, ""
+	}
+	if u.RawQuery != "" && u.Path == "" {
+		// The driver wants a / before the options
+		u.Path = "/"
+	}
+	return u.String()
+}
+
+// restoreTarget is the cluster RestoreFromS3 writes to.
+func (c Config) restoreTarget() MongoConfig {
+	t := c.Restore.Target
+	if t.ClusterURI == "" {
+		return c.Mongo
+	}
+	if c.Restore.ReuseCredentials && t.Username == "" && t.Password == "" {
+		t.Username, t.Password = c.Mongo.Username, c.Mongo.Password
+	}
+	return t
+}
+
+// databaseSelected reports whether dbName passes the configured filters.
+// The exclude pattern wins when a name matches both.
+func (c Config) databaseSelected(dbName string) bool {
+	if c.IncludeDatabases != nil && !c.IncludeDatabases.MatchString(dbName) {
+		return false
+	}
+	if c.ExcludeDatabases != nil && c.ExcludeDatabases.MatchString(dbName) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	lastUploadFileName = "last-upload.json"
+	checksumMetadata   = "content-sha256"
+)
+
+// uploadRecord remembers the last uploaded archive so an identical one can
+// be skipped when DEDUP_UPLOADS is enabled.
+type uploadRecord struct {
+	Key        string    `json:"key"`
+	Checksum   string    `json:"checksum"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// contentChecksum hashes the dump folder's file names and contents in walk
+// (lexical) order. File timestamps, the manifest, which always carries a
+// fresh creation time, and the mongodump logs are left out so two dumps of
+// unchanged data match.
+func contentChecksum(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if checksumExcluded(filepath.ToSlash(rel)) {
+			return nil
+		}
+
+		io.WriteString(h, filepath.ToSlash(rel))
+		h.Write([]byte{0})
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(h, file)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumExcluded reports whether the file at rel, a slash-separated path
+// relative to the dump folder, is left out of contentChecksum.
+func checksumExcluded(rel string) bool {
+	return rel == manifestFileName || rel == restoreShellScript || rel == restorePowerShellScript || strings.HasSuffix(rel, dumpLogSuffix)
+}
+
+func readUploadRecord(stateDir string) (uploadRecord, error) {
+	var rec uploadRecord
+	data, err := os.ReadFile(filepath.Join(stateDir, lastUploadFileName))
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+func writeUploadRecord(cfg Config, rec uploadRecord) error {
+	if err := os.MkdirAll(cfg.StateDir, cfg.DirMode()); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cfg.StateDir, lastUploadFileName), data, cfg.FileMode())
+}
+
+// previousUploadMatches reports whether the last uploaded archive has the
+// given checksum and still exists, unchanged, on every destination.
+func previousUploadMatches(ctx context.Context, stateDir, checksum string) (uploadRecord, bool) {
+	rec, err := readUploadRecord(stateDir)
+	if err != nil || rec.Checksum != checksum {
+		return rec, false
+	}
+
+	log := LoggerFrom(ctx)
+	for _, dest := range destinations {
+		info, err := dest.Stat(ctx, rec.Key)
+		if err != nil {
+			if !errors.Is(err, ErrObjectNotFound) {
+				log.Warn("unable to check previous upload", "key", rec.Key, "destination", dest.Name(), "error", err)
+			}
+			return rec, false
+		}
+		if stored := info.Metadata[checksumMetadata]; stored != "" && stored != checksum {
+			return rec, false
+		}
+	}
+	return rec, true
+}
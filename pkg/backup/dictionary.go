@@ -0,0 +1,172 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// dictionaryFileName is the zstd dictionary of a per-database run,
+	// stored in the run's folder and named by its index.
+	dictionaryFileName = "zstd.dict"
+	// defaultDictionarySize is the default of zstd --train, 110 KiB.
+	defaultDictionarySize = 112640
+	// dictionarySampleChunk is how much of the start of every dump file
+	// is sampled; the builder makes little use of anything beyond it.
+	dictionarySampleChunk = 64 << 10
+	// dictionarySampleSize bounds the samples of all databases together.
+	dictionarySampleSize = 32 << 20
+)
+
+// trainDictionary builds a zstd dictionary of up to cfg.DictionarySize
+// bytes from the start of every file of the dumps of dbs below source.
+// Small databases barely fill a zstd window on their own, so what they
+// share, such as field names and collection metadata, is stored once in
+// the dictionary instead of once per archive. The dictionary is tuned for
+// the level the archives are written at.
+func trainDictionary(ctx context.Context, source string, dbs []string, cfg ArchiveConfig) ([]byte, error) {
+	log := LoggerFrom(ctx)
+	start := time.Now()
+	samples, err := dictionarySamples(source, dbs)
+	if err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("the dumps have no data to sample")
+	}
+	trained, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: cmp.Or(cfg.DictionarySize, defaultDictionarySize),
+		HashBytes:   6,
+		ZstdLevel:   zstdLevel(cfg),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Compressing the samples on their own, as every small archive is,
+	// shows what the dictionary gains
+	var raw, plain, withDict int
+	plainEnc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstdLevel(cfg)))
+	if err != nil {
+		return nil, err
+	}
+	defer plainEnc.Close()
+	dictEnc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstdLevel(cfg)), zstd.WithEncoderDict(trained))
+	if err != nil {
+		return nil, err
+	}
+	defer dictEnc.Close()
+	for _, sample := range samples {
+		raw += len(sample)
+		plain += len(plainEnc.EncodeAll(sample, nil))
+		withDict += len(dictEnc.EncodeAll(sample, nil))
+	}
+	log.Info("zstd dictionary trained", "size", len(trained), "databases", len(dbs), "samples", len(samples),
+		"sample_bytes", raw, "ratio_without", float64(plain)/float64(raw), "ratio_with", float64(withDict)/float64(raw),
+		"duration", time.Since(start).Round(time.Millisecond))
+	return trained, nil
+}
+
+// dictionarySamples reads up to dictionarySampleChunk bytes from the start
+// of every file of the dumps of dbs, dictionarySampleSize in all, spread
+// evenly over the databases.
+func dictionarySamples(source string, dbs []string) ([][]byte, error) {
+	if len(dbs) == 0 {
+		return nil, nil
+	}
+	perDatabase := dictionarySampleSize / len(dbs)
+	var samples [][]byte
+	for _, db := range dbs {
+		left := perDatabase
+		err := walkArchiveEntries(filepath.Join(source, db), func(name, path string, info os.FileInfo) error {
+			if !info.Mode().IsRegular() || info.Size() == 0 || left <= 0 {
+				return nil
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			sample := make([]byte, min(info.Size(), dictionarySampleChunk, int64(left)))
+			if _, err := io.ReadFull(file, sample); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			samples = append(samples, sample)
+			left -= len(sample)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+// useDictionary trains the zstd dictionary of the run on the dumps of dbs
+// and uploads it, sealed like the archives, to <run>/zstd.dict. The index
+// names it and the archives are compressed with it. A dictionary that
+// cannot be trained or uploaded is logged, and the run goes on without.
+func (r *databaseRun) useDictionary(ctx context.Context, dbs []string) {
+	log := LoggerFrom(ctx)
+	cfg := r.cfg
+	trained, err := trainDictionary(ctx, cfg.OutputDir, dbs, cfg.Archive)
+	if err != nil {
+		log.Warn("unable to train a zstd dictionary, compressing without one", "error", err)
+		return
+	}
+	if err := r.uploadDictionary(ctx, trained); err != nil {
+		log.Warn("unable to upload the zstd dictionary, compressing without one", "error", err)
+		return
+	}
+	r.cfg.Archive.dictionary = trained
+}
+
+func (r *databaseRun) uploadDictionary(ctx context.Context, trained []byte) error {
+	cfg := r.cfg
+	dictPath := filepath.Join(r.folder, dictionaryFileName)
+	if err := os.WriteFile(dictPath, trained, cfg.FileMode()); err != nil {
+		return err
+	}
+	uploadPath, sealedMetadata, err := sealArchive(ctx, cfg.Encryption, dictPath)
+	if err != nil {
+		return err
+	}
+	metadata := maps.Clone(r.metadata)
+	if uploadPath != dictPath {
+		defer os.Remove(uploadPath)
+	}
+	maps.Copy(metadata, sealedMetadata)
+	key := r.prefix + dictionaryFileName
+	obj := Object{Key: key, ContentType: "application/octet-stream", Metadata: metadata}
+	if _, err := uploadFile(ctx, cfg.Upload.Quorum, uploadPath, obj); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	r.index.Dictionary = key
+	LoggerFrom(ctx).Info("zstd dictionary uploaded", "key", key, "size", len(trained))
+	return nil
+}
+
+// fetchDictionary downloads the zstd dictionary key of a run into scratch
+// and returns it, decrypted if it was sealed.
+func fetchDictionary(ctx context.Context, cfg Config, src Storage, key, scratch string) ([]byte, error) {
+	dictPath := filepath.Join(scratch, path.Base(key))
+	if err := downloadTo(ctx, cfg, src, key, dictPath); err != nil {
+		return nil, err
+	}
+	defer os.Remove(dictPath)
+	if _, err := unsealArchive(ctx, cfg.Encryption, dictPath); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(dictPath)
+}
@@ -0,0 +1,223 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Names the diff subcommand accepts in place of a backup key: the backup
+// named by the latest pointer (see LoadBackupManifest), and the cluster as
+// it is now (see LiveManifest).
+const (
+	DiffLatest = "latest"
+	DiffLive   = "live"
+)
+
+// errManifestRead stops the walk of an archive once its manifest is read.
+var errManifestRead = errors.New("manifest read")
+
+// CollectionDiff compares one collection between two manifests, A and B.
+type CollectionDiff struct {
+	Database   string
+	Collection string
+	// InA and InB report which manifests list the collection.
+	InA, InB   bool
+	DocumentsA int64
+	DocumentsB int64
+	// SizeA and SizeB are the collStats storage sizes, 0 when the
+	// manifest was written without REPORT_COLLECTION_STATS.
+	SizeA int64
+	SizeB int64
+}
+
+// Changed reports whether the collection differs between A and B. Sizes
+// only count when both manifests have them.
+func (d CollectionDiff) Changed() bool {
+	if d.InA != d.InB || d.DocumentsA != d.DocumentsB {
+		return true
+	}
+	return d.SizeA != 0 && d.SizeB != 0 && d.SizeA != d.SizeB
+}
+
+// DiffManifests compares the collections of a and b, sorted by database and
+// collection. Collections in only one of them are included.
+func DiffManifests(a, b Manifest) []CollectionDiff {
+	byName := map[string]*CollectionDiff{}
+	entry := func(db, coll string) *CollectionDiff {
+		key := db + "." + coll
+		if byName[key] == nil {
+			byName[key] = &CollectionDiff{Database: db, Collection: coll}
+		}
+		return byName[key]
+	}
+	for _, db := range a.Databases {
+		for _, coll := range db.Collections {
+			d := entry(db.Name, coll.Name)
+			d.InA, d.DocumentsA, d.SizeA = true, coll.Documents, coll.StorageSize
+		}
+	}
+	for _, db := range b.Databases {
+		for _, coll := range db.Collections {
+			d := entry(db.Name, coll.Name)
+			d.InB, d.DocumentsB, d.SizeB = true, coll.Documents, coll.StorageSize
+		}
+	}
+
+	diffs := make([]CollectionDiff, 0, len(byName))
+	for _, d := range byName {
+		diffs = append(diffs, *d)
+	}
+	slices.SortFunc(diffs, func(x, y CollectionDiff) int {
+		return cmp.Or(strings.Compare(x.Database, y.Database), strings.Compare(x.Collection, y.Collection))
+	})
+	return diffs
+}
+
+// LoadBackupManifest returns the manifest of the backup key on the first
+// destination. key is an archive, the folder or index.json of a
+// per-database run, a manifest object itself, or DiffLatest. For an archive
+// the <key>.manifest.json sidecar is read when there is one; otherwise the
+// archive is downloaded below cfg.Restore.Dir, decrypted if needed, and the
+// manifest.json at its root is read.
+func LoadBackupManifest(ctx context.Context, cfg Config, key string) (Manifest, error) {
+	if len(destinations) == 0 {
+		return Manifest{}, fmt.Errorf("no storage destination configured")
+	}
+	src := destinations[0]
+
+	if key == DiffLatest {
+		pointer, err := readLatestPointer(ctx, src, cfg.clusterKey(cfg.Upload.LatestPointer))
+		if err != nil {
+			return Manifest{}, fmt.Errorf("the latest pointer is unavailable: %w", err)
+		}
+		key = pointer.Key
+	}
+	switch {
+	case strings.HasSuffix(key, "/"):
+		return readManifestObject(ctx, src, key+manifestFileName)
+	case isRunIndexKey(key):
+		return readManifestObject(ctx, src, path.Dir(key)+"/"+manifestFileName)
+	case path.Ext(key) == ".json":
+		return readManifestObject(ctx, src, key)
+	}
+
+	m, err := readManifestObject(ctx, src, key+".manifest.json")
+	if !errors.Is(err, ErrObjectNotFound) {
+		return m, err
+	}
+
+	if err := os.MkdirAll(cfg.Restore.Dir, cfg.DirMode()); err != nil {
+		return m, err
+	}
+	scratch, err := os.MkdirTemp(cfg.Restore.Dir, "diff-")
+	if err != nil {
+		return m, err
+	}
+	defer os.RemoveAll(scratch)
+	archivePath := filepath.Join(scratch, path.Base(key))
+	LoggerFrom(ctx).Info("no manifest sidecar, downloading archive", "key", key, "source", src.Name())
+	if err := downloadTo(ctx, cfg, src, key, archivePath); err != nil {
+		return m, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	if _, err := unsealArchive(ctx, cfg.Encryption, archivePath); err != nil {
+		return m, fmt.Errorf("failed to decrypt %s: %w", key, err)
+	}
+	return readArchiveManifest(archivePath)
+}
+
+func readManifestObject(ctx context.Context, src Storage, key string) (Manifest, error) {
+	var m Manifest
+	body, err := src.Open(ctx, key)
+	if err != nil {
+		return m, fmt.Errorf("%s: %w", key, err)
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(&m); err != nil {
+		return m, fmt.Errorf("%s: %w", key, err)
+	}
+	return m, nil
+}
+
+// readArchiveManifest reads the manifest.json at the root of the archive
+// at path without extracting the rest.
+func readArchiveManifest(archivePath string) (Manifest, error) {
+	var m Manifest
+	format, err := archiveFormatOf(archivePath)
+	if err != nil {
+		return m, err
+	}
+	visit := func(name string, r io.Reader) error {
+		if strings.TrimPrefix(name, "./") != manifestFileName {
+			return nil
+		}
+		if err := json.NewDecoder(r).Decode(&m); err != nil {
+			return fmt.Errorf("%s is not valid: %w", manifestFileName, err)
+		}
+		return errManifestRead
+	}
+	if format == FormatZip {
+		err = verifyZip(archivePath, visit)
+	} else {
+		err = verifyTar(archivePath, format, visit)
+	}
+	switch {
+	case errors.Is(err, errManifestRead):
+		return m, nil
+	case err != nil:
+		return m, err
+	}
+	return m, fmt.Errorf("%s has no %s", filepath.Base(archivePath), manifestFileName)
+}
+
+// LiveManifest describes the databases a backup with cfg would dump now,
+// as BackUp records them in its manifest, with the collStats storage size
+// of every collection. Nothing is dumped.
+func LiveManifest(ctx context.Context, cfg Config) (Manifest, error) {
+	log := LoggerFrom(ctx)
+	client, err := connectCluster(ctx, cfg.Mongo)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer client.Disconnect(context.Background())
+
+	listCtx, cancel := context.WithTimeout(ctx, cmp.Or(cfg.Mongo.ListTimeout, defaultListTimeout))
+	defer cancel()
+	dbs, err := listDatabases(listCtx, cfg, client)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("%w: failed to list databases: %w", ErrMongoConnect, err)
+	}
+
+	m := Manifest{CreatedAt: time.Now().UTC(), Databases: []DatabaseManifest{}}
+	for _, dbName := range dbs {
+		if dbName == "admin" || dbName == "local" || dbName == "config" || !cfg.databaseSelected(dbName) {
+			continue
+		}
+		entry := collectDatabaseManifest(ctx, client, dbName)
+		if entry.Error != "" {
+			log.Warn("failed to collect manifest", "db", dbName, "error", entry.Error)
+		}
+		stats, err := databaseCollectionStats(ctx, client, dbName)
+		if err != nil {
+			log.Warn("failed to read collection stats", "db", dbName, "error", err)
+		}
+		sizes := map[string]int64{}
+		for _, s := range stats {
+			sizes[s.Collection] = s.StorageSize
+		}
+		for i, coll := range entry.Collections {
+			entry.Collections[i].StorageSize = sizes[coll.Name]
+		}
+		m.Databases = append(m.Databases, entry)
+	}
+	return m, nil
+}
@@ -0,0 +1,232 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RangeOpener is implemented by storages that can read part of an object,
+// which lets an interrupted download continue where it stopped.
+type RangeOpener interface {
+	// OpenRange returns length bytes of key from offset on, or the rest of
+	// the object when length is negative.
+	OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// downloadsFolder, below RestoreConfig.Dir, keeps the partial downloads of
+// restores. Unlike the scratch folder of a restore, it survives the
+// process, so the next restore of the same archive continues the download.
+const downloadsFolder = "downloads"
+
+// partialDownload is the persisted progress of a download, stored next to
+// the partial file. A partial file is only continued while the object is
+// the same size and age.
+type partialDownload struct {
+	Destination  string    `json:"destination"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Offset       int64     `json:"offset"`
+}
+
+// downloadTo writes the object key of src to target. Storages that are a
+// RangeOpener are read in chunks of cfg.Restore.DownloadChunkSize, each
+// tried up to cfg.Restore.DownloadAttempts times, into a partial file
+// below cfg.Restore.Dir that an interrupted restore continues. The
+// complete file is checked against the object's size and, when it was
+// uploaded with CHECKSUM_SIDECAR, its SHA-256.
+func downloadTo(ctx context.Context, cfg Config, src Storage, key, target string) error {
+	ranged, ok := src.(RangeOpener)
+	if !ok || cfg.Restore.DownloadChunkSize <= 0 {
+		return downloadWhole(ctx, src, key, target, cfg.FileMode())
+	}
+	log := LoggerFrom(ctx)
+
+	info, err := src.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	partial, progress := partialDownloadPath(cfg.Restore.Dir, src.Name(), key)
+	if err := os.MkdirAll(filepath.Dir(partial), cfg.DirMode()); err != nil {
+		return err
+	}
+
+	state := partialDownload{Destination: src.Name(), Key: key, Size: info.Size, LastModified: info.LastModified.UTC()}
+	if prev, err := readPartialDownload(progress); err == nil && prev.Size == state.Size && prev.LastModified.Equal(state.LastModified) {
+		// Only bytes that are both on disk and recorded count
+		if fi, err := os.Stat(partial); err == nil {
+			state.Offset = min(prev.Offset, fi.Size())
+		}
+	}
+	out, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, cfg.FileMode())
+	if err != nil {
+		return err
+	}
+	if err := out.Truncate(state.Offset); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := out.Seek(state.Offset, io.SeekStart); err != nil {
+		out.Close()
+		return err
+	}
+	if state.Offset > 0 {
+		log.Info("resuming download", "key", key, "source", src.Name(), "offset", state.Offset, "size", state.Size)
+	}
+
+	for state.Offset < state.Size {
+		length := min(cfg.Restore.DownloadChunkSize, state.Size-state.Offset)
+		if err := downloadChunk(ctx, cfg, ranged, key, out, state.Offset, length); err != nil {
+			out.Close()
+			return fmt.Errorf("%w (%d of %d bytes downloaded to %s, the next restore continues from there)", err, state.Offset, state.Size, partial)
+		}
+		if err := out.Sync(); err != nil {
+			out.Close()
+			return err
+		}
+		state.Offset += length
+		if err := writePartialDownload(progress, state, cfg.FileMode()); err != nil {
+			log.Warn("failed to store download progress", "key", key, "error", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if err := verifyDownload(ctx, src, key, info, partial); err != nil {
+		// Corrupt bytes are not worth resuming from
+		os.Remove(partial)
+		os.Remove(progress)
+		return err
+	}
+	os.Remove(progress)
+	return moveAcross(partial, target)
+}
+
+// downloadChunk copies length bytes of key from offset to out, which is
+// positioned at offset, retrying a failed request from the byte it
+// stopped at.
+func downloadChunk(ctx context.Context, cfg Config, src RangeOpener, key string, out *os.File, offset, length int64) error {
+	attempts := max(cfg.Restore.DownloadAttempts, 1)
+	written := int64(0)
+	for attempt := 1; ; attempt++ {
+		body, err := src.OpenRange(ctx, key, offset+written, length-written)
+		if err == nil {
+			var n int64
+			n, err = io.Copy(out, io.LimitReader(body, length-written))
+			body.Close()
+			written += n
+			if err == nil && written < length {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt == attempts || ctx.Err() != nil {
+			return fmt.Errorf("bytes %d-%d: %w", offset, offset+length-1, err)
+		}
+		wait := time.Duration(attempt) * 5 * time.Second
+		LoggerFrom(ctx).Warn("download failed, retrying", "key", key, "offset", offset+written, "attempt", attempt, "wait", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// verifyDownload compares the file at path with info, the object it was
+// downloaded from: its size, and its SHA-256 from the sha256 metadata or
+// the checksum sidecar when there is one.
+func verifyDownload(ctx context.Context, src Storage, key string, info ObjectInfo, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != info.Size {
+		return fmt.Errorf("downloaded %d bytes of %s, expected %d", fi.Size(), key, info.Size)
+	}
+
+	expected := info.Metadata[archiveSHA256Metadata]
+	if expected == "" {
+		if body, err := src.Open(ctx, key+checksumSidecarSuffix); err == nil {
+			line, _ := io.ReadAll(io.LimitReader(body, 1024))
+			body.Close()
+			expected, _, _ = strings.Cut(strings.TrimSpace(string(line)), " ")
+		} else if !errors.Is(err, ErrObjectNotFound) {
+			LoggerFrom(ctx).Warn("unable to read checksum sidecar", "key", key+checksumSidecarSuffix, "error", err)
+		}
+	}
+	if expected == "" {
+		LoggerFrom(ctx).Info("archive downloaded, no checksum to verify", "key", key, "size", fi.Size())
+		return nil
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, expected) {
+		return fmt.Errorf("downloaded %s has SHA-256 %s, expected %s", key, sum, expected)
+	}
+	LoggerFrom(ctx).Info("archive downloaded and verified", "key", key, "size", fi.Size(), "sha256", sum)
+	return nil
+}
+
+// partialDownloadPath returns the partial file and progress file of key on
+// destination. The name keeps the archive's name readable; the hash tells
+// apart equal names in different folders or destinations.
+func partialDownloadPath(restoreDir, destination, key string) (string, string) {
+	h := sha256.Sum256([]byte(destination + "\x00" + key))
+	name := hex.EncodeToString(h[:4]) + "-" + path.Base(key) + ".partial"
+	partial := filepath.Join(restoreDir, downloadsFolder, name)
+	return partial, partial + ".json"
+}
+
+func readPartialDownload(path string) (partialDownload, error) {
+	var state partialDownload
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func writePartialDownload(path string, state partialDownload, perm os.FileMode) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, perm)
+}
+
+// downloadWhole copies key in a single request into target, created with
+// perm.
+func downloadWhole(ctx context.Context, src Storage, key, target string, perm os.FileMode) error {
+	body, err := src.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, body); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
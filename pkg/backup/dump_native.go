@@ -0,0 +1,318 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Dump engines for Config.Engine.
+const (
+	EngineMongodump = "mongodump"
+	// EngineNative reads the collections through the driver instead of
+	// running mongodump, for hosts without the Database Tools. It writes
+	// the same layout, so mongorestore reads its dumps like any other.
+	EngineNative = "native"
+)
+
+// nativeCollection is an entry of listCollections.
+type nativeCollection struct {
+	Name    string   `bson:"name"`
+	Type    string   `bson:"type"`
+	Options bson.Raw `bson:"options"`
+	Info    struct {
+		UUID *bson.RawValue `bson:"uuid"`
+	} `bson:"info"`
+}
+
+// dumpNative writes the collections and views of dbName to dir as
+// mongodump --out would: every collection's documents, one after another,
+// to <coll>.bson, and its options, indexes and UUID to
+// <coll>.metadata.json; a view only gets the metadata. Collections with a
+// query in cfg.DumpQueries only get the documents it selects. What
+// mongodump would log is written to logw.
+//
+// A collection larger than cfg.Split is written in numbered parts instead
+// of <coll>.bson; see dumpNativeParts. dumpNative returns the number of
+// parts of those collections, by name.
+//
+// Every collection is read by its own cursor, so the dump is not a
+// point-in-time copy of the database: writes during the dump may show up
+// in one collection and not in another.
+func dumpNative(ctx context.Context, client *mongo.Client, cfg Config, dbName, dir string, logw io.Writer) (map[string]int, error) {
+	if err := os.MkdirAll(dir, cfg.DirMode()); err != nil {
+		return nil, err
+	}
+	db := client.Database(dbName)
+	cursor, err := db.ListCollections(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("list collections: %w", err)
+	}
+	var colls []nativeCollection
+	if err := cursor.All(ctx, &colls); err != nil {
+		return nil, fmt.Errorf("list collections: %w", err)
+	}
+	split := map[string]int{}
+
+	for _, coll := range colls {
+		// mongodump leaves the system collections out too; the views
+		// stored in system.views are dumped on their own
+		if strings.HasPrefix(coll.Name, "system.") && coll.Name != "system.js" {
+			continue
+		}
+		if coll.Type == "timeseries" {
+			return nil, fmt.Errorf("time series collection %s cannot be dumped with BACKUP_ENGINE=native", coll.Name)
+		}
+		base := filepath.Join(dir, url.PathEscape(coll.Name))
+		if coll.Type != "view" {
+			filter, err := nativeFilter(cfg.DumpQueries[dbName+"."+coll.Name])
+			if err != nil {
+				return nil, fmt.Errorf("dump %s: %w", coll.Name, err)
+			}
+			n, parts, err := dumpNativeParts(ctx, db.Collection(coll.Name), base+".bson", filter, cfg.Split, cfg.FileMode())
+			if err != nil {
+				return nil, fmt.Errorf("dump %s: %w", coll.Name, err)
+			}
+			done := fmt.Sprintf("done dumping %s.%s (%d documents)", dbName, coll.Name, n)
+			if parts > 1 {
+				split[coll.Name] = parts
+				done += fmt.Sprintf(" in %d parts", parts)
+			}
+			fmt.Fprintf(logw, "%s\t%s\n", time.Now().Format("2006-01-02T15:04:05.000-0700"), done)
+		}
+		if err := writeNativeMetadata(ctx, db.Collection(coll.Name), coll, base+metadataSuffix, cfg.FileMode()); err != nil {
+			return nil, fmt.Errorf("dump %s: %w", coll.Name, err)
+		}
+	}
+	return split, nil
+}
+
+// nativeFilter parses a query of Config.DumpQueries; an empty one selects
+// every document.
+func nativeFilter(query string) (bson.D, error) {
+	filter := bson.D{}
+	if query != "" {
+		if err := bson.UnmarshalExtJSON([]byte(query), false, &filter); err != nil {
+			return nil, fmt.Errorf("invalid query: %w", err)
+		}
+	}
+	return filter, nil
+}
+
+// dumpNativeParts writes the documents of coll that match filter to path,
+// or, once they outgrow split, to numbered parts of it (see splitPartName)
+// that restore joins again. Every part is read by its own cursor, sorted
+// on _id and starting after the last _id of the part before, so each
+// holds a contiguous _id range. A collection that fits in one part is
+// written to path as usual. It returns the number of documents and of
+// parts, 1 for path.
+func dumpNativeParts(ctx context.Context, coll *mongo.Collection, path string, filter bson.D, split SplitConfig, perm os.FileMode) (int64, int, error) {
+	if !split.enabled() {
+		n, _, err := dumpNativeDocuments(ctx, coll, path, filter, nil, SplitConfig{}, perm)
+		return n, 1, err
+	}
+	// $gt only compares _ids of the same type, so ranges would skip
+	// documents when the collection mixes them
+	ranged, err := uniformIDs(ctx, coll, filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !ranged {
+		LoggerFrom(ctx).Warn("collection mixes _id types, dumping it to a single file", "collection", coll.Database().Name()+"."+coll.Name())
+		n, _, err := dumpNativeDocuments(ctx, coll, path, filter, nil, SplitConfig{}, perm)
+		return n, 1, err
+	}
+
+	var (
+		total int64
+		after *bson.RawValue
+		parts int
+	)
+	for {
+		if parts == maxSplitParts {
+			return total, parts, fmt.Errorf("more than %d parts; raise NATIVE_SPLIT_DOCUMENTS or NATIVE_SPLIT_SIZE_MB", maxSplitParts)
+		}
+		n, last, err := dumpNativeDocuments(ctx, coll, splitPartName(path, parts+1), filter, after, split, perm)
+		if err != nil {
+			return total, parts, err
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+		parts++
+		if last == nil {
+			break
+		}
+		after = last
+	}
+	switch parts {
+	case 0:
+		// An empty collection still gets its file
+		n, _, err := dumpNativeDocuments(ctx, coll, path, filter, nil, SplitConfig{}, perm)
+		return n, 1, err
+	case 1:
+		return total, 1, os.Rename(splitPartName(path, 1), path)
+	}
+	return total, parts, nil
+}
+
+// uniformIDs reports whether the documents of coll that match filter have
+// _ids of a single type, as far as sorting and comparing them goes.
+func uniformIDs(ctx context.Context, coll *mongo.Collection, filter bson.D) (bool, error) {
+	var types []bsontype.Type
+	for _, order := range []int{1, -1} {
+		opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: order}}).SetProjection(bson.D{{Key: "_id", Value: 1}})
+		doc, err := coll.FindOne(ctx, filter, opts).Raw()
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		types = append(types, idBracket(doc.Lookup("_id").Type))
+	}
+	return types[0] == types[1], nil
+}
+
+// idBracket maps t to the first type of its group of types that compare
+// with each other, as numbers do whatever their width.
+func idBracket(t bsontype.Type) bsontype.Type {
+	switch t {
+	case bsontype.Int32, bsontype.Int64, bsontype.Decimal128:
+		return bsontype.Double
+	case bsontype.Symbol:
+		return bsontype.String
+	}
+	return t
+}
+
+// dumpNativeDocuments writes the documents of coll that match filter to
+// path and returns how many there were. Documents are copied as the server
+// sent them. With split enabled, the documents are read in _id order,
+// after the _id after when it is set, and the file ends once it reached
+// split; the _id of its last document is then returned, to continue
+// from. Only a file with documents is created, unless split is disabled.
+func dumpNativeDocuments(ctx context.Context, coll *mongo.Collection, path string, filter bson.D, after *bson.RawValue, split SplitConfig, perm os.FileMode) (int64, *bson.RawValue, error) {
+	opts := options.Find()
+	if split.enabled() {
+		opts.SetSort(bson.D{{Key: "_id", Value: 1}})
+	}
+	if after != nil {
+		idRange := bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: *after}}}}
+		if len(filter) > 0 {
+			filter = bson.D{{Key: "$and", Value: bson.A{filter, idRange}}}
+		} else {
+			filter = idRange
+		}
+	}
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var (
+		out  *os.File
+		w    *bufio.Writer
+		n    int64
+		size int64
+	)
+	create := func() error {
+		var err error
+		if out, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm); err != nil {
+			return err
+		}
+		w = bufio.NewWriterSize(out, 1<<20)
+		return nil
+	}
+	if !split.enabled() {
+		if err := create(); err != nil {
+			return 0, nil, err
+		}
+	}
+	defer func() {
+		if out != nil {
+			out.Close()
+		}
+	}()
+	var last *bson.RawValue
+	for cursor.Next(ctx) {
+		if out == nil {
+			if err := create(); err != nil {
+				return n, nil, err
+			}
+		}
+		if _, err := w.Write(cursor.Current); err != nil {
+			return n, nil, err
+		}
+		n++
+		size += int64(len(cursor.Current))
+		if split.reached(n, size) {
+			id := cursor.Current.Lookup("_id")
+			last = &bson.RawValue{Type: id.Type, Value: slices.Clone(id.Value)}
+			break
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return n, nil, err
+	}
+	if out == nil {
+		return 0, nil, nil
+	}
+	if err := w.Flush(); err != nil {
+		return n, nil, err
+	}
+	err = out.Close()
+	out = nil
+	return n, last, err
+}
+
+// writeNativeMetadata writes the metadata file mongorestore recreates
+// coll from, as canonical Extended JSON like mongodump's.
+func writeNativeMetadata(ctx context.Context, coll *mongo.Collection, spec nativeCollection, path string, perm os.FileMode) error {
+	indexes := bson.A{}
+	if spec.Type != "view" {
+		cursor, err := coll.Indexes().List(ctx)
+		if err != nil {
+			return fmt.Errorf("list indexes: %w", err)
+		}
+		var specs []bson.Raw
+		if err := cursor.All(ctx, &specs); err != nil {
+			return fmt.Errorf("list indexes: %w", err)
+		}
+		for _, index := range specs {
+			indexes = append(indexes, index)
+		}
+	}
+	options := spec.Options
+	if options == nil {
+		options, _ = bson.Marshal(bson.D{})
+	}
+	meta := bson.D{{Key: "options", Value: options}, {Key: "indexes", Value: indexes}}
+	if spec.Info.UUID != nil {
+		if _, data, ok := spec.Info.UUID.BinaryOK(); ok {
+			meta = append(meta, bson.E{Key: "uuid", Value: fmt.Sprintf("%x", data)})
+		}
+	}
+	meta = append(meta, bson.E{Key: "collectionName", Value: spec.Name}, bson.E{Key: "type", Value: spec.Type})
+
+	data, err := bson.MarshalExtJSON(meta, true, false)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, perm)
+}
@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// maxSplitParts bounds the parts of one collection, so that their four
+// digit numbers sort in order as names.
+const maxSplitParts = 9999
+
+// splitPartRE matches the parts dumpNativeParts writes in place of a
+// collection's .bson file.
+var splitPartRE = regexp.MustCompile(`\.bson\.(\d{4})$`)
+
+// splitPartName names part n (from 1) of the collection file path, e.g.
+// orders.bson.0001. mongorestore does not read such files; restore joins
+// them back into path first.
+func splitPartName(path string, n int) string {
+	return fmt.Sprintf("%s.%04d", path, n)
+}
+
+// bsonFileParts returns the files that hold the collection file path: the
+// file itself, or its parts in order when it was split.
+func bsonFileParts(path string) []string {
+	var parts []string
+	for n := 1; n <= maxSplitParts; n++ {
+		part := splitPartName(path, n)
+		if _, err := os.Stat(part); err != nil {
+			break
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return []string{path}
+	}
+	return parts
+}
+
+// joinSplitCollections joins the parts of every split collection below
+// dir into the collection's .bson file, in the order of their numbers,
+// and removes the parts, so that mongorestore finds the files it expects.
+func joinSplitCollections(dir string) error {
+	split := map[string][]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && splitPartRE.MatchString(d.Name()) {
+			base := path[:len(path)-len(".0001")]
+			split[base] = append(split[base], path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for base, parts := range split {
+		slices.Sort(parts)
+		for i, part := range parts {
+			if n, _ := strconv.Atoi(splitPartRE.FindStringSubmatch(part)[1]); n != i+1 {
+				return fmt.Errorf("%s: part %d is missing", base, i+1)
+			}
+		}
+		if err := joinFiles(base, parts); err != nil {
+			return fmt.Errorf("failed to join %s: %w", base, err)
+		}
+		for _, part := range parts {
+			if err := os.Remove(part); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// joinFiles writes the content of parts, one after another, to target. A
+// .bson file is a plain concatenation of documents, so the result is the
+// file the collection would have had unsplit.
+func joinFiles(target string, parts []string) error {
+	info, err := os.Stat(parts[0])
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("%s exists next to its parts", filepath.Base(target))
+	}
+	out, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		in, err := os.Open(part)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
@@ -0,0 +1,148 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// managedDumpFlags are set by BackUp for every database. Passing them again
+// would point mongodump at another cluster or folder than the pipeline
+// expects.
+var managedDumpFlags = []string{"--uri", "--host", "-h", "--port", "--db", "-d", "--out", "-o", "--archive"}
+
+// ParseDumpArgs splits s into the argv appended to every mongodump, the way
+// a POSIX shell would: arguments are separated by whitespace, single quotes
+// preserve everything, double quotes and backslashes escape as in sh.
+// Nothing is expanded. Flags that BackUp sets itself are rejected.
+func ParseDumpArgs(s string) ([]string, error) {
+	args, err := splitShellWords(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		if arg == "" {
+			return nil, errors.New("empty argument")
+		}
+		name, _, _ := strings.Cut(arg, "=")
+		for _, managed := range managedDumpFlags {
+			if name == managed {
+				return nil, fmt.Errorf("%s is set by the backup itself", managed)
+			}
+		}
+	}
+	return args, nil
+}
+
+// ParseDumpQueries reads a JSON object mapping "db.collection" to the
+// mongodump query for that collection, e.g.
+// {"crm.users": {"deleted": false}}. Every query must be an Extended JSON
+// document that mongodump can parse.
+func ParseDumpQueries(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, err
+	}
+	queries := make(map[string]string, len(raw))
+	for ns, query := range raw {
+		db, coll, ok := strings.Cut(ns, ".")
+		if !ok || db == "" || coll == "" {
+			return nil, fmt.Errorf("%q is not a db.collection namespace", ns)
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(query, false, &doc); err != nil {
+			return nil, fmt.Errorf("query for %s: %w", ns, err)
+		}
+		queries[ns] = string(query)
+	}
+	return queries, nil
+}
+
+// queriedCollections returns the collections of dbName that have a dump
+// query, sorted.
+func (c Config) queriedCollections(dbName string) []string {
+	var colls []string
+	for _, ns := range slices.Sorted(maps.Keys(c.DumpQueries)) {
+		if db, coll, _ := strings.Cut(ns, "."); db == dbName {
+			colls = append(colls, coll)
+		}
+	}
+	return colls
+}
+
+func excludeCollectionArgs(colls []string) []string {
+	args := make([]string, 0, len(colls))
+	for _, coll := range colls {
+		args = append(args, "--excludeCollection="+coll)
+	}
+	return args
+}
+
+func splitShellWords(s string) ([]string, error) {
+	var (
+		args  []string
+		word  strings.Builder
+		inArg bool
+		quote rune
+	)
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]):
+				// Inside double quotes a backslash only escapes these
+				i++
+				if runes[i] != '\n' {
+					word.WriteRune(runes[i])
+				}
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == '\\':
+			if i+1 == len(runes) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			if runes[i] != '\n' {
+				word.WriteRune(runes[i])
+				inArg = true
+			}
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, word.String())
+				word.Reset()
+				inArg = false
+			}
+		default:
+			word.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
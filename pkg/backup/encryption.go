@@ -0,0 +1,315 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// Settings of EncryptionConfig.Mode.
+const (
+	EncryptionNone        = "none"
+	EncryptionKMSEnvelope = "kms-envelope"
+	EncryptionAge         = "age"
+)
+
+// Metadata stored on an encrypted archive (x-amz-meta-* on S3). The
+// wrapped data key is also in the archive's header, so a downloaded or
+// copied archive can be decrypted without its metadata.
+const (
+	encryptionMetadata       = "encryption"
+	encryptionKeyIDMetadata  = "encryption-kms-key-id"
+	encryptedDataKeyMetadata = "encrypted-data-key"
+)
+
+// A sealed archive starts with sealMagic, the length of the wrapped data key
+// as a big-endian uint16, the wrapped key and a random nonce prefix. The
+// archive follows in segments of sealSegmentSize bytes, each sealed with
+// AES-GCM under the nonce prefix, the segment number and a last-segment
+// flag, so that a reordered or truncated archive fails to decrypt.
+const (
+	sealSegmentSize = 64 << 10
+	sealPrefixSize  = 7
+	sealSuffix      = ".sealed"
+)
+
+var sealMagic = []byte("MDBKMS01")
+
+// kmsAPI is the part of the KMS client used for envelope encryption.
+type kmsAPI interface {
+	GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// kmsClient is set by InitializeS3Client, with the same credentials and
+// region as the S3 client.
+var kmsClient kmsAPI
+
+// sealArchive encrypts the archive at path for upload when cfg.Mode is
+// EncryptionKMSEnvelope: it asks KMS for a new data key, writes the sealed
+// archive next to path and returns its path with the metadata to store on
+// the object. The caller removes the sealed file. The local archive itself
+// stays in the clear. With EncryptionAge, see sealAgeFile. Otherwise path
+// is returned unchanged, without metadata.
+func sealArchive(ctx context.Context, cfg EncryptionConfig, path string) (string, map[string]string, error) {
+	if cfg.Mode == EncryptionAge {
+		return sealAgeFile(ctx, cfg, path)
+	}
+	if cfg.Mode != EncryptionKMSEnvelope {
+		return path, nil, nil
+	}
+	if kmsClient == nil {
+		return "", nil, errors.New("KMS client not initialized")
+	}
+
+	dataKey, err := kmsClient.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(cfg.KMSKeyID),
+		KeySpec: types.DataKeySpecAes256,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate a data key with %s: %w", cfg.KMSKeyID, err)
+	}
+	defer clear(dataKey.Plaintext)
+
+	sealed := path + sealSuffix
+	if err := sealFile(path, sealed, dataKey.Plaintext, dataKey.CiphertextBlob); err != nil {
+		os.Remove(sealed)
+		return "", nil, fmt.Errorf("failed to encrypt %s: %w", path, err)
+	}
+	LoggerFrom(ctx).Info("archive encrypted", "path", path, "kms_key_id", aws.ToString(dataKey.KeyId))
+	return sealed, map[string]string{
+		encryptionMetadata:       EncryptionKMSEnvelope,
+		encryptionKeyIDMetadata:  aws.ToString(dataKey.KeyId),
+		encryptedDataKeyMetadata: base64.StdEncoding.EncodeToString(dataKey.CiphertextBlob),
+	}, nil
+}
+
+func sealFile(src, dst string, key, wrappedKey []byte) error {
+	if len(wrappedKey) > 0xffff {
+		return fmt.Errorf("wrapped data key of %d bytes is too long", len(wrappedKey))
+	}
+	aead, err := segmentCipher(key)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, sealPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		out.Close()
+		return err
+	}
+	w := bufio.NewWriter(out)
+	w.Write(sealMagic)
+	binary.Write(w, binary.BigEndian, uint16(len(wrappedKey)))
+	w.Write(wrappedKey)
+	w.Write(prefix)
+
+	r := bufio.NewReaderSize(in, sealSegmentSize)
+	plain := make([]byte, sealSegmentSize)
+	sealed := make([]byte, 0, sealSegmentSize+aead.Overhead())
+	for segment := uint32(0); ; segment++ {
+		n, err := io.ReadFull(r, plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			out.Close()
+			return err
+		}
+		// Only the last segment may be short; a full one is last when
+		// nothing follows
+		last := n < sealSegmentSize
+		if !last {
+			if _, peekErr := r.Peek(1); peekErr == io.EOF {
+				last = true
+			}
+		}
+		if segment == ^uint32(0) && !last {
+			out.Close()
+			return errors.New("archive too large to encrypt")
+		}
+		sealed = aead.Seal(sealed[:0], segmentNonce(prefix, segment, last), plain[:n], nil)
+		if _, err := w.Write(sealed); err != nil {
+			out.Close()
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// unsealArchive decrypts the archive at path in place when it was sealed
+// by sealArchive, unwrapping its data key with KMS, or encrypted to age
+// recipients, with cfg.AgeIdentities. It reports whether it was sealed.
+// Plain archives are left alone.
+func unsealArchive(ctx context.Context, cfg EncryptionConfig, path string) (bool, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	r := bufio.NewReaderSize(in, sealSegmentSize)
+	head, _ := r.Peek(sealHeadSize)
+	if !isSealed(head) {
+		return false, nil
+	}
+	if bytes.HasPrefix(head, ageMagic) {
+		info, err := in.Stat()
+		if err != nil {
+			return true, err
+		}
+		plainPath := path + ".plain"
+		if err := unsealAgeArchive(ctx, cfg, r, plainPath, info.Mode().Perm()); err != nil {
+			return true, err
+		}
+		in.Close()
+		LoggerFrom(ctx).Info("archive decrypted", "path", path, "mode", EncryptionAge)
+		return true, os.Rename(plainPath, path)
+	}
+	if kmsClient == nil {
+		return true, errors.New("archive is encrypted with ENCRYPTION_MODE=kms-envelope but no KMS client is initialized")
+	}
+
+	header := make([]byte, len(sealMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return true, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	wrappedKey := make([]byte, binary.BigEndian.Uint16(header[len(sealMagic):]))
+	prefix := make([]byte, sealPrefixSize)
+	if _, err := io.ReadFull(r, wrappedKey); err != nil {
+		return true, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return true, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+
+	dataKey, err := kmsClient.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: wrappedKey})
+	if err != nil {
+		return true, fmt.Errorf("failed to decrypt the data key with KMS: %w", err)
+	}
+	defer clear(dataKey.Plaintext)
+	aead, err := segmentCipher(dataKey.Plaintext)
+	if err != nil {
+		return true, err
+	}
+
+	info, err := in.Stat()
+	if err != nil {
+		return true, err
+	}
+	plainPath := path + ".plain"
+	out, err := os.OpenFile(plainPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return true, err
+	}
+	if err := openSegments(r, out, aead, prefix); err != nil {
+		out.Close()
+		os.Remove(plainPath)
+		return true, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(plainPath)
+		return true, err
+	}
+	in.Close()
+	LoggerFrom(ctx).Info("archive decrypted", "path", path, "kms_key_id", aws.ToString(dataKey.KeyId))
+	return true, os.Rename(plainPath, path)
+}
+
+func openSegments(r *bufio.Reader, w io.Writer, aead cipher.AEAD, prefix []byte) error {
+	sealed := make([]byte, sealSegmentSize+aead.Overhead())
+	plain := make([]byte, 0, sealSegmentSize)
+	for segment := uint32(0); ; segment++ {
+		n, err := io.ReadFull(r, sealed)
+		if err == io.EOF {
+			return errors.New("encrypted archive is truncated")
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(sealed)
+		if !last {
+			if _, peekErr := r.Peek(1); peekErr == io.EOF {
+				last = true
+			}
+		}
+		plain, err = aead.Open(plain[:0], segmentNonce(prefix, segment, last), sealed[:n], nil)
+		if err != nil {
+			return fmt.Errorf("encrypted archive is corrupt or truncated at segment %d", segment)
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func segmentCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce is the 12-byte GCM nonce of a segment: the archive's random
+// prefix, the segment number and 1 for the last segment.
+func segmentNonce(prefix []byte, segment uint32, last bool) []byte {
+	nonce := make([]byte, 0, sealPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, segment)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// fileIsSealed reports whether the file at path is a sealed archive.
+func fileIsSealed(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	head := make([]byte, sealHeadSize)
+	n, _ := io.ReadFull(file, head)
+	return isSealed(head[:n]), nil
+}
+
+// isSealed reports whether head, the first sealHeadSize bytes of a file,
+// starts a sealed or age-encrypted archive.
+func isSealed(head []byte) bool {
+	return bytes.HasPrefix(head, sealMagic) || bytes.HasPrefix(head, ageMagic)
+}
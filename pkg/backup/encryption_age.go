@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"filippo.io/age"
+)
+
+// ageMagic starts every binary age file: the first line of its header.
+var ageMagic = []byte("age-encryption.org/v1\n")
+
+// sealHeadSize is how much of a file tells a sealed archive, of either
+// mode, from a plain one.
+var sealHeadSize = max(len(sealMagic), len(ageMagic))
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// sealWriter returns a writer that encrypts to cfg.AgeRecipients what is
+// written to w when cfg.Mode is EncryptionAge, so that an archive is
+// compressed and encrypted in a single pass. Closing it writes the last
+// chunk but does not close w. In the other modes what is written goes to w
+// unchanged.
+func sealWriter(cfg EncryptionConfig, w io.Writer) (io.WriteCloser, error) {
+	if cfg.Mode != EncryptionAge {
+		return nopWriteCloser{w}, nil
+	}
+	if len(cfg.AgeRecipients) == 0 {
+		return nil, errors.New("no age recipients configured")
+	}
+	return age.Encrypt(w, cfg.AgeRecipients...)
+}
+
+// sealAgeFile encrypts the file at path to cfg.AgeRecipients for upload,
+// unless archiveFolder already did as it wrote it, and returns the path to
+// upload with the metadata to store on the object. The caller removes a
+// returned path that differs from path.
+func sealAgeFile(ctx context.Context, cfg EncryptionConfig, path string) (string, map[string]string, error) {
+	metadata := map[string]string{encryptionMetadata: EncryptionAge}
+	in, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer in.Close()
+	head := make([]byte, len(ageMagic))
+	n, _ := io.ReadFull(in, head)
+	if bytes.Equal(head[:n], ageMagic) {
+		return path, metadata, nil
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	info, err := in.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+
+	sealed := path + sealSuffix
+	err = writeArchiveFile(sealed, info.Mode().Perm(), func(w io.Writer) error {
+		enc, err := sealWriter(cfg, w)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(enc, in); err != nil {
+			return err
+		}
+		return enc.Close()
+	})
+	if err != nil {
+		os.Remove(sealed)
+		return "", nil, fmt.Errorf("failed to encrypt %s: %w", path, err)
+	}
+	LoggerFrom(ctx).Info("file encrypted", "path", path, "recipients", len(cfg.AgeRecipients))
+	return sealed, metadata, nil
+}
+
+// unsealAgeArchive decrypts the age-encrypted archive read from r with
+// cfg.AgeIdentities into plainPath, created with perm.
+func unsealAgeArchive(ctx context.Context, cfg EncryptionConfig, r io.Reader, plainPath string, perm os.FileMode) error {
+	if len(cfg.AgeIdentities) == 0 {
+		return errors.New("archive is encrypted with ENCRYPTION_MODE=age but no age identity is configured")
+	}
+	plain, err := age.Decrypt(r, cfg.AgeIdentities...)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt with the age identities: %w", err)
+	}
+	err = writeArchiveFile(plainPath, perm, func(w io.Writer) error {
+		_, err := io.Copy(w, plain)
+		return err
+	})
+	if err != nil {
+		os.Remove(plainPath)
+		// age authenticates every chunk, so a corrupt or truncated archive
+		// fails here rather than restoring partially
+		return fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return nil
+}
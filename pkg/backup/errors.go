@@ -0,0 +1,15 @@
+package backup
+
+import "errors"
+
+// Sentinel errors identifying the pipeline stage that failed. Every error
+// returned by BackUp, UploadToS3, CleanExportsFolder, RestoreFromS3 and
+// VerifyArchive wraps one of them, so callers can branch with errors.Is.
+var (
+	ErrMongoConnect  = errors.New("mongodb connection failed")
+	ErrDumpFailed    = errors.New("database dump failed")
+	ErrUploadFailed  = errors.New("upload failed")
+	ErrCleanup       = errors.New("cleanup failed")
+	ErrRestoreFailed = errors.New("restore failed")
+	ErrVerifyFailed  = errors.New("archive verification failed")
+)
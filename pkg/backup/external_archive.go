@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// mongodumpArchiveMagic starts every file mongodump --archive writes,
+	// 0x8199e26d in little-endian order.
+	mongodumpArchiveMagic = []byte{0x6d, 0xe2, 0x99, 0x81}
+	// gzipMagic starts an archive written with --archive --gzip, which is
+	// compressed as a whole.
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// stageArchive puts cfg.ExternalArchive into cfg.OutputDir in place of a
+// dump, with a manifest naming it, so that UploadToS3 archives, encrypts
+// and uploads it like any backup. The file is hard-linked when it is on
+// the same file system and copied otherwise, so cleaning the folder leaves
+// the original alone.
+func stageArchive(ctx context.Context, cfg Config) error {
+	log := LoggerFrom(ctx)
+	src := cfg.ExternalArchive
+	name := filepath.Base(src)
+	if name == manifestFileName {
+		return fmt.Errorf("%w: %s: an archive cannot be named %s", ErrDumpFailed, src, manifestFileName)
+	}
+	gzipped, size, err := checkMongodumpArchive(src)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDumpFailed, err)
+	}
+
+	target := filepath.Join(cfg.OutputDir, name)
+	// A leftover could be a link to src, which copying over would truncate
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%w: %w", ErrDumpFailed, err)
+	}
+	if err := os.Link(src, target); err != nil {
+		if err := copyFile(src, target); err != nil {
+			os.Remove(target)
+			return fmt.Errorf("%w: failed to stage %s: %w", ErrDumpFailed, src, err)
+		}
+	}
+
+	manifest := Manifest{
+		CreatedAt:       time.Now().UTC(),
+		Label:           cfg.Label,
+		AppVersion:      cfg.AppVersion,
+		Databases:       []DatabaseManifest{},
+		ExternalArchive: name,
+	}
+	if err := writeManifest(cfg, filepath.Join(cfg.OutputDir, manifestFileName), manifest); err != nil {
+		log.Warn("failed to write manifest", "error", err)
+	}
+	log.Info("mongodump archive staged", "path", src, "size", size, "gzip", gzipped)
+	return nil
+}
+
+// checkMongodumpArchive checks that path is a regular file written by
+// mongodump --archive, with or without --gzip, and returns whether it is
+// gzipped and its size.
+func checkMongodumpArchive(path string) (gzipped bool, size int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, 0, fmt.Errorf("%s is not a regular file", path)
+	}
+	head, err := readHead(file)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if bytes.HasPrefix(head, gzipMagic) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return false, 0, err
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return false, 0, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		defer gz.Close()
+		if head, err = readHead(gz); err != nil {
+			return false, 0, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		gzipped = true
+	}
+	if !bytes.Equal(head, mongodumpArchiveMagic) {
+		return false, 0, fmt.Errorf("%s is not a mongodump --archive file", path)
+	}
+	return gzipped, info.Size(), nil
+}
+
+// readHead reads the first bytes of r, as many as mongodumpArchiveMagic
+// has or fewer when r is shorter.
+func readHead(r io.Reader) ([]byte, error) {
+	head := make([]byte, len(mongodumpArchiveMagic))
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return head[:n], err
+}
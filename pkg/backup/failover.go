@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// defaultFailoverGrace covers an election and the driver noticing it.
+const defaultFailoverGrace = time.Minute
+
+// failoverRetry is the wait between two attempts of an operation that
+// failed during a failover. Elections usually take a few seconds.
+var failoverRetry = Backoff{Base: 2 * time.Second, Max: 15 * time.Second}
+
+// failoverCodes are the server error codes of a node that stepped down,
+// is not primary (yet), or is shutting down or unreachable.
+var failoverCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// failoverMessages are what mongodump reports for the same errors in its
+// last "Failed:" line; its exit status does not tell them apart.
+var failoverMessages = []string{
+	"server selection error",
+	"not primary",
+	"not master",
+	"node is recovering",
+	"NotWritablePrimary",
+	"NotPrimaryNoSecondaryOk",
+	"NotPrimaryOrSecondary",
+	"PrimarySteppedDown",
+	"InterruptedDueToReplStateChange",
+	"InterruptedAtShutdown",
+	"ShutdownInProgress",
+	"connection reset by peer",
+	"incomplete read of message header",
+}
+
+// dumpFailoverError is a failed mongodump whose output names a transient
+// topology error, in Line.
+type dumpFailoverError struct {
+	err  error
+	Line string
+}
+
+func (e *dumpFailoverError) Error() string {
+	return e.err.Error() + ": " + e.Line
+}
+
+func (e *dumpFailoverError) Unwrap() error {
+	return e.err
+}
+
+// failoverError reports whether err is one a replica set failover causes
+// and that goes away once a new primary is elected: a server selection or
+// network error, or a server error of a node that is not primary.
+func failoverError(err error) bool {
+	var dumpErr *dumpFailoverError
+	if errors.As(err, &dumpErr) || errors.As(err, new(topology.ServerSelectionError)) || mongo.IsNetworkError(err) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		for _, code := range failoverCodes {
+			if serverErr.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mongodumpFailover returns err, of a mongodump whose output ended in
+// output, as a *dumpFailoverError when its failure names a failover.
+func mongodumpFailover(err error, output string) error {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		_, failure, ok := strings.Cut(lines[i], "Failed: ")
+		if !ok {
+			continue
+		}
+		for _, msg := range failoverMessages {
+			if strings.Contains(failure, msg) {
+				return &dumpFailoverError{err: err, Line: failure}
+			}
+		}
+		break
+	}
+	return err
+}
+
+// retryFailover runs fn, named op in the log, and runs it again while it
+// fails with a failoverError, for up to grace after the first failure.
+// Other errors, and the last failover error, are returned as they are.
+func retryFailover(ctx context.Context, grace time.Duration, op string, fn func() error) error {
+	var deadline time.Time
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil && attempt > 1 {
+			LoggerFrom(ctx).Info("recovered after failover", "operation", op, "attempts", attempt)
+		}
+		if err == nil || grace <= 0 || !failoverError(err) || ctx.Err() != nil {
+			return err
+		}
+		if deadline.IsZero() {
+			deadline = time.Now().Add(grace)
+		}
+		wait := failoverRetry.delay(attempt)
+		if time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		LoggerFrom(ctx).Warn("failover suspected, retrying", "operation", op, "attempt", attempt, "wait", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// outputTail keeps the last limit bytes written to it, such as the end of
+// a mongodump's output.
+type outputTail struct {
+	limit int
+	mu    sync.Mutex
+	buf   []byte
+}
+
+func (t *outputTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.limit; over > 0 {
+		t.buf = t.buf[over:]
+	}
+	return len(p), nil
+}
+
+func (t *outputTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
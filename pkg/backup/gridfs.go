@@ -0,0 +1,184 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxReportedGridFSProblems caps how many broken files are listed per
+// bucket so a badly damaged bucket does not flood the log.
+const maxReportedGridFSProblems = 10
+
+// gridFSBuckets returns the GridFS bucket names found in a database's
+// collection names. A bucket consists of <bucket>.files and <bucket>.chunks.
+func gridFSBuckets(collections []CollectionManifest) []string {
+	names := make(map[string]bool, len(collections))
+	for _, c := range collections {
+		names[c.Name] = true
+	}
+
+	var buckets []string
+	for name := range names {
+		bucket, ok := strings.CutSuffix(name, ".files")
+		if ok && names[bucket+".chunks"] {
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// verifyGridFSDump checks that every file in the dumped bucket has all of
+// its chunks and that no chunk belongs to a missing file. mongodump does not
+// dump .files and .chunks at the same instant, so uploads or deletes made
+// while the dump ran can leave the two out of step.
+func verifyGridFSDump(dumpDir, bucket string) ([]string, error) {
+	type fileState struct {
+		id       string
+		expected int64
+		seen     map[int64]bool
+	}
+	files := make(map[string]*fileState)
+	var order []string
+
+	err := readBSONFile(filepath.Join(dumpDir, bucket+".files.bson"), func(doc bson.Raw) error {
+		id, err := doc.LookupErr("_id")
+		if err != nil {
+			return fmt.Errorf("file without _id: %w", err)
+		}
+		length, _ := doc.Lookup("length").AsInt64OK()
+		chunkSize, _ := doc.Lookup("chunkSize").AsInt64OK()
+		var expected int64
+		if length > 0 {
+			if chunkSize <= 0 {
+				return fmt.Errorf("file %s has length %d but no chunkSize", id, length)
+			}
+			expected = (length + chunkSize - 1) / chunkSize
+		}
+		key := string(id.Type) + string(id.Value)
+		if _, ok := files[key]; !ok {
+			order = append(order, key)
+		}
+		files[key] = &fileState{id: id.String(), expected: expected, seen: make(map[int64]bool)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	orphans := 0
+	err = readBSONFile(filepath.Join(dumpDir, bucket+".chunks.bson"), func(doc bson.Raw) error {
+		id, err := doc.LookupErr("files_id")
+		if err != nil {
+			return fmt.Errorf("chunk without files_id: %w", err)
+		}
+		n, _ := doc.Lookup("n").AsInt64OK()
+		f, ok := files[string(id.Type)+string(id.Value)]
+		if !ok {
+			orphans++
+			return nil
+		}
+		f.seen[n] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	broken := 0
+	for _, key := range order {
+		f := files[key]
+		missing := int64(0)
+		for n := int64(0); n < f.expected; n++ {
+			if !f.seen[n] {
+				missing++
+			}
+		}
+		if missing == 0 && int64(len(f.seen)) == f.expected {
+			continue
+		}
+		broken++
+		if broken <= maxReportedGridFSProblems {
+			problems = append(problems, fmt.Sprintf("file %s: expected %d chunks, found %d, %d missing",
+				f.id, f.expected, len(f.seen), missing))
+		}
+	}
+	if broken > maxReportedGridFSProblems {
+		problems = append(problems, fmt.Sprintf("%d more inconsistent files", broken-maxReportedGridFSProblems))
+	}
+	if orphans > 0 {
+		problems = append(problems, fmt.Sprintf("%d chunks belong to no file", orphans))
+	}
+	return problems, nil
+}
+
+// verifyGridFS runs verifyGridFSDump for every bucket of a dumped database
+// and logs a warning for each inconsistent bucket.
+func verifyGridFS(ctx context.Context, dumpDir, dbName string, buckets []string) {
+	log := LoggerFrom(ctx)
+	for _, bucket := range buckets {
+		problems, err := verifyGridFSDump(dumpDir, bucket)
+		if err != nil {
+			log.Warn("unable to verify GridFS bucket", "db", dbName, "bucket", bucket, "error", err)
+			continue
+		}
+		if len(problems) > 0 {
+			log.Warn("GridFS bucket looks inconsistent", "db", dbName, "bucket", bucket, "problems", problems)
+			continue
+		}
+		log.Info("GridFS bucket verified", "db", dbName, "bucket", bucket)
+	}
+}
+
+// readBSONFile calls fn for every document in a mongodump .bson file, which
+// is a plain concatenation of BSON documents, or in its parts in order when
+// the collection was dumped split.
+func readBSONFile(path string, fn func(bson.Raw) error) error {
+	for _, part := range bsonFileParts(path) {
+		if err := readBSONPart(part, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBSONPart(path string, fn func(bson.Raw) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		n := int32(binary.LittleEndian.Uint32(size[:]))
+		if n < 5 {
+			return fmt.Errorf("%s: invalid document length %d", path, n)
+		}
+		doc := make([]byte, n)
+		copy(doc, size[:])
+		if _, err := io.ReadFull(r, doc[4:]); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := fn(bson.Raw(doc)); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// indexSpecsSuffix marks the per-database index inventories written with
+// Config.IndexSpecs.
+const indexSpecsSuffix = ".indexes.json"
+
+func indexSpecsName(dbName string) string {
+	return dbName + indexSpecsSuffix
+}
+
+// DatabaseIndexes is the index inventory of a database, written to
+// <db>.indexes.json at the root of the archive.
+type DatabaseIndexes struct {
+	Database    string              `json:"database"`
+	Collections []CollectionIndexes `json:"collections"`
+}
+
+type CollectionIndexes struct {
+	Name string `json:"name"`
+	// Indexes are the specs listIndexes returned, sorted by name, as
+	// relaxed extended JSON.
+	Indexes []json.RawMessage `json:"indexes"`
+}
+
+// writeIndexSpecs lists the indexes of every collection of the database
+// dumped into m and writes them to path. The inventory holds nothing that
+// changes from one run to the next, so two of them can be diffed as they
+// are.
+func writeIndexSpecs(ctx context.Context, client *mongo.Client, m DatabaseManifest, path string, perm os.FileMode) error {
+	db := client.Database(m.Name)
+	inventory := DatabaseIndexes{Database: m.Name, Collections: []CollectionIndexes{}}
+	for _, coll := range m.Collections {
+		cursor, err := db.Collection(coll.Name).Indexes().List(ctx)
+		if err != nil {
+			return fmt.Errorf("list indexes of %s: %w", coll.Name, err)
+		}
+		var specs []bson.Raw
+		if err := cursor.All(ctx, &specs); err != nil {
+			return fmt.Errorf("list indexes of %s: %w", coll.Name, err)
+		}
+		slices.SortFunc(specs, func(a, b bson.Raw) int {
+			nameA, _ := a.Lookup("name").StringValueOK()
+			nameB, _ := b.Lookup("name").StringValueOK()
+			return strings.Compare(nameA, nameB)
+		})
+		entry := CollectionIndexes{Name: coll.Name, Indexes: make([]json.RawMessage, len(specs))}
+		for i, spec := range specs {
+			data, err := bson.MarshalExtJSON(spec, false, false)
+			if err != nil {
+				return fmt.Errorf("index of %s: %w", coll.Name, err)
+			}
+			entry.Indexes[i] = data
+		}
+		inventory.Collections = append(inventory.Collections, entry)
+	}
+	slices.SortFunc(inventory.Collections, func(a, b CollectionIndexes) int { return strings.Compare(a.Name, b.Name) })
+
+	data, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), perm)
+}
@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	archivePrefix   = "mongodb-dump-"
+	labelMetadata   = "backup-label"
+	clusterMetadata = "backup-cluster"
+	versionMetadata = "backup-app-version"
+)
+
+// labelPattern keeps labels safe in object keys and file names. The
+// underscore is reserved as the separator between date and label.
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]{0,63}$`)
+
+// appVersionPattern keeps app versions, such as v1.4.2 or a commit hash,
+// safe in object metadata, which only takes printable ASCII.
+var appVersionPattern = regexp.MustCompile(`^[!-~]{1,128}$`)
+
+// clusterNameUnsafe matches the runs of characters SanitizeClusterName
+// replaces.
+var clusterNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9-]+`)
+
+// SanitizeClusterName turns name into a Config.ClusterName: runs of
+// anything but letters, digits and dashes become a single dash, and dashes
+// at either end are dropped, so "Prod EU/1" becomes "Prod-EU-1". The
+// result is empty when name has no usable character.
+func SanitizeClusterName(name string) string {
+	name = clusterNameUnsafe.ReplaceAllString(name, "-")
+	name = strings.Trim(name, "-")
+	if len(name) > 64 {
+		name = strings.TrimRight(name[:64], "-")
+	}
+	return name
+}
+
+// ValidateLabel reports whether label can be used as Config.Label.
+func ValidateLabel(label string) error {
+	if !labelPattern.MatchString(label) {
+		return fmt.Errorf("invalid label %q: use up to 64 letters, digits, dots and dashes", label)
+	}
+	return nil
+}
+
+// ValidateAppVersion reports whether version can be used as
+// Config.AppVersion.
+func ValidateAppVersion(version string) error {
+	if !appVersionPattern.MatchString(version) {
+		return fmt.Errorf("invalid app version %q: use up to 128 printable ASCII characters without spaces", version)
+	}
+	return nil
+}
+
+// runName names a backup taken at t: mongodb-dump-2024-06-01, or
+// mongodb-dump-2024-06-01_<label>.
+func runName(t time.Time, label string) string {
+	name := archivePrefix + t.Format("2006-01-02")
+	if label != "" {
+		name += "_" + label
+	}
+	return name
+}
+
+// archiveName returns the archive file name and key for a backup taken at
+// t: mongodb-dump-2024-06-01.zip, or mongodb-dump-2024-06-01_<label>.zip.
+func archiveName(t time.Time, label, format string) string {
+	return runName(t, label) + archiveExtension(format)
+}
+
+// IsLabeledKey reports whether key belongs to a labeled backup, which
+// retention must never delete: a labeled archive or an object in the
+// folder of a labeled per-database run.
+func IsLabeledKey(key string) bool {
+	for _, part := range strings.Split(key, "/") {
+		if strings.HasPrefix(part, archivePrefix) && strings.Contains(part, "_") {
+			return true
+		}
+	}
+	return false
+}
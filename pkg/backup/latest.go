@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"time"
+)
+
+// LatestPointer is the content of the latest pointer object. Restore
+// automation can fetch this one fixed key instead of listing the bucket.
+type LatestPointer struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	Checksum    string    `json:"checksum,omitempty"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	ToolVersion string    `json:"tool_version"`
+}
+
+// Copier is implemented by storages that can duplicate an object without
+// the bytes passing through this process.
+type Copier interface {
+	Copy(ctx context.Context, srcKey string, dst Object) error
+}
+
+// errCopyTooLarge is returned by a Copier that cannot copy an object of
+// that size in one request.
+var errCopyTooLarge = errors.New("object too large to copy")
+
+// updateLatest points the latest pointer (and the latest copy, when
+// configured) at obj on every destination that received it. Failures are
+// logged only: the backup itself is already stored.
+func updateLatest(ctx context.Context, cfg Config, uploaded []Storage, path string, obj Object, checksum string) {
+	log := LoggerFrom(ctx)
+
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	pointer, err := json.MarshalIndent(LatestPointer{
+		Key:         obj.Key,
+		Size:        size,
+		ContentType: obj.ContentType,
+		Checksum:    checksum,
+		UploadedAt:  time.Now().UTC(),
+		ToolVersion: Version,
+	}, "", "  ")
+	if err != nil {
+		log.Warn("failed to build latest pointer", "error", err)
+		return
+	}
+
+	copyKey, pointerKey := cfg.clusterKey(cfg.Upload.LatestCopy), cfg.clusterKey(cfg.Upload.LatestPointer)
+	for _, dest := range uploaded {
+		if cfg.Upload.LatestCopy != "" {
+			if err := copyLatest(ctx, dest, path, obj, copyKey); err != nil {
+				log.Warn("failed to update latest copy", "key", copyKey, "destination", dest.Name(), "error", err)
+			} else {
+				log.Info("latest copy updated", "key", copyKey, "destination", dest.Name())
+			}
+		}
+
+		if cfg.Upload.LatestPointer != "" {
+			err := dest.Upload(ctx, Object{
+				Key:          pointerKey,
+				Body:         bytes.NewReader(pointer),
+				ContentType:  "application/json",
+				CacheControl: "no-cache",
+				Metadata:     map[string]string{toolVersionMetadata: Version},
+			})
+			if err != nil {
+				log.Warn("failed to update latest pointer", "key", pointerKey, "destination", dest.Name(), "error", err)
+			} else {
+				log.Info("latest pointer updated", "key", pointerKey, "target", obj.Key, "destination", dest.Name())
+			}
+		}
+	}
+}
+
+// copyLatest copies the archive to key, server-side when dest supports it
+// and by uploading the local file again otherwise.
+func copyLatest(ctx context.Context, dest Storage, path string, obj Object, key string) error {
+	dst := obj
+	dst.Key = key
+	dst.ContentDisposition, dst.CacheControl = "", "no-cache"
+	dst.Metadata = map[string]string{toolVersionMetadata: Version}
+	maps.Copy(dst.Metadata, obj.Metadata)
+
+	if c, ok := dest.(Copier); ok {
+		err := c.Copy(ctx, obj.Key, dst)
+		if !errors.Is(err, errCopyTooLarge) {
+			return err
+		}
+		LoggerFrom(ctx).Info("archive too large for a server-side copy, uploading it again", "key", key, "destination", dest.Name())
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dst.Body = file
+	return dest.Upload(ctx, dst)
+}
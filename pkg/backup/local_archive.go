@@ -0,0 +1,122 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// keepLocalArchive moves src, an archive or the staging folder of a
+// per-database run, into cfg.LocalArchive.Dir, then deletes the oldest kept
+// archives beyond cfg.LocalArchive.Count.
+func keepLocalArchive(ctx context.Context, cfg Config, src string) error {
+	log := LoggerFrom(ctx)
+	if err := os.MkdirAll(cfg.LocalArchive.Dir, cfg.DirMode()); err != nil {
+		return err
+	}
+	target := filepath.Join(cfg.LocalArchive.Dir, filepath.Base(src))
+	// A second run on the same day replaces the first one's archive
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	if err := moveAcross(src, target); err != nil {
+		return err
+	}
+	log.Info("local archive kept", "path", target)
+	return rotateLocalArchives(ctx, cfg.LocalArchive)
+}
+
+// moveAcross renames src to target, copying it when they are on different
+// file systems, e.g. a volume mounted for the secondary copy.
+func moveAcross(src, target string) error {
+	err := os.Rename(src, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.CopyFS(target, os.DirFS(src))
+	} else {
+		err = copyFile(src, target)
+	}
+	if err != nil {
+		os.RemoveAll(target)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyFile copies src to target with the mode of src.
+func copyFile(src, target string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// rotateLocalArchives deletes the kept archives and run folders of
+// cfg.Dir beyond the newest cfg.Count. Other files are left alone.
+func rotateLocalArchives(ctx context.Context, cfg LocalArchiveConfig) error {
+	if cfg.Count <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return err
+	}
+	type kept struct {
+		name string
+		info os.FileInfo
+	}
+	var archives []kept
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), archivePrefix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		archives = append(archives, kept{e.Name(), info})
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].info.ModTime().After(archives[j].info.ModTime())
+	})
+
+	var errs []error
+	for _, a := range archives[min(cfg.Count, len(archives)):] {
+		path := filepath.Join(cfg.Dir, a.name)
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		LoggerFrom(ctx).Info("old local archive removed", "path", path)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to rotate local archives: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+)
+
+type loggerKey struct{}
+
+// WithLogger attaches a run-scoped logger to ctx so every function taking
+// part in a run logs with the same fields (such as run_id).
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFrom returns the logger attached by WithLogger, or slog's default.
+func LoggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+type outputKey struct{}
+
+// WithCommandOutput makes mongodump and mongorestore write their standard
+// output to w instead of os.Stdout, e.g. when stdout carries an archive.
+func WithCommandOutput(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, outputKey{}, w)
+}
+
+func commandOutput(ctx context.Context) io.Writer {
+	if w, ok := ctx.Value(outputKey{}).(io.Writer); ok {
+		return w
+	}
+	return os.Stdout
+}
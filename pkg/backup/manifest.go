@@ -0,0 +1,220 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	manifestFileName     = "manifest.json"
+	lastManifestFileName = "last-manifest.json"
+	manifestCountTimeout = 5 * time.Minute
+)
+
+// Manifest records what a backup contained at dump time. It is written to
+// the root of the archive so that later backups can be compared against it.
+type Manifest struct {
+	CreatedAt time.Time          `json:"created_at"`
+	Label     string             `json:"label,omitempty"`
+	Databases []DatabaseManifest `json:"databases"`
+	// AppVersion is Config.AppVersion at the time of the backup.
+	AppVersion string `json:"app_version,omitempty"`
+	// DumpVersion is the version of the mongodump that wrote the backup.
+	DumpVersion string `json:"mongodump_version,omitempty"`
+	// Engine is EngineNative for a backup dumped through the driver, and
+	// empty for one dumped with mongodump.
+	Engine string `json:"engine,omitempty"`
+	// SizeAnomaly marks a suspicious backup, whose size is far from the
+	// recent average. See ManifestConfig.SizeDeviation.
+	SizeAnomaly *SizeAnomaly `json:"size_anomaly,omitempty"`
+	// ExternalArchive names the mongodump --archive file a backup holds
+	// instead of a dump, for one made with Config.ExternalArchive. Such a
+	// manifest lists no databases.
+	ExternalArchive string `json:"external_archive,omitempty"`
+	// ViewsAsCollections is set when mongodump ran with
+	// --viewsAsCollections, which dumps the documents of every view as a
+	// collection, so they are restored as collections too.
+	ViewsAsCollections bool `json:"views_as_collections,omitempty"`
+}
+
+type DatabaseManifest struct {
+	Name        string               `json:"name"`
+	Collections []CollectionManifest `json:"collections"`
+	Error       string               `json:"error,omitempty"`
+	// Size is the number of bytes mongodump wrote for the database.
+	Size int64 `json:"size,omitempty"`
+	// GridFSBuckets lists the buckets whose .files and .chunks collections
+	// were both present.
+	GridFSBuckets []string `json:"gridfs_buckets,omitempty"`
+	// Views lists the definitions of the database's views, which mongodump
+	// dumps as metadata only.
+	Views []ViewManifest `json:"views,omitempty"`
+
+	// Set when BACKUP_CHANGED_ONLY is enabled. Unchanged databases are not
+	// dumped; their entry is carried over and BackedUpAt points at the run
+	// whose archive holds their data.
+	ChangeMarker string    `json:"change_marker,omitempty"`
+	BackedUpAt   time.Time `json:"backed_up_at"`
+	Unchanged    bool      `json:"unchanged,omitempty"`
+}
+
+type CollectionManifest struct {
+	Name      string `json:"name"`
+	Documents int64  `json:"documents"`
+	// StorageSize is collStats' storageSize, set with
+	// ManifestConfig.CollectionStats.
+	StorageSize int64 `json:"storage_size,omitempty"`
+	// Parts is the number of files the collection was dumped to, when it
+	// was split with Config.Split.
+	Parts int `json:"parts,omitempty"`
+}
+
+type ViewManifest struct {
+	Name   string `json:"name"`
+	ViewOn string `json:"view_on"`
+	// Pipeline is the view's aggregation pipeline as relaxed extended
+	// JSON.
+	Pipeline json.RawMessage `json:"pipeline"`
+}
+
+func collectDatabaseManifest(ctx context.Context, client *mongo.Client, dbName string) DatabaseManifest {
+	ctx, cancel := context.WithTimeout(ctx, manifestCountTimeout)
+	defer cancel()
+
+	entry := DatabaseManifest{Name: dbName, Collections: []CollectionManifest{}}
+	db := client.Database(dbName)
+	names, err := db.ListCollectionNames(ctx, bson.D{{Key: "type", Value: "collection"}})
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+
+	for _, name := range names {
+		count, err := db.Collection(name).CountDocuments(ctx, bson.D{})
+		if err != nil {
+			entry.Error = fmt.Sprintf("count %s: %v", name, err)
+			return entry
+		}
+		entry.Collections = append(entry.Collections, CollectionManifest{Name: name, Documents: count})
+	}
+	entry.GridFSBuckets = gridFSBuckets(entry.Collections)
+	if entry.Views, err = listViews(ctx, db); err != nil {
+		entry.Error = fmt.Sprintf("list views: %v", err)
+	}
+	return entry
+}
+
+func writeManifest(cfg Config, path string, m Manifest) error {
+	if err := os.MkdirAll(filepath.Dir(path), cfg.DirMode()); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, cfg.FileMode())
+}
+
+func readManifest(path string) (Manifest, error) {
+	var m Manifest
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// compareWithPreviousManifest warns about collections whose document count
+// dropped by more than cfg.Manifest.DropThreshold percent since the last
+// successfully uploaded backup.
+func compareWithPreviousManifest(ctx context.Context, cfg Config, current Manifest) {
+	log := LoggerFrom(ctx)
+	previous, err := readManifest(filepath.Join(cfg.StateDir, lastManifestFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("unable to read previous manifest", "error", err)
+		}
+		return
+	}
+
+	threshold := cfg.Manifest.DropThreshold
+	counts := map[string]int64{}
+	for _, db := range previous.Databases {
+		for _, coll := range db.Collections {
+			counts[db.Name+"."+coll.Name] = coll.Documents
+		}
+	}
+
+	for _, db := range current.Databases {
+		for _, coll := range db.Collections {
+			before, ok := counts[db.Name+"."+coll.Name]
+			if !ok || before == 0 || coll.Documents >= before {
+				continue
+			}
+			drop := float64(before-coll.Documents) / float64(before) * 100
+			if drop > threshold {
+				log.Warn("collection document count dropped",
+					"db", db.Name, "collection", coll.Name, "before", before, "after", coll.Documents,
+					"drop_percent", fmt.Sprintf("%.1f", drop), "previous_backup", previous.CreatedAt.Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+// ReadManifest returns the manifest BackUp wrote to cfg.OutputDir, until
+// the folder is cleaned.
+func ReadManifest(cfg Config) (Manifest, error) {
+	return readManifest(filepath.Join(cfg.OutputDir, manifestFileName))
+}
+
+// LastUploadedAt returns when the last successfully uploaded backup was
+// created, from the baseline PromoteManifest keeps in cfg.StateDir, so it
+// survives a restart.
+func LastUploadedAt(cfg Config) (time.Time, error) {
+	m, err := readManifest(filepath.Join(cfg.StateDir, lastManifestFileName))
+	return m.CreatedAt, err
+}
+
+// PromoteManifest stores the manifest of a successfully uploaded backup as
+// the baseline for the next comparison, and adds its size to the history
+// the next backups' sizes are compared with. The manifest of an external
+// archive describes no dump and is left out.
+func PromoteManifest(cfg Config) error {
+	m, err := readManifest(filepath.Join(cfg.OutputDir, manifestFileName))
+	if err != nil {
+		return err
+	}
+	if m.ExternalArchive != "" {
+		return nil
+	}
+	if err := writeManifest(cfg, filepath.Join(cfg.StateDir, lastManifestFileName), m); err != nil {
+		return err
+	}
+	return recordBackupSize(cfg, m)
+}
+
+// dirSize returns the total size of the files below dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,40 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"runtime"
+)
+
+// defaultUmask keeps the dump folder and archives, which hold raw database
+// contents, to the user the service runs as: folders 0700, files 0600.
+const defaultUmask os.FileMode = 0o077
+
+// DirMode is the mode the output folder, staging folders and the local
+// archive folder are created with. The process umask still applies on top.
+func (cfg Config) DirMode() os.FileMode {
+	return 0o777 &^ cfg.Umask
+}
+
+// FileMode is the mode archives and the other files written next to the
+// dumps are created with.
+func (cfg Config) FileMode() os.FileMode {
+	return 0o666 &^ cfg.Umask
+}
+
+// warnLoosePermissions logs when dir, which already existed, grants more
+// than cfg.DirMode, as a folder created by hand or by an older version.
+// Windows has no such mode bits to compare.
+func warnLoosePermissions(ctx context.Context, cfg Config, dir string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return
+	}
+	if extra := info.Mode().Perm() &^ cfg.DirMode(); extra != 0 {
+		LoggerFrom(ctx).Warn("folder permissions are looser than BACKUP_UMASK allows",
+			"path", dir, "mode", info.Mode().Perm().String(), "expected", cfg.DirMode().String())
+	}
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type dumpedKey struct{}
+
+// withDumpedHook attaches fn to ctx so that BackUp calls it with the name
+// of every database whose dump succeeded, from the dumping goroutine.
+func withDumpedHook(ctx context.Context, fn func(db string)) context.Context {
+	return context.WithValue(ctx, dumpedKey{}, fn)
+}
+
+// BackUpAndUpload runs BackUp and UploadToS3. With cfg.Upload.Pipeline and
+// cfg.Archive.PerDatabase, every database is archived and uploaded while
+// the next ones are still dumping, up to cfg.Upload.Concurrency at a time;
+// the manifest, the run index and the latest pointer follow once every
+// dump is done. With cfg.Upload.Stream instead, the next dump waits until
+// the database was uploaded and its dump deleted. Dedup does not apply to
+// either, since the content of the run is only known after it was
+// uploaded.
+//
+// A database whose upload fails every attempt does not stop the other
+// dumps; the run is finished without it and a *DatabaseUploadError names
+// it. A run that fails halfway leaves a run folder without an index,
+// which restores ignore and retention removes in time.
+func BackUpAndUpload(ctx context.Context, cfg Config) error {
+	if !cfg.Upload.Pipeline && !cfg.Upload.Stream || !cfg.Archive.PerDatabase {
+		if err := BackUp(ctx, cfg); err != nil {
+			return err
+		}
+		return UploadToS3(ctx, cfg)
+	}
+	log := LoggerFrom(ctx)
+
+	run, err := newDatabaseRun(ctx, cfg, time.Now())
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+	defer run.close(ctx)
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, max(cfg.Upload.Concurrency, 1))
+	dumpCtx := withDumpedHook(ctx, func(db string) {
+		if cfg.Upload.Stream {
+			// The dump goes even when the upload failed; the database is
+			// then left out of the run, as in any per-database run
+			if err := run.uploadDatabase(ctx, db); err == nil {
+				log.Info("database uploaded", "db", db)
+			}
+			removeStreamedDump(ctx, cfg, db)
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+			if err := run.uploadDatabase(ctx, db); err == nil {
+				log.Info("database uploaded", "db", db)
+			}
+		}()
+	})
+
+	dumpErr := BackUp(dumpCtx, cfg)
+	wg.Wait()
+	if dumpErr != nil {
+		return dumpErr
+	}
+
+	key, err := run.finish(ctx, "")
+	if err != nil {
+		return fmt.Errorf("%w: failed to upload backup: %w", ErrUploadFailed, err)
+	}
+	log.Info("backup uploaded", "key", key)
+	reportUploaded(ctx, key)
+	postManifestWebhook(ctx, cfg, key, "", run.size)
+	return nil
+}
+
+// removeStreamedDump deletes the dump folder of db in a streamed run. The
+// database's loose files, such as its mongodump log, stay for the end of
+// the run.
+func removeStreamedDump(ctx context.Context, cfg Config, db string) {
+	path := filepath.Join(cfg.OutputDir, db)
+	if err := removeWithRetry(ctx, path, cfg.CleanupAttempts); err != nil {
+		LoggerFrom(ctx).Warn("failed to remove streamed dump", "db", db, "path", path, "error", err)
+	}
+}
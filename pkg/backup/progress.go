@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Progress describes how far BackUp got. It is passed to the ProgressFunc
+// attached with WithProgress after every change.
+type Progress struct {
+	Total     int                `json:"total"`
+	Dumped    int                `json:"dumped"`
+	Failed    int                `json:"failed"`
+	Unchanged int                `json:"unchanged,omitempty"`
+	Current   string             `json:"current,omitempty"`
+	Summary   string             `json:"summary"`
+	Databases []DatabaseProgress `json:"databases"`
+}
+
+// DatabaseProgress is the state of one selected database: pending,
+// dumping, dumped, failed or unchanged.
+type DatabaseProgress struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration_seconds,omitempty"`
+
+	started time.Time
+}
+
+// ProgressFunc receives a copy of the progress; it may keep it.
+type ProgressFunc func(Progress)
+
+type progressKey struct{}
+
+// WithProgress attaches fn to ctx so that BackUp reports its progress.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// progressTracker keeps the progress of one BackUp call. Concurrent dumps
+// report through it in turn, so fn is never called concurrently.
+type progressTracker struct {
+	mu sync.Mutex
+	fn ProgressFunc
+	p  Progress
+}
+
+func newProgressTracker(ctx context.Context, databases []string) *progressTracker {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	t := &progressTracker{fn: fn, p: Progress{Total: len(databases)}}
+	for _, name := range databases {
+		t.p.Databases = append(t.p.Databases, DatabaseProgress{Name: name, Status: "pending"})
+	}
+	t.report()
+	return t
+}
+
+func (t *progressTracker) set(name, status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.p.Databases {
+		db := &t.p.Databases[i]
+		if db.Name != name {
+			continue
+		}
+		db.Status = status
+		switch status {
+		case "dumping":
+			db.started = time.Now()
+			t.p.Current = name
+		case "dumped", "failed":
+			db.Duration = time.Since(db.started).Round(time.Millisecond).Seconds()
+			if t.p.Current == name {
+				t.p.Current = ""
+			}
+		}
+	}
+	switch status {
+	case "dumped":
+		t.p.Dumped++
+	case "failed":
+		t.p.Failed++
+	case "unchanged":
+		t.p.Unchanged++
+	}
+	t.report()
+}
+
+func (t *progressTracker) report() {
+	done := t.p.Dumped + t.p.Failed + t.p.Unchanged
+	t.p.Summary = fmt.Sprintf("%d/%d databases done", done, t.p.Total)
+	if t.p.Current != "" {
+		t.p.Summary += ", currently dumping " + t.p.Current
+	}
+	if t.fn == nil {
+		return
+	}
+	p := t.p
+	p.Databases = append([]DatabaseProgress(nil), t.p.Databases...)
+	t.fn(p)
+}
@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultRegistryField is the field of a registry document holding the
+// database name when DatabaseRegistryField is unset.
+const defaultRegistryField = "database"
+
+// listDatabases returns the names of the databases to consider for a
+// backup. Without cfg.DatabaseRegistry that is every database of the
+// cluster. With it, the names are the distinct values of the registry
+// field, limited to databases that exist on the cluster; registered ones
+// that do not are logged and left out.
+func listDatabases(ctx context.Context, cfg Config, client *mongo.Client) ([]string, error) {
+	if cfg.DatabaseRegistry == "" {
+		return client.ListDatabaseNames(ctx, bson.D{})
+	}
+	log := LoggerFrom(ctx)
+	dbName, collName, _ := strings.Cut(cfg.DatabaseRegistry, ".")
+	field := cfg.DatabaseRegistryField
+	if field == "" {
+		field = defaultRegistryField
+	}
+
+	values, err := client.Database(dbName).Collection(collName).Distinct(ctx, field, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database registry %s: %w", cfg.DatabaseRegistry, err)
+	}
+	var registered []string
+	for _, v := range values {
+		name, ok := v.(string)
+		if !ok || name == "" {
+			log.Warn("ignoring database registry entry, not a database name", "registry", cfg.DatabaseRegistry, "field", field, "value", v)
+			continue
+		}
+		registered = append(registered, name)
+	}
+	if len(registered) == 0 {
+		return nil, fmt.Errorf("database registry %s lists no databases in field %q", cfg.DatabaseRegistry, field)
+	}
+
+	existing, err := client.ListDatabaseNames(ctx, bson.D{{Key: "name", Value: bson.D{{Key: "$in", Value: registered}}}})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range registered {
+		if !slices.Contains(existing, name) {
+			log.Warn("skipping database, registered but not found on the cluster", "db", name, "registry", cfg.DatabaseRegistry)
+		}
+	}
+	log.Info("databases read from the registry", "registry", cfg.DatabaseRegistry, "registered", len(registered), "found", len(existing))
+	return existing, nil
+}
@@ -0,0 +1,404 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RestoreFromS3 downloads the archive key from the first configured
+// destination and restores it with mongorestore. An empty key restores the
+// archive named by the latest pointer. When databases is empty, every
+// database in the archive is restored. For a per-database run, key is its
+// index.json (or folder), and only the archives of the requested databases
+// are downloaded.
+//
+// Databases are restored by a pool of cfg.Restore.Concurrency workers, each
+// running one mongorestore with --numParallelCollections. Every worker uses
+// the same flags, so --drop applies to all databases or none. All failures
+// are collected and returned together.
+//
+// The archive is restored into cfg.Restore.Target, or the backup source
+// when no target is set. Restoring into the cluster the archive was taken
+// from is refused unless cfg.Restore.Confirm names that cluster.
+func RestoreFromS3(ctx context.Context, cfg Config, key string, databases []string) error {
+	if len(destinations) == 0 {
+		return fmt.Errorf("%w: no storage destination configured", ErrRestoreFailed)
+	}
+	src := destinations[0]
+
+	if key == "" {
+		pointer, err := readLatestPointer(ctx, src, cfg.clusterKey(cfg.Upload.LatestPointer))
+		if err != nil {
+			return fmt.Errorf("%w: no key given and the latest pointer is unavailable: %w", ErrRestoreFailed, err)
+		}
+		key = pointer.Key
+	}
+	if strings.HasSuffix(key, "/") {
+		key += runIndexFileName
+	}
+
+	return restore(ctx, cfg, key, databases, func(target, scratch, dumpDir string) ([]string, error) {
+		if isRunIndexKey(key) {
+			return fetchIndexedRun(ctx, cfg, src, key, target, scratch, dumpDir, databases)
+		}
+		return databases, fetchArchive(ctx, cfg, src, key, target, scratch, dumpDir)
+	})
+}
+
+// restore checks the target, lets fetch fill dumpDir inside a scratch
+// directory that is removed afterwards, and restores the databases fetch
+// returns (all dumped ones when empty). source only names the archive in
+// logs.
+func restore(ctx context.Context, cfg Config, source string, databases []string, fetch func(target, scratch, dumpDir string) ([]string, error)) error {
+	log := LoggerFrom(ctx)
+
+	target := cfg.restoreTarget()
+	if err := confirmRestoreTarget(cfg, target.ClusterURI, cfg.Mongo.ClusterURI); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(cfg.Restore.Dir, cfg.DirMode()); err != nil {
+		return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+	scratch, err := os.MkdirTemp(cfg.Restore.Dir, "restore-")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+	defer os.RemoveAll(scratch)
+
+	dumpDir := filepath.Join(scratch, "dump")
+	if databases, err = fetch(target.ClusterURI, scratch, dumpDir); err != nil {
+		return err
+	}
+	// Collections dumped in parts are whole again before mongorestore
+	if err := joinSplitCollections(dumpDir); err != nil {
+		return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+
+	dbs, err := dumpedDatabases(dumpDir, databases)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+	if cfg.Restore.Collection != "" {
+		if err := checkDumpedCollection(dumpDir, dbs, cfg.Restore.Collection); err != nil {
+			return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+		}
+		log.Info("restoring a single collection", "namespace", dbs[0]+"."+cfg.Restore.Collection, "to", cfg.Restore.RenameTo)
+	}
+	log.Info("restoring databases", "key", source, "target", target.ClusterURI, "databases", dbs,
+		"concurrency", cfg.Restore.Concurrency, "drop", cfg.Restore.Drop)
+
+	errs := restoreDatabases(ctx, cfg, target, dumpDir, dbs)
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%w: %d of %d databases failed: %w", ErrRestoreFailed, len(errs), len(dbs), err)
+	}
+	if cfg.Restore.Collection == "" {
+		if err := confirmRestoredViews(ctx, target, dumpDir, dbs); err != nil {
+			return fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+		}
+	}
+	log.Info("restore completed", "key", source, "databases", len(dbs))
+	return nil
+}
+
+// fetchArchive downloads the single archive key and extracts it into
+// dumpDir.
+func fetchArchive(ctx context.Context, cfg Config, src Storage, key, target, scratch, dumpDir string) error {
+	log := LoggerFrom(ctx)
+
+	archivePath := filepath.Join(scratch, path.Base(key))
+	log.Info("downloading archive", "key", key, "source", src.Name())
+	if err := downloadTo(ctx, cfg, src, key, archivePath); err != nil {
+		return fmt.Errorf("%w: failed to download %s: %w", ErrRestoreFailed, key, err)
+	}
+	return unpackArchive(ctx, cfg, archivePath, target, dumpDir)
+}
+
+// unpackArchive decrypts the archive at archivePath if it is encrypted,
+// logs its metadata, checks that it may be restored into target and
+// extracts it into dumpDir.
+func unpackArchive(ctx context.Context, cfg Config, archivePath, target, dumpDir string) error {
+	log := LoggerFrom(ctx)
+	key := filepath.Base(archivePath)
+
+	if _, err := unsealArchive(ctx, cfg.Encryption, archivePath); err != nil {
+		return fmt.Errorf("%w: failed to decrypt %s: %w", ErrRestoreFailed, key, err)
+	}
+	if info, ok, err := ReadArchiveInfo(archivePath); err != nil {
+		log.Warn("unable to read archive metadata", "key", key, "error", err)
+	} else if ok {
+		log.Info("archive metadata", "key", key, "cluster", info.Cluster, "created_at", info.CreatedAt,
+			"databases", info.Databases, "tool_version", info.ToolVersion)
+		// The archive may come from another cluster than the one configured
+		// today, e.g. the production bucket read from a staging deployment
+		if err := confirmRestoreTarget(cfg, target, info.Cluster); err != nil {
+			return err
+		}
+	}
+
+	if err := extractArchive(archivePath, dumpDir, nil, cfg.DirMode(), cfg.FileMode()); err != nil {
+		return fmt.Errorf("%w: failed to extract %s: %w", ErrRestoreFailed, key, err)
+	}
+	os.Remove(archivePath)
+
+	// The manifest at the root of the archive names the mongodump version
+	var dumpVersion string
+	if m, err := readManifest(filepath.Join(dumpDir, manifestFileName)); err == nil {
+		dumpVersion = m.DumpVersion
+	}
+	return checkRestoreTools(ctx, cfg, dumpVersion)
+}
+
+// fetchIndexedRun reads the index of a per-database run and downloads and
+// extracts only the archives of the wanted databases, or all of them. It
+// returns the databases to restore.
+func fetchIndexedRun(ctx context.Context, cfg Config, src Storage, key, target, scratch, dumpDir string, wanted []string) ([]string, error) {
+	log := LoggerFrom(ctx)
+
+	index, err := readRunIndex(ctx, src, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read run index %s: %w", ErrRestoreFailed, key, err)
+	}
+	log.Info("run index", "key", key, "cluster", index.Cluster, "created_at", index.CreatedAt,
+		"databases", len(index.Databases), "tool_version", index.ToolVersion, "mongodump_version", index.DumpVersion)
+	if err := confirmRestoreTarget(cfg, target, index.Cluster); err != nil {
+		return nil, err
+	}
+	if err := checkRestoreTools(ctx, cfg, index.DumpVersion); err != nil {
+		return nil, err
+	}
+
+	byName := map[string]RunIndexDatabase{}
+	var all []string
+	for _, db := range index.Databases {
+		byName[db.Name] = db
+		all = append(all, db.Name)
+	}
+	if len(wanted) == 0 {
+		wanted = all
+	}
+	for _, name := range wanted {
+		if _, ok := byName[name]; !ok {
+			return nil, fmt.Errorf("%w: database %q is not in run %s", ErrRestoreFailed, name, key)
+		}
+	}
+
+	// The run's manifest sits next to its index rather than in the archives
+	manifestKey := path.Dir(key) + "/" + manifestFileName
+	if err := os.MkdirAll(dumpDir, cfg.DirMode()); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+	}
+	if err := downloadTo(ctx, cfg, src, manifestKey, filepath.Join(dumpDir, manifestFileName)); err != nil {
+		log.Warn("unable to download the run's manifest", "key", manifestKey, "error", err)
+	}
+
+	var dict []byte
+	if index.Dictionary != "" {
+		log.Info("downloading zstd dictionary", "key", index.Dictionary, "source", src.Name())
+		if dict, err = fetchDictionary(ctx, cfg, src, index.Dictionary, scratch); err != nil {
+			return nil, fmt.Errorf("%w: failed to download %s: %w", ErrRestoreFailed, index.Dictionary, err)
+		}
+	}
+	for _, name := range wanted {
+		db := byName[name]
+		archivePath := filepath.Join(scratch, path.Base(db.Key))
+		log.Info("downloading archive", "key", db.Key, "source", src.Name(), "size", db.Size)
+		if err := downloadTo(ctx, cfg, src, db.Key, archivePath); err != nil {
+			return nil, fmt.Errorf("%w: failed to download %s: %w", ErrRestoreFailed, db.Key, err)
+		}
+		if _, err := unsealArchive(ctx, cfg.Encryption, archivePath); err != nil {
+			return nil, fmt.Errorf("%w: failed to decrypt %s: %w", ErrRestoreFailed, db.Key, err)
+		}
+		// Each archive holds <db>/*.bson, mongodump's layout below dir/db
+		if err := extractArchive(archivePath, filepath.Join(dumpDir, name), dict, cfg.DirMode(), cfg.FileMode()); err != nil {
+			return nil, fmt.Errorf("%w: failed to extract %s: %w", ErrRestoreFailed, db.Key, err)
+		}
+		os.Remove(archivePath)
+	}
+	return wanted, nil
+}
+
+func readRunIndex(ctx context.Context, src Storage, key string) (RunIndex, error) {
+	var index RunIndex
+	body, err := src.Open(ctx, key)
+	if err != nil {
+		return index, err
+	}
+	defer body.Close()
+	err = json.NewDecoder(body).Decode(&index)
+	return index, err
+}
+
+// restoreDatabases runs mongorestore for every database with a bounded
+// number of workers and returns one error per failed database.
+func restoreDatabases(ctx context.Context, cfg Config, target MongoConfig, dumpDir string, dbs []string) []error {
+	log := LoggerFrom(ctx)
+	args := restoreArgs(cfg)
+
+	jobs := make(chan string)
+	var (
+		mu   sync.Mutex
+		errs []error
+		wg   sync.WaitGroup
+	)
+	for range max(cfg.Restore.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for db := range jobs {
+				log.Info("restoring database", "db", db)
+				cmd := exec.CommandContext(ctx, "mongorestore", slices.Concat(args, []string{
+					"--uri", target.uri(""),
+					// mongodump --out dir/db wrote dir/db/db/*.bson
+					"--dir", filepath.Join(dumpDir, db),
+				}, namespaceArgs(cfg, db))...)
+				cmd.Stdout = commandOutput(ctx)
+				cmd.Stderr = os.Stderr
+				if err := cmd.Run(); err != nil {
+					log.Error("failed to restore database", "db", db, "error", err)
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("%s: %w", db, err))
+					mu.Unlock()
+					continue
+				}
+				log.Info("database restored", "db", db)
+			}
+		}()
+	}
+
+	for _, db := range dbs {
+		select {
+		case jobs <- db:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		errs = append(errs, fmt.Errorf("restore cancelled: %w", ctx.Err()))
+	}
+	return errs
+}
+
+// restoreArgs are the flags shared by every mongorestore invocation.
+func restoreArgs(cfg Config) []string {
+	args := []string{"--numParallelCollections", strconv.Itoa(max(cfg.Restore.ParallelCollections, 1))}
+	if cfg.Restore.Drop {
+		args = append(args, "--drop")
+	}
+	return args
+}
+
+// namespaceArgs select what mongorestore restores of db: all of it, or
+// only Restore.Collection, renamed to Restore.RenameTo when it is set.
+func namespaceArgs(cfg Config, db string) []string {
+	if cfg.Restore.Collection == "" {
+		return []string{"--nsInclude", db + ".*"}
+	}
+	// * is the only wildcard of --nsInclude and --nsFrom
+	ns := db + "." + strings.NewReplacer(`\`, `\\`, "*", `\*`).Replace(cfg.Restore.Collection)
+	args := []string{"--nsInclude", ns}
+	if cfg.Restore.RenameTo != "" {
+		args = append(args, "--nsFrom", ns, "--nsTo", cfg.Restore.RenameTo)
+	}
+	return args
+}
+
+// checkDumpedCollection checks that coll was dumped for the one database
+// of dbs, the only one a single collection may be restored from.
+func checkDumpedCollection(dumpDir string, dbs []string, coll string) error {
+	if len(dbs) != 1 {
+		return fmt.Errorf("a single collection is restored from one database, got %d", len(dbs))
+	}
+	file := filepath.Join(dumpDir, dbs[0], dbs[0], coll+".bson")
+	for _, name := range []string{file, file + ".gz"} {
+		if _, err := os.Stat(name); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("collection %q is not in the archive's dump of %s", coll, dbs[0])
+}
+
+// confirmRestoreTarget refuses to restore into source, the cluster the
+// backup was taken from, unless the restore was confirmed for it.
+func confirmRestoreTarget(cfg Config, target, source string) error {
+	if !sameCluster(target, source) || sameCluster(cfg.Restore.Confirm, target) {
+		return nil
+	}
+	return fmt.Errorf("%w: refusing to restore into %s, the cluster the backup was taken from; set a different restore target or confirm with -confirm %s",
+		ErrRestoreFailed, target, target)
+}
+
+// sameCluster compares two cluster hosts, ignoring case, a scheme,
+// credentials and anything after the host.
+func sameCluster(a, b string) bool {
+	host := func(uri string) string {
+		uri = strings.ToLower(strings.TrimSpace(uri))
+		if _, rest, ok := strings.Cut(uri, "://"); ok {
+			uri = rest
+		}
+		if i := strings.LastIndex(uri, "@"); i >= 0 {
+			uri = uri[i+1:]
+		}
+		if i := strings.IndexAny(uri, "/?"); i >= 0 {
+			uri = uri[:i]
+		}
+		return uri
+	}
+	a, b = host(a), host(b)
+	return a != "" && a == b
+}
+
+// dumpedDatabases lists the database folders in an extracted dump, limited
+// to wanted when it is not empty.
+func dumpedDatabases(dumpDir string, wanted []string) ([]string, error) {
+	entries, err := os.ReadDir(dumpDir)
+	if err != nil {
+		return nil, err
+	}
+	present := map[string]bool{}
+	var all []string
+	for _, e := range entries {
+		if e.IsDir() {
+			present[e.Name()] = true
+			all = append(all, e.Name())
+		}
+	}
+	if len(wanted) == 0 {
+		sort.Strings(all)
+		return all, nil
+	}
+
+	for _, db := range wanted {
+		if !present[db] {
+			return nil, fmt.Errorf("database %q is not in the archive", db)
+		}
+	}
+	return wanted, nil
+}
+
+func readLatestPointer(ctx context.Context, src Storage, key string) (LatestPointer, error) {
+	var pointer LatestPointer
+	if key == "" {
+		return pointer, errors.New("LATEST_POINTER_KEY is disabled")
+	}
+	body, err := src.Open(ctx, key)
+	if err != nil {
+		return pointer, err
+	}
+	defer body.Close()
+	err = json.NewDecoder(body).Decode(&pointer)
+	return pointer, err
+}
@@ -0,0 +1,276 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Defaults for RestoreCheckConfig.
+const (
+	defaultRestoreCheckDocker  = "docker"
+	defaultRestoreCheckImage   = "mongo:7.0"
+	defaultRestoreCheckTimeout = 5 * time.Minute
+)
+
+// ErrEphemeralMongo is returned by VerifyRestore when the throwaway mongod
+// could not be started, so nothing was learned about the backup.
+var ErrEphemeralMongo = errors.New("ephemeral mongod unavailable")
+
+type uploadedKey struct{}
+
+// WithUploaded attaches fn to ctx so that UploadToS3 and BackUpAndUpload
+// call it with the key of the backup they uploaded: the archive, or the
+// index.json of a per-database run. A run skipped by dedup uploads nothing.
+func WithUploaded(ctx context.Context, fn func(key string)) context.Context {
+	return context.WithValue(ctx, uploadedKey{}, fn)
+}
+
+func reportUploaded(ctx context.Context, key string) {
+	if fn, ok := ctx.Value(uploadedKey{}).(func(string)); ok {
+		fn(key)
+	}
+}
+
+// RestoreCheck is the outcome of VerifyRestore.
+type RestoreCheck struct {
+	Key    string `json:"key"`
+	Passed bool   `json:"passed"`
+	// Databases is the number of databases restored.
+	Databases   int                  `json:"databases"`
+	Collections []RestoredCollection `json:"collections"`
+	// Missing lists the db.collection namespaces of the manifest that are
+	// not on the server after the restore, and MissingViews its views that
+	// were not recreated.
+	Missing      []string `json:"missing,omitempty"`
+	MissingViews []string `json:"missing_views,omitempty"`
+	// CountMismatches is the number of collections whose restored count
+	// differs from the manifest's.
+	CountMismatches int     `json:"count_mismatches"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// RestoredCollection compares the documents of one collection in the
+// manifest with those restored.
+type RestoredCollection struct {
+	Namespace string `json:"namespace"`
+	Expected  int64  `json:"expected"`
+	Restored  int64  `json:"restored"`
+}
+
+// VerifyRestore restores the backup key from the first destination into a
+// mongod started for the purpose with cfg.RestoreCheck.Docker, counts the
+// documents of every collection and removes the server again. The check
+// passes when every database restored and every collection of the manifest
+// is there. Counts that differ from the manifest's, which are taken just
+// before each database is dumped, are reported but do not fail it.
+//
+// The error wraps ErrEphemeralMongo when the server could not be started,
+// and ErrVerifyFailed when the backup did not restore.
+func VerifyRestore(ctx context.Context, cfg Config, key string) (check RestoreCheck, err error) {
+	log := LoggerFrom(ctx)
+	started := time.Now()
+	check = RestoreCheck{Key: key, Collections: []RestoredCollection{}}
+	defer func() {
+		check.DurationSeconds = time.Since(started).Round(time.Millisecond).Seconds()
+		if err != nil {
+			check.Error = err.Error()
+		}
+	}()
+	if len(destinations) == 0 {
+		return check, fmt.Errorf("%w: no storage destination configured", ErrVerifyFailed)
+	}
+	src := destinations[0]
+	if strings.HasSuffix(key, "/") {
+		key += runIndexFileName
+	}
+
+	uri, stop, err := startEphemeralMongo(ctx, cfg.RestoreCheck)
+	if err != nil {
+		return check, fmt.Errorf("%w: %w", ErrEphemeralMongo, err)
+	}
+	defer stop()
+	log.Info("ephemeral mongod started", "uri", uri, "image", cmp.Or(cfg.RestoreCheck.Image, defaultRestoreCheckImage))
+
+	// The restore errors wrap ErrRestoreFailed; only the verify stage is
+	// kept, so that the run fails with the verification exit code
+	failed := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrVerifyFailed, fmt.Sprintf(format, args...))
+	}
+	if err := os.MkdirAll(cfg.Restore.Dir, cfg.DirMode()); err != nil {
+		return check, failed("%v", err)
+	}
+	scratch, err := os.MkdirTemp(cfg.Restore.Dir, "restore-check-")
+	if err != nil {
+		return check, failed("%v", err)
+	}
+	defer os.RemoveAll(scratch)
+	dumpDir := filepath.Join(scratch, "dump")
+
+	var wanted []string
+	if isRunIndexKey(key) {
+		wanted, err = fetchIndexedRun(ctx, cfg, src, key, uri, scratch, dumpDir, nil)
+	} else {
+		err = fetchArchive(ctx, cfg, src, key, uri, scratch, dumpDir)
+	}
+	if err != nil {
+		return check, failed("%v", err)
+	}
+	if err := joinSplitCollections(dumpDir); err != nil {
+		return check, failed("%v", err)
+	}
+	dbs, err := dumpedDatabases(dumpDir, wanted)
+	if err != nil {
+		return check, failed("%v", err)
+	}
+	m, err := readManifest(filepath.Join(dumpDir, manifestFileName))
+	if err != nil {
+		if m, err = LoadBackupManifest(ctx, cfg, key); err != nil {
+			return check, failed("failed to read the manifest: %v", err)
+		}
+	}
+
+	// A clean server: nothing to drop, and the whole backup is restored
+	restoreCfg := cfg
+	restoreCfg.Restore.Drop, restoreCfg.Restore.Collection, restoreCfg.Restore.RenameTo = false, "", ""
+	check.Databases = len(dbs)
+	if errs := restoreDatabases(ctx, restoreCfg, MongoConfig{ClusterURI: uri}, dumpDir, dbs); len(errs) > 0 {
+		return check, failed("%d of %d databases failed to restore: %v", len(errs), len(dbs), errors.Join(errs...))
+	}
+
+	if err := countRestored(ctx, uri, m, dbs, &check); err != nil {
+		return check, failed("failed to count the restored documents: %v", err)
+	}
+	for _, c := range check.Collections {
+		if c.Restored != c.Expected {
+			log.Warn("restored document count differs from the manifest", "namespace", c.Namespace, "expected", c.Expected, "restored", c.Restored)
+		}
+	}
+	if len(check.Missing) > 0 {
+		return check, failed("%d collections missing after the restore: %s", len(check.Missing), strings.Join(check.Missing, ", "))
+	}
+	if len(check.MissingViews) > 0 {
+		return check, failed("%d views missing after the restore: %s", len(check.MissingViews), strings.Join(check.MissingViews, ", "))
+	}
+	check.Passed = true
+	log.Info("restore check passed", "key", key, "databases", check.Databases, "collections", len(check.Collections),
+		"count_mismatches", check.CountMismatches)
+	return check, nil
+}
+
+// countRestored counts the documents of every manifest collection of dbs
+// on the server at uri into check, and lists the manifest's views that
+// are not there.
+func countRestored(ctx context.Context, uri string, m Manifest, dbs []string, check *RestoreCheck) error {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+
+	for _, db := range m.Databases {
+		if !slices.Contains(dbs, db.Name) || db.Unchanged {
+			continue
+		}
+		names, err := client.Database(db.Name).ListCollectionNames(ctx, bson.D{})
+		if err != nil {
+			return err
+		}
+		for _, coll := range db.Collections {
+			ns := db.Name + "." + coll.Name
+			if !slices.Contains(names, coll.Name) {
+				check.Missing = append(check.Missing, ns)
+				continue
+			}
+			n, err := client.Database(db.Name).Collection(coll.Name).CountDocuments(ctx, bson.D{})
+			if err != nil {
+				return err
+			}
+			check.Collections = append(check.Collections, RestoredCollection{Namespace: ns, Expected: coll.Documents, Restored: n})
+			if n != coll.Documents {
+				check.CountMismatches++
+			}
+		}
+	}
+	check.MissingViews, err = missingViews(ctx, client, m, dbs)
+	return err
+}
+
+// startEphemeralMongo runs cfg.Image with cfg.Docker, publishing mongod on
+// a free local port, and waits until it answers. stop removes the
+// container.
+func startEphemeralMongo(ctx context.Context, cfg RestoreCheckConfig) (uri string, stop func(), err error) {
+	docker := cmp.Or(cfg.Docker, defaultRestoreCheckDocker)
+	startCtx, cancel := context.WithTimeout(ctx, cmp.Or(cfg.StartTimeout, defaultRestoreCheckTimeout))
+	defer cancel()
+
+	// The image is pulled first when it is not there, within the timeout
+	id, err := dockerOutput(startCtx, docker, "run", "--detach", "--rm", "--publish", "127.0.0.1::27017",
+		"--label", "mongodb-backup.restore-check=true", cmp.Or(cfg.Image, defaultRestoreCheckImage))
+	if err != nil {
+		return "", nil, err
+	}
+	stop = func() {
+		// Removed even when the run was cancelled
+		rmCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		if _, err := dockerOutput(rmCtx, docker, "rm", "--force", id); err != nil {
+			LoggerFrom(ctx).Warn("failed to remove the ephemeral mongod", "container", id, "error", err)
+		}
+	}
+
+	ports, err := dockerOutput(startCtx, docker, "port", id, "27017/tcp")
+	if err != nil {
+		stop()
+		return "", nil, err
+	}
+	addr, _, _ := strings.Cut(ports, "\n")
+	uri = "mongodb://" + strings.TrimSpace(addr) + "/?directConnection=true"
+
+	client, err := mongo.Connect(startCtx, options.Client().ApplyURI(uri))
+	if err != nil {
+		stop()
+		return "", nil, err
+	}
+	defer client.Disconnect(context.Background())
+	for {
+		pingCtx, cancelPing := context.WithTimeout(startCtx, 2*time.Second)
+		err = client.Ping(pingCtx, nil)
+		cancelPing()
+		if err == nil {
+			return uri, stop, nil
+		}
+		select {
+		case <-startCtx.Done():
+			stop()
+			return "", nil, fmt.Errorf("mongod did not answer in time: %w", err)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// dockerOutput runs docker with args and returns its trimmed output, or an
+// error carrying what it wrote to stderr.
+func dockerOutput(ctx context.Context, docker string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, docker, args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%s %s: %w: %s", docker, args[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("%s %s: %w", docker, args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
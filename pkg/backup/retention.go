@@ -0,0 +1,244 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deleteBatchSize is the most keys S3 accepts in one DeleteObjects call.
+const deleteBatchSize = 1000
+
+// ApplyRetention deletes backup archives older than cfg.Retention.MaxAge
+// from every destination. Labeled backups, the archive named by the latest
+// pointer and the latest copy are never deleted. A MaxAge of 0 keeps
+// everything.
+//
+// The folder of a per-database run is deleted as a whole once its newest
+// object expired, and its index is deleted last. An interrupted sweep
+// therefore leaves the index behind and the next sweep finishes the
+// folder.
+//
+// Each destination is listed page by page while up to
+// cfg.Retention.Concurrency batches of deleteBatchSize keys are deleted in
+// parallel, so a sweep over a huge bucket neither holds all keys in memory
+// nor sends one request per object. Keys a batch failed to delete are sent
+// again up to cfg.Retention.DeleteAttempts times. Nothing is remembered
+// between sweeps: every sweep works from a fresh listing, so whatever an
+// interrupted or failed sweep left behind is deleted by the next one.
+func ApplyRetention(ctx context.Context, cfg Config) error {
+	if cfg.Retention.MaxAge <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-cfg.Retention.MaxAge)
+
+	var errs []error
+	for _, dest := range destinations {
+		if err := applyRetention(ctx, cfg, dest, cutoff); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dest.Name(), err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%w: retention: %w", ErrCleanup, err)
+	}
+	return nil
+}
+
+func applyRetention(ctx context.Context, cfg Config, dest Storage, cutoff time.Time) error {
+	log := LoggerFrom(ctx)
+
+	keep := map[string]bool{}
+	if cfg.Upload.LatestCopy != "" {
+		keep[cfg.clusterKey(cfg.Upload.LatestCopy)] = true
+	}
+	if pointer, err := readLatestPointer(ctx, dest, cfg.clusterKey(cfg.Upload.LatestPointer)); err == nil {
+		keep[pointer.Key] = true
+		keep[pointer.Key+checksumSidecarSuffix] = true
+		keep[pointer.Key+".manifest.json"] = true
+		// The pointer names the index of a per-database run
+		keep[path.Dir(pointer.Key)+"/"] = true
+	}
+
+	batches := make(chan []string)
+	var (
+		mu      sync.Mutex
+		deleted int
+		failed  int
+		errs    []error
+		wg      sync.WaitGroup
+	)
+	for range max(cfg.Retention.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				n, err := deleteBatch(ctx, cfg, dest, batch)
+				mu.Lock()
+				deleted += n
+				if err != nil {
+					failed += len(batch) - n
+					errs = append(errs, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	send := func(batch []string) error {
+		select {
+		case batches <- batch:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var batch []string
+	queue := func(keys ...string) error {
+		for _, key := range keys {
+			batch = append(batch, key)
+			if len(batch) == deleteBatchSize {
+				if err := send(batch); err != nil {
+					return err
+				}
+				batch = nil
+			}
+		}
+		return nil
+	}
+
+	// The keys of a run folder are listed one after another; collect
+	// them until the folder ends, then decide for the folder as a whole
+	var (
+		folder  string
+		objects []ObjectInfo
+		indexes []string
+	)
+	flushFolder := func() error {
+		defer func() { folder, objects = "", nil }()
+		var keys []string
+		for _, obj := range objects {
+			if !obj.LastModified.Before(cutoff) {
+				return nil
+			}
+			if isRunIndexKey(obj.Key) {
+				indexes = append(indexes, obj.Key)
+			} else {
+				keys = append(keys, obj.Key)
+			}
+		}
+		return queue(keys...)
+	}
+
+	labeled := 0
+	prefix := cfg.clusterKey("")
+	listErr := dest.List(ctx, prefix+archivePrefix, func(obj ObjectInfo) error {
+		if f := runFolder(prefix, obj.Key); f != folder {
+			if err := flushFolder(); err != nil {
+				return err
+			}
+			folder = f
+		}
+		if IsLabeledKey(obj.Key) {
+			if obj.LastModified.Before(cutoff) {
+				labeled++
+			}
+			return nil
+		}
+		if folder != "" {
+			if !keep[folder] {
+				objects = append(objects, obj)
+			}
+			return nil
+		}
+		if !obj.LastModified.Before(cutoff) || keep[obj.Key] {
+			return nil
+		}
+		return queue(obj.Key)
+	})
+	if listErr == nil {
+		listErr = flushFolder()
+	}
+	if listErr == nil && len(batch) > 0 {
+		listErr = send(batch)
+	}
+	close(batches)
+	wg.Wait()
+
+	// Only drop the indexes once every object of their folders is gone
+	if listErr == nil && len(errs) == 0 && len(indexes) > 0 {
+		for chunk := range slices.Chunk(indexes, deleteBatchSize) {
+			n, err := deleteBatch(ctx, cfg, dest, chunk)
+			deleted += n
+			if err != nil {
+				failed += len(chunk) - n
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	log.Info("retention sweep finished", "destination", dest.Name(), "cutoff", cutoff.Format(time.RFC3339),
+		"deleted", deleted, "failed", failed, "labeled_kept", labeled)
+	return errors.Join(append(errs, listErr)...)
+}
+
+// deleteBatch deletes keys from dest and returns how many were deleted.
+// After a partial failure only the keys named by the *DeleteError are sent
+// again, after any other error the whole batch; the wait doubles from one
+// second between attempts. Every key still left after the last attempt is
+// logged.
+func deleteBatch(ctx context.Context, cfg Config, dest Storage, keys []string) (int, error) {
+	log := LoggerFrom(ctx)
+	total := len(keys)
+	attempts := max(cfg.Retention.DeleteAttempts, 1)
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		err := dest.Delete(ctx, keys)
+		if err == nil {
+			return total, nil
+		}
+		var partial *DeleteError
+		if errors.As(err, &partial) {
+			keys = slices.DeleteFunc(keys, func(key string) bool {
+				_, failed := partial.Failed[key]
+				return !failed
+			})
+			if len(keys) == 0 {
+				return total, nil
+			}
+		}
+		if attempt == attempts || ctx.Err() != nil {
+			for _, key := range keys {
+				reason := err.Error()
+				if partial != nil {
+					reason = partial.Failed[key]
+				}
+				log.Warn("retention could not delete object", "destination", dest.Name(), "key", key, "attempts", attempt, "error", reason)
+			}
+			return total - len(keys), err
+		}
+		log.Warn("retention delete failed, retrying", "destination", dest.Name(), "keys", len(keys), "attempt", attempt, "wait", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return total - len(keys), ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// runFolder returns the folder of a per-database run that key belongs to,
+// such as "mongodb-dump-2024-06-01/", or "" for a single-archive key. Keys
+// start with the cluster prefix, which is kept in the result.
+func runFolder(prefix, key string) string {
+	rest := strings.TrimPrefix(key, prefix)
+	if i := strings.Index(rest, "/"); i >= 0 {
+		return prefix + rest[:i+1]
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// shardedReleaseTimeout bounds restarting the balancer and unlocking writes,
+// which must happen even when the run itself was cancelled.
+const shardedReleaseTimeout = 30 * time.Second
+
+// isShardedCluster reports whether client is connected to a mongos router,
+// which identifies itself with msg "isdbgrid" in its hello response.
+func isShardedCluster(ctx context.Context, client *mongo.Client) (bool, error) {
+	var hello struct {
+		Msg string `bson:"msg"`
+	}
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return false, err
+	}
+	return hello.Msg == "isdbgrid", nil
+}
+
+// prepareShardedDump makes a dump through mongos safe: without
+// cfg.Sharded.Enabled it refuses, because per-database mongodump through a
+// router gives no cross-shard consistency and chunk migrations can make
+// documents appear twice or not at all. When enabled it stops the balancer
+// and, with cfg.Sharded.FsyncLock, blocks writes on every shard until the
+// returned release function is called.
+func prepareShardedDump(ctx context.Context, cfg Config, client *mongo.Client) (release func(), err error) {
+	if !cfg.Sharded.Enabled {
+		return nil, fmt.Errorf("%w: connected to a sharded cluster (mongos); dumping it without coordination can produce an inconsistent backup. Set SHARDED_CLUSTER=true to stop the balancer during the dump", ErrDumpFailed)
+	}
+
+	log := LoggerFrom(ctx)
+	admin := client.Database("admin")
+
+	var balancer struct {
+		Mode string `bson:"mode"`
+	}
+	if err := admin.RunCommand(ctx, bson.D{{Key: "balancerStatus", Value: 1}}).Decode(&balancer); err != nil {
+		return nil, fmt.Errorf("%w: failed to read balancer status: %w", ErrDumpFailed, err)
+	}
+	restartBalancer := balancer.Mode != "off"
+	if restartBalancer {
+		if err := admin.RunCommand(ctx, bson.D{{Key: "balancerStop", Value: 1}}).Err(); err != nil {
+			return nil, fmt.Errorf("%w: failed to stop the balancer: %w", ErrDumpFailed, err)
+		}
+		log.Info("balancer stopped for sharded dump")
+	}
+
+	release = func() {
+		releaseCtx, cancel := context.WithTimeout(context.Background(), shardedReleaseTimeout)
+		defer cancel()
+		if cfg.Sharded.FsyncLock {
+			if err := admin.RunCommand(releaseCtx, bson.D{{Key: "fsyncUnlock", Value: 1}}).Err(); err != nil {
+				log.Error("failed to unlock writes, run db.fsyncUnlock() on mongos", "error", err)
+			} else {
+				log.Info("writes unlocked")
+			}
+		}
+		if restartBalancer {
+			if err := admin.RunCommand(releaseCtx, bson.D{{Key: "balancerStart", Value: 1}}).Err(); err != nil {
+				log.Error("failed to restart the balancer, run sh.startBalancer()", "error", err)
+			} else {
+				log.Info("balancer restarted")
+			}
+		}
+	}
+
+	if cfg.Sharded.FsyncLock {
+		// fsync with lock through mongos requires MongoDB 7.1 or later
+		if err := admin.RunCommand(ctx, bson.D{{Key: "fsync", Value: 1}, {Key: "lock", Value: true}}).Err(); err != nil {
+			// Only the balancer needs restoring; never unlock what we did not lock
+			cfg.Sharded.FsyncLock = false
+			release()
+			return nil, fmt.Errorf("%w: failed to lock writes on the cluster: %w", ErrDumpFailed, err)
+		}
+		log.Warn("writes locked on all shards for the duration of the dump")
+	}
+	return release, nil
+}
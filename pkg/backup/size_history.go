@@ -0,0 +1,162 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	sizeHistoryFileName = "size-history.json"
+	// MinSizeHistory is the number of earlier backups needed before a size
+	// is compared with their average.
+	MinSizeHistory = 3
+)
+
+// SizeRecord is the dump size of an uploaded backup, kept in
+// STATE_DIR/size-history.json.
+type SizeRecord struct {
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// SizeAnomaly records a backup whose dump size deviates from the average of
+// the recent backups by more than ManifestConfig.SizeDeviation percent. The
+// backup is still uploaded; the anomaly is recorded in its manifest.
+type SizeAnomaly struct {
+	Size    int64 `json:"size"`
+	Average int64 `json:"average"`
+	// Backups is the number of earlier backups averaged.
+	Backups int `json:"backups"`
+	// DeviationPercent is negative for a smaller backup.
+	DeviationPercent float64 `json:"deviation_percent"`
+	ThresholdPercent float64 `json:"threshold_percent"`
+}
+
+// manifestSize is the dump size of the backup m describes. Databases
+// carried over by BACKUP_CHANGED_ONLY count with their earlier size, so
+// that skipping them does not look like a shrinking backup.
+func manifestSize(m Manifest) int64 {
+	var size int64
+	for _, db := range m.Databases {
+		size += db.Size
+	}
+	return size
+}
+
+// checkBackupSize compares the size of m with the recent backups in
+// cfg.StateDir and returns the anomaly when it deviates by more than
+// cfg.Manifest.SizeDeviation percent, or nil. It needs MinSizeHistory
+// earlier backups.
+func checkBackupSize(ctx context.Context, cfg Config, m Manifest) *SizeAnomaly {
+	if cfg.Manifest.SizeDeviation <= 0 {
+		return nil
+	}
+	log := LoggerFrom(ctx)
+	history, err := readSizeHistory(cfg.StateDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("unable to read backup size history", "error", err)
+		}
+		return nil
+	}
+	if n := cfg.Manifest.SizeHistory; n > 0 && len(history) > n {
+		history = history[len(history)-n:]
+	}
+	if len(history) < MinSizeHistory {
+		return nil
+	}
+
+	var total int64
+	for _, r := range history {
+		total += r.Size
+	}
+	average := total / int64(len(history))
+	if average == 0 {
+		return nil
+	}
+	size := manifestSize(m)
+	deviation := float64(size-average) / float64(average) * 100
+	if math.Abs(deviation) <= cfg.Manifest.SizeDeviation {
+		log.Info("backup size within the usual range", "size", size, "average", average, "backups", len(history))
+		return nil
+	}
+	anomaly := &SizeAnomaly{
+		Size:             size,
+		Average:          average,
+		Backups:          len(history),
+		DeviationPercent: math.Round(deviation*10) / 10,
+		ThresholdPercent: cfg.Manifest.SizeDeviation,
+	}
+	log.Warn("backup size deviates from the recent average, marking the backup suspicious",
+		"size", size, "average", average, "backups", len(history), "deviation_percent", anomaly.DeviationPercent)
+	return anomaly
+}
+
+// SizeAlert is the body POSTed to ManifestConfig.AlertWebhookURL for a
+// suspicious backup.
+type SizeAlert struct {
+	Event      string    `json:"event"`
+	Cluster    string    `json:"cluster,omitempty"`
+	Label      string    `json:"label,omitempty"`
+	AppVersion string    `json:"app_version,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	SizeAnomaly
+}
+
+// postSizeAlert sends anomaly to cfg.Manifest.AlertWebhookURL. Failures are
+// only logged.
+func postSizeAlert(ctx context.Context, cfg Config, m Manifest, anomaly SizeAnomaly) {
+	if cfg.Manifest.AlertWebhookURL == "" {
+		return
+	}
+	log := LoggerFrom(ctx)
+	body, err := json.Marshal(SizeAlert{
+		Event:       "size_anomaly",
+		Cluster:     cfg.ClusterName,
+		Label:       m.Label,
+		AppVersion:  m.AppVersion,
+		CreatedAt:   m.CreatedAt,
+		SizeAnomaly: anomaly,
+	})
+	if err != nil {
+		log.Warn("size alert failed", "error", err)
+		return
+	}
+	if err := sendWebhook(ctx, cfg.Manifest.AlertWebhookURL, body); err != nil {
+		// The URL may carry a token, keep it out of the logs
+		log.Warn("size alert failed", "error", strings.ReplaceAll(err.Error(), cfg.Manifest.AlertWebhookURL, "<webhook url>"))
+		return
+	}
+	log.Info("size alert delivered")
+}
+
+// recordBackupSize appends the size of m, an uploaded backup, to the
+// history in cfg.StateDir, keeping the newest cfg.Manifest.SizeHistory.
+func recordBackupSize(cfg Config, m Manifest) error {
+	// A missing or unreadable history starts over
+	history, _ := readSizeHistory(cfg.StateDir)
+	history = append(history, SizeRecord{CreatedAt: m.CreatedAt, Size: manifestSize(m)})
+	if n := max(cfg.Manifest.SizeHistory, 1); len(history) > n {
+		history = history[len(history)-n:]
+	}
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cfg.StateDir, sizeHistoryFileName), data, cfg.FileMode())
+}
+
+func readSizeHistory(stateDir string) ([]SizeRecord, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, sizeHistoryFileName))
+	if err != nil {
+		return nil, err
+	}
+	var history []SizeRecord
+	err = json.Unmarshal(data, &history)
+	return history, err
+}
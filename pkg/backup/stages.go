@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Stages of a backup run, as named by StageTimeoutError and reported to
+// the StageFunc of WithStageTimings.
+const (
+	StageConnect = "connect"
+	StageDump    = "dump"
+	StageArchive = "archive"
+	StageUpload  = "upload"
+)
+
+// Stages lists the stages in the order a run goes through them.
+var Stages = []string{StageConnect, StageDump, StageArchive, StageUpload}
+
+// StageTimeoutError is the error of a stage that ran past its deadline in
+// StageTimeouts, wrapped in the stage's sentinel error. It matches
+// context.DeadlineExceeded.
+type StageTimeoutError struct {
+	Stage   string
+	Timeout time.Duration
+}
+
+func (e *StageTimeoutError) Error() string {
+	return fmt.Sprintf("%s stage timed out after %s", e.Stage, e.Timeout)
+}
+
+func (e *StageTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// withStageDeadline bounds ctx by timeout, so that the stage's work is
+// cancelled with a *StageTimeoutError as the cause. A timeout of 0 leaves
+// ctx unbounded.
+func withStageDeadline(ctx context.Context, stage string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, &StageTimeoutError{Stage: stage, Timeout: timeout})
+}
+
+// stageError names the stage of ctx in err when the stage ran out of time,
+// since what failed then, such as a killed mongodump or an aborted
+// request, rarely says why.
+func stageError(ctx context.Context, err error) error {
+	var timeout *StageTimeoutError
+	if err == nil || !errors.As(context.Cause(ctx), &timeout) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", timeout, err)
+}
+
+// StageFunc receives how long a stage took. Archives and uploads of
+// per-database runs report every archive, so their durations are summed.
+type StageFunc func(stage string, d time.Duration)
+
+type stageKey struct{}
+
+// WithStageTimings attaches fn to ctx so that BackUp, UploadToS3 and
+// BackUpAndUpload report the duration of every stage to it, whether it
+// succeeded or not. fn may be called concurrently.
+func WithStageTimings(ctx context.Context, fn StageFunc) context.Context {
+	return context.WithValue(ctx, stageKey{}, fn)
+}
+
+// recordStage reports stage, started at started, to the StageFunc of ctx.
+func recordStage(ctx context.Context, stage string, started time.Time) {
+	if fn, ok := ctx.Value(stageKey{}).(StageFunc); ok {
+		fn(stage, time.Since(started))
+	}
+}
@@ -0,0 +1,261 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Storage is a destination that backup archives are uploaded to.
+type Storage interface {
+	Name() string
+	Upload(ctx context.Context, obj Object) error
+	// Stat returns ErrObjectNotFound when key does not exist.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Open returns the content of key, or ErrObjectNotFound.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// List calls fn for every object whose key starts with prefix, in
+	// pages, so that huge buckets are never held in memory at once.
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+	// Delete removes up to deleteBatchSize keys. Keys that do not exist
+	// are not an error. When only some keys could not be deleted, the
+	// error is a *DeleteError naming them.
+	Delete(ctx context.Context, keys []string) error
+}
+
+// ErrObjectNotFound is returned by Storage.Stat when the key does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// DeleteError is returned by Storage.Delete when the other keys of the
+// batch were deleted. Failed maps every key left behind to its error.
+type DeleteError struct {
+	Failed map[string]string
+	Total  int
+}
+
+func (e *DeleteError) Error() string {
+	first := slices.Min(slices.Collect(maps.Keys(e.Failed)))
+	return fmt.Sprintf("%d of %d keys not deleted, first %s: %s", len(e.Failed), e.Total, first, e.Failed[first])
+}
+
+// Object is a single file to be written to a Storage.
+type Object struct {
+	Key                string
+	Body               io.ReadSeeker
+	ContentType        string
+	ContentEncoding    string
+	ContentDisposition string
+	CacheControl       string
+	Metadata           map[string]string
+}
+
+// ObjectInfo describes an object already stored on a Storage.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+var destinations []Storage
+
+// toolVersionMetadata is stored on every uploaded object (x-amz-meta-tool-version on S3).
+const toolVersionMetadata = "tool-version"
+
+// UseStorages replaces the configured destinations, e.g. with a
+// MemoryStorage when exercising the upload flow without S3.
+func UseStorages(dests ...Storage) {
+	destinations = dests
+}
+
+// Storage backends of UploadConfig.Backend.
+const (
+	BackendS3   = "s3"
+	BackendSFTP = "sftp"
+)
+
+// InitializeStorages builds the upload destinations from
+// cfg.Upload.Destinations. When there are none, the single destination of
+// cfg.Upload.Backend is used: the cfg.AWS.Bucket bucket or the cfg.SFTP
+// server. InitializeS3Client must have been called first. It also applies
+// cfg.Upload.BandwidthLimit.
+func InitializeStorages(cfg Config) error {
+	limitUploadBandwidth(cfg.Upload.BandwidthLimit)
+	if len(cfg.Upload.Destinations) == 0 {
+		switch cfg.Upload.Backend {
+		case "", BackendS3:
+			destinations = []Storage{newS3Storage(AWSClient, cfg.AWS.Bucket, cfg)}
+		case BackendSFTP:
+			if cfg.SFTP.Host == "" {
+				return errors.New("the sftp storage backend needs a host")
+			}
+			dest, err := newSFTPStorage(sftpAddr(cfg.SFTP.Host), cfg.SFTP.User, cmp.Or(cfg.SFTP.Path, "."), cfg.SFTP)
+			if err != nil {
+				return err
+			}
+			destinations = []Storage{dest}
+		default:
+			return fmt.Errorf("unsupported storage backend %q (expected %s or %s)", cfg.Upload.Backend, BackendS3, BackendSFTP)
+		}
+		return validateQuorum(cfg.Upload.Quorum)
+	}
+
+	destinations = nil
+	for _, entry := range cfg.Upload.Destinations {
+		dest, err := parseDestination(entry, cfg)
+		if err != nil {
+			return err
+		}
+		destinations = append(destinations, dest)
+	}
+	return validateQuorum(cfg.Upload.Quorum)
+}
+
+func parseDestination(raw string, cfg Config) (Storage, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage destination %q: %w", raw, err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("storage destination %q is missing a bucket name", raw)
+		}
+		client := AWSClient
+		if region := u.Query().Get("region"); region != "" {
+			client = s3.New(AWSClient.Options(), func(o *s3.Options) {
+				o.Region = region
+			})
+		}
+		return newS3Storage(client, u.Host, cfg), nil
+	case "file":
+		path := u.Host + u.Path
+		if path == "" {
+			return nil, fmt.Errorf("storage destination %q is missing a path", raw)
+		}
+		return &localStorage{dir: path, dirMode: cfg.DirMode(), fileMode: cfg.FileMode()}, nil
+	case "sftp":
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("storage destination %q is missing a host", raw)
+		}
+		// The path is absolute, or below the login directory after /~
+		dir, ok := strings.CutPrefix(u.Path, "/~")
+		switch {
+		case ok && (dir == "" || dir[0] == '/'):
+			dir = "." + dir
+		case u.Path == "":
+			return nil, fmt.Errorf("storage destination %q is missing a path", raw)
+		default:
+			dir = u.Path
+		}
+		user := cmp.Or(u.User.Username(), cfg.SFTP.User)
+		return newSFTPStorage(sftpAddr(u.Host), user, dir, cfg.SFTP)
+	default:
+		return nil, fmt.Errorf("unsupported storage destination %q (expected s3://, file:// or sftp://)", raw)
+	}
+}
+
+// sftpAddr adds the SSH port to host unless it names one.
+func sftpAddr(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "22")
+}
+
+// uploadQuorum is the number of destinations that must succeed for an upload
+// to count as successful. A quorum of 0 (the default) requires all of them.
+func uploadQuorum(quorum int) int {
+	if quorum <= 0 || quorum > len(destinations) {
+		return len(destinations)
+	}
+	return quorum
+}
+
+func validateQuorum(quorum int) error {
+	if quorum > len(destinations) {
+		return fmt.Errorf("upload quorum %d exceeds the %d configured destinations", quorum, len(destinations))
+	}
+	return nil
+}
+
+// uploadFile writes the file at path to every destination in parallel and
+// reports the outcome per destination. obj describes the object; its Body is
+// opened separately for each destination. It returns the destinations that
+// succeeded.
+func uploadFile(ctx context.Context, quorum int, path string, obj Object) ([]Storage, error) {
+	metadata := make(map[string]string, len(obj.Metadata)+1)
+	maps.Copy(metadata, obj.Metadata)
+	metadata[toolVersionMetadata] = Version
+	obj.Metadata = metadata
+
+	results := make([]error, len(destinations))
+	var wg sync.WaitGroup
+	for i, dest := range destinations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = uploadFileTo(ctx, dest, path, obj)
+		}()
+	}
+	wg.Wait()
+
+	log := LoggerFrom(ctx)
+	var succeeded []Storage
+	var failures []string
+	for i, err := range results {
+		if err != nil {
+			log.Error("upload failed", "key", obj.Key, "destination", destinations[i].Name(), "error", err)
+			failures = append(failures, fmt.Sprintf("%s: %v", destinations[i].Name(), err))
+			continue
+		}
+		succeeded = append(succeeded, destinations[i])
+		log.Info("uploaded", "key", obj.Key, "destination", destinations[i].Name())
+	}
+
+	if quorum := uploadQuorum(quorum); len(succeeded) < quorum {
+		return succeeded, fmt.Errorf("%d of %d destinations succeeded, %d required (%s)",
+			len(succeeded), len(destinations), quorum, strings.Join(failures, "; "))
+	}
+	return succeeded, nil
+}
+
+func uploadFileTo(ctx context.Context, dest Storage, path string, obj Object) (err error) {
+	ctx, span := tracer.Start(ctx, "backup.upload_destination", trace.WithAttributes(
+		attribute.String("backup.destination", dest.Name()), attribute.String("backup.key", obj.Key)))
+	defer func() { endSpan(span, err) }()
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil {
+		span.SetAttributes(attribute.Int64("backup.bytes", info.Size()))
+	}
+
+	obj.Body = throttleUpload(ctx, file)
+	return dest.Upload(ctx, obj)
+}
+
+// downloadHeaders returns the Content-Disposition and Cache-Control values
+// for an archive, replacing {filename} with the object's file name.
+func downloadHeaders(cfg UploadConfig, key string) (disposition, cacheControl string) {
+	disposition = strings.ReplaceAll(cfg.ContentDisposition, "{filename}", path.Base(key))
+	return disposition, cfg.CacheControl
+}
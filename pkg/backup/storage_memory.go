@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps uploaded objects in memory. It is meant for tests and
+// dry runs of code built on this package; nothing survives the process.
+type MemoryStorage struct {
+	mu       sync.Mutex
+	objects  map[string]memoryObject
+	failures []error
+	attempts int
+}
+
+type memoryObject struct {
+	obj  Object
+	data []byte
+	at   time.Time
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{objects: make(map[string]memoryObject)}
+}
+
+func (m *MemoryStorage) Name() string {
+	return "memory"
+}
+
+// FailNext makes the next len(errs) uploads return errs in order, to
+// simulate a flaky destination.
+func (m *MemoryStorage) FailNext(errs ...error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures = append(m.failures, errs...)
+}
+
+func (m *MemoryStorage) Upload(ctx context.Context, obj Object) error {
+	m.mu.Lock()
+	m.attempts++
+	if len(m.failures) > 0 {
+		err := m.failures[0]
+		m.failures = m.failures[1:]
+		m.mu.Unlock()
+		return err
+	}
+	m.mu.Unlock()
+
+	var data []byte
+	if obj.Body != nil {
+		var err error
+		if data, err = io.ReadAll(obj.Body); err != nil {
+			return err
+		}
+	}
+	obj.Body = nil
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[obj.Key] = memoryObject{obj: obj, data: data, at: time.Now()}
+	return nil
+}
+
+func (m *MemoryStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, ok := m.objects[key]
+	if !ok {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	return ObjectInfo{Key: key, Size: int64(len(o.data)), LastModified: o.at, Metadata: o.obj.Metadata}, nil
+}
+
+func (m *MemoryStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, ok := m.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (m *MemoryStorage) OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, ok := m.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	data := o.data[min(offset, int64(len(o.data))):]
+	if length >= 0 {
+		data = data[:min(length, int64(len(data)))]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *MemoryStorage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	for _, key := range m.Keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		info, err := m.Stat(ctx, key)
+		if err != nil {
+			continue
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) Delete(ctx context.Context, keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.objects, key)
+	}
+	return nil
+}
+
+// Keys returns the stored keys in sorted order.
+func (m *MemoryStorage) Keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.objects))
+	for k := range m.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Data returns the stored bytes of key, or nil if it was never uploaded.
+func (m *MemoryStorage) Data(key string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.objects[key].data
+}
+
+// Attempts returns how many uploads were tried, including failed ones.
+func (m *MemoryStorage) Attempts() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.attempts
+}
@@ -0,0 +1,406 @@
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// AWSClient is the S3 client for the default bucket, set by InitializeS3Client.
+var AWSClient *s3.Client
+
+type s3Storage struct {
+	client  *s3.Client
+	bucket  string
+	timeout time.Duration
+	acl     types.ObjectCannedACL
+	// contentMD5 sends Content-MD5 with every object and part
+	contentMD5 bool
+
+	// Archives larger than partSize go through a resumable multipart upload
+	partSize   int64
+	bufferSize int
+	attempts   int
+	retry      Backoff
+	stateDir   string
+	dirMode    os.FileMode
+	fileMode   os.FileMode
+}
+
+func newS3Storage(client *s3.Client, bucket string, cfg Config) *s3Storage {
+	return &s3Storage{
+		client:     client,
+		bucket:     bucket,
+		timeout:    cfg.AWS.Timeout,
+		acl:        types.ObjectCannedACL(cfg.AWS.ObjectACL),
+		contentMD5: cfg.AWS.ContentMD5,
+		partSize:   cfg.AWS.PartSize,
+		bufferSize: cfg.AWS.UploadBufferSize,
+		attempts:   cfg.AWS.UploadAttempts,
+		retry:      cfg.Upload.Retry,
+		stateDir:   cfg.StateDir,
+		dirMode:    cfg.DirMode(),
+		fileMode:   cfg.FileMode(),
+	}
+}
+
+// CheckObjectACL reports whether acl is empty or one of S3's canned ACLs.
+func CheckObjectACL(acl string) error {
+	if acl == "" {
+		return nil
+	}
+	known := types.ObjectCannedACL("").Values()
+	if !slices.Contains(known, types.ObjectCannedACL(acl)) {
+		names := make([]string, len(known))
+		for i, v := range known {
+			names[i] = string(v)
+		}
+		return fmt.Errorf("unknown canned ACL %q (expected one of %s)", acl, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+func (s *s3Storage) Name() string {
+	return "s3://" + s.bucket
+}
+
+func (s *s3Storage) Upload(ctx context.Context, obj Object) error {
+	size, err := obj.Body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := obj.Body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if s.partSize > 0 && size > s.partSize {
+		return s.uploadMultipart(ctx, obj, size)
+	}
+
+	ctx, cancel := s3Context(ctx, s.timeout)
+	defer cancel()
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(obj.Key),
+		Body:        obj.Body,
+		ContentType: aws.String(obj.ContentType),
+	}
+	if obj.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(obj.ContentEncoding)
+	}
+	if obj.ContentDisposition != "" {
+		input.ContentDisposition = aws.String(obj.ContentDisposition)
+	}
+	if obj.CacheControl != "" {
+		input.CacheControl = aws.String(obj.CacheControl)
+	}
+	if len(obj.Metadata) > 0 {
+		input.Metadata = obj.Metadata
+	}
+	if s.acl != "" {
+		input.ACL = s.acl
+	}
+	if s.contentMD5 {
+		// Hashing is not sent, so it does not count against the bandwidth limit
+		h := md5.New()
+		if _, err := io.Copy(h, unthrottled(obj.Body)); err != nil {
+			return err
+		}
+		if _, err := obj.Body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	}
+
+	_, err = s.client.PutObject(ctx, input)
+	return err
+}
+
+// maxCopySize is the largest object a single CopyObject request accepts.
+const maxCopySize = 5 << 30
+
+// Copy duplicates srcKey within the bucket without downloading it.
+func (s *s3Storage) Copy(ctx context.Context, srcKey string, dst Object) error {
+	info, err := s.Stat(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	if info.Size > maxCopySize {
+		return errCopyTooLarge
+	}
+
+	ctx, cancel := s3Context(ctx, s.timeout)
+	defer cancel()
+
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(dst.Key),
+		CopySource:        aws.String((&url.URL{Path: s.bucket + "/" + srcKey}).EscapedPath()),
+		ContentType:       aws.String(dst.ContentType),
+		MetadataDirective: types.MetadataDirectiveReplace,
+		Metadata:          dst.Metadata,
+	}
+	if dst.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(dst.ContentEncoding)
+	}
+	if dst.ContentDisposition != "" {
+		input.ContentDisposition = aws.String(dst.ContentDisposition)
+	}
+	if dst.CacheControl != "" {
+		input.CacheControl = aws.String(dst.CacheControl)
+	}
+	// Copies do not carry the source's ACL over
+	if s.acl != "" {
+		input.ACL = s.acl
+	}
+	_, err = s.client.CopyObject(ctx, input)
+	return err
+}
+
+// Open streams key from the bucket. The request timeout covers the whole
+// download and ends when the body is closed.
+func (s *s3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.OpenRange(ctx, key, 0, -1)
+}
+
+// OpenRange sends a ranged GetObject, bounded by S3_TIMEOUT like any
+// other request.
+func (s *s3Storage) OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	switch {
+	case length >= 0:
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	ctx, cancel := s3Context(ctx, s.timeout)
+	out, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		cancel()
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	return &cancelReadCloser{ReadCloser: out.Body, cancel: cancel}, nil
+}
+
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		callCtx, cancel := s3Context(ctx, s.timeout)
+		page, err := paginator.NextPage(callCtx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			err := fn(ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// slowDownAttempts bounds how often a DeleteObjects call that S3 throttled
+// is sent again, on top of the SDK's own retries.
+const slowDownAttempts = 5
+
+// Delete removes keys with a single quiet DeleteObjects call. When S3
+// answers SlowDown, the call is repeated with exponential backoff. The
+// per-key errors of a partial success are returned as a *DeleteError.
+func (s *s3Storage) Delete(ctx context.Context, keys []string) error {
+	ids := make([]types.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		ids[i] = types.ObjectIdentifier{Key: aws.String(key)}
+	}
+
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		callCtx, cancel := s3Context(ctx, s.timeout)
+		out, err := s.client.DeleteObjects(callCtx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		cancel()
+
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "SlowDown" && attempt < slowDownAttempts {
+			LoggerFrom(ctx).Warn("delete throttled, backing off", "destination", s.Name(), "keys", len(keys), "attempt", attempt, "wait", wait)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			wait *= 2
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			partial := &DeleteError{Failed: make(map[string]string, len(out.Errors)), Total: len(keys)}
+			for _, e := range out.Errors {
+				partial.Failed[aws.ToString(e.Key)] = aws.ToString(e.Code) + ": " + aws.ToString(e.Message)
+			}
+			return partial
+		}
+		return nil
+	}
+}
+
+func (s *s3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	ctx, cancel := s3Context(ctx, s.timeout)
+	defer cancel()
+
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return ObjectInfo{}, ErrObjectNotFound
+		}
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		LastModified: aws.ToTime(out.LastModified),
+		Metadata:     out.Metadata,
+	}, nil
+}
+
+// CheckBuckets verifies at startup that every S3 destination's bucket
+// exists and is accessible, so a wrong bucket name fails immediately rather
+// than at the next scheduled upload. With cfg.AWS.CreateBucket, a missing
+// bucket is created in its destination's region. With
+// cfg.AWS.AbortIncompleteDays, the lifecycle rule aborting incomplete
+// uploads is added to the bucket or updated. SFTP destinations are
+// connected to, which checks their credentials and host key.
+func CheckBuckets(ctx context.Context, cfg Config) error {
+	for _, dest := range destinations {
+		if s, ok := dest.(*sftpStorage); ok {
+			if err := s.check(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := dest.(*s3Storage)
+		if !ok {
+			continue
+		}
+		if err := s.checkBucket(ctx, cfg.AWS.CreateBucket); err != nil {
+			return err
+		}
+		if cfg.AWS.AbortIncompleteDays > 0 {
+			if err := s.applyAbortRule(ctx, cfg.clusterKey(archivePrefix), cfg.AWS.AbortIncompleteDays); err != nil {
+				return fmt.Errorf("failed to apply the lifecycle rule for incomplete uploads to bucket %q: %w", s.bucket, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *s3Storage) checkBucket(ctx context.Context, create bool) error {
+	region := s.client.Options().Region
+	callCtx, cancel := s3Context(ctx, s.timeout)
+	defer cancel()
+
+	_, err := s.client.HeadBucket(callCtx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	if err == nil {
+		return nil
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) || !create {
+		return fmt.Errorf("bucket %q not found or not accessible in region %s: %w", s.bucket, region, err)
+	}
+
+	input := &s3.CreateBucketInput{Bucket: aws.String(s.bucket)}
+	// us-east-1 is the default location and must not be named
+	if region != "us-east-1" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(region),
+		}
+	}
+	if _, err := s.client.CreateBucket(callCtx, input); err != nil {
+		return fmt.Errorf("bucket %q not found in region %s and could not be created: %w", s.bucket, region, err)
+	}
+	LoggerFrom(ctx).Info("created missing bucket", "bucket", s.bucket, "region", region)
+	return nil
+}
+
+func InitializeS3Client(ctx context.Context, cfg AWSConfig) error {
+	awsCfg, err := CreateAWSConfig(ctx, cfg)
+	AWSClient = s3.NewFromConfig(awsCfg)
+	kmsClient = kms.NewFromConfig(awsCfg)
+	return err
+}
+
+// s3Context bounds a single S3 call by timeout so a hung request cannot
+// stall the scheduler forever.
+func s3Context(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+func CreateAWSConfig(ctx context.Context, cfg AWSConfig) (aws.Config, error) {
+	ctx, cancel := s3Context(ctx, cfg.Timeout)
+	defer cancel()
+
+	awsCfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(cfg.Region),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			cfg.AccessKeyID,
+			cfg.SecretAccessKey,
+			"",
+		)),
+	)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("unable to load AWS config: %w", err)
+	}
+
+	return awsCfg, nil
+}
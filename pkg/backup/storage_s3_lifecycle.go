@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// lifecycleRuleID names the lifecycle rule applyAbortRule maintains. The
+// prefix is part of it, so clusters sharing a bucket keep a rule each.
+func lifecycleRuleID(prefix string) string {
+	return "mongodb-backup-abort-incomplete-uploads:" + prefix
+}
+
+// applyAbortRule adds or updates the rule aborting incomplete multipart
+// uploads below prefix after days. The bucket's other rules are kept, since
+// the lifecycle configuration is replaced as a whole.
+func (s *s3Storage) applyAbortRule(ctx context.Context, prefix string, days int) error {
+	log := LoggerFrom(ctx)
+	callCtx, cancel := s3Context(ctx, s.timeout)
+	defer cancel()
+
+	var rules []types.LifecycleRule
+	var minSize types.TransitionDefaultMinimumObjectSize
+	current, err := s.client.GetBucketLifecycleConfiguration(callCtx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(s.bucket)})
+	var apiErr smithy.APIError
+	switch {
+	case err == nil:
+		rules, minSize = current.Rules, current.TransitionDefaultMinimumObjectSize
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchLifecycleConfiguration":
+	default:
+		return err
+	}
+
+	id := lifecycleRuleID(prefix)
+	rule := types.LifecycleRule{
+		ID:     aws.String(id),
+		Status: types.ExpirationStatusEnabled,
+		Filter: &types.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+		AbortIncompleteMultipartUpload: &types.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int32(int32(days)),
+		},
+	}
+	i := 0
+	for ; i < len(rules); i++ {
+		if aws.ToString(rules[i].ID) == id {
+			break
+		}
+	}
+	if i < len(rules) {
+		existing := rules[i]
+		if existing.Status == types.ExpirationStatusEnabled && existing.AbortIncompleteMultipartUpload != nil &&
+			aws.ToInt32(existing.AbortIncompleteMultipartUpload.DaysAfterInitiation) == int32(days) {
+			return nil
+		}
+		rules[i] = rule
+	} else {
+		rules = append(rules, rule)
+	}
+
+	_, err = s.client.PutBucketLifecycleConfiguration(callCtx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                             aws.String(s.bucket),
+		LifecycleConfiguration:             &types.BucketLifecycleConfiguration{Rules: rules},
+		TransitionDefaultMinimumObjectSize: minSize,
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("lifecycle rule for incomplete uploads applied", "bucket", s.bucket, "prefix", prefix, "days", days)
+	return nil
+}
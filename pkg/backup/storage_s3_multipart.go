@@ -0,0 +1,401 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	multipartStateFileName = "multipart-uploads.json"
+	minPartSize            = 5 << 20
+	maxParts               = 10000
+)
+
+// multipartUpload is the persisted progress of an in-flight multipart
+// upload, so that a failed attempt can continue where it stopped.
+type multipartUpload struct {
+	Bucket    string          `json:"bucket"`
+	Key       string          `json:"key"`
+	UploadID  string          `json:"upload_id"`
+	PartSize  int64           `json:"part_size"`
+	StartedAt time.Time       `json:"started_at"`
+	Parts     []multipartPart `json:"parts"`
+}
+
+// multipartPart is a completed part. MD5 is the local digest of the part's
+// bytes; a part is only reused when the file still has the same bytes there.
+type multipartPart struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+	MD5    string `json:"md5"`
+}
+
+// Destinations upload in parallel, so every read-modify-write of the state
+// file goes through this lock.
+var multipartStateMu sync.Mutex
+
+func multipartStateKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+func readMultipartState(stateDir string) (map[string]multipartUpload, error) {
+	uploads := make(map[string]multipartUpload)
+	data, err := os.ReadFile(filepath.Join(stateDir, multipartStateFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return uploads, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &uploads); err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+// updateMultipartState applies fn to the stored uploads and writes them back.
+// The folder and file are created with dirMode and fileMode.
+func updateMultipartState(stateDir string, dirMode, fileMode os.FileMode, fn func(map[string]multipartUpload)) error {
+	multipartStateMu.Lock()
+	defer multipartStateMu.Unlock()
+
+	uploads, err := readMultipartState(stateDir)
+	if err != nil {
+		return err
+	}
+	fn(uploads)
+
+	if err := os.MkdirAll(stateDir, dirMode); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(uploads, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stateDir, multipartStateFileName), data, fileMode)
+}
+
+// uploadMultipart uploads obj in parts, retrying failed attempts up to
+// s.attempts times after the s.retry backoff. Each attempt resumes the
+// persisted upload and only sends the parts that are missing or whose
+// bytes changed.
+func (s *s3Storage) uploadMultipart(ctx context.Context, obj Object, size int64) error {
+	log := LoggerFrom(ctx)
+
+	partSize := max(s.partSize, minPartSize)
+	if (size+partSize-1)/partSize > maxParts {
+		partSize = (size + maxParts - 1) / maxParts
+	}
+
+	attempts := max(s.attempts, 1)
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			wait := s.retry.delay(attempt - 1)
+			log.Warn("multipart upload failed, resuming", "key", obj.Key, "destination", s.Name(), "attempt", attempt, "wait", wait, "error", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		if err = s.multipartAttempt(ctx, obj, size, partSize); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *s3Storage) multipartAttempt(ctx context.Context, obj Object, size, partSize int64) error {
+	up, err := s.resumeOrCreateUpload(ctx, obj, partSize)
+	if err != nil {
+		return err
+	}
+
+	done := make(map[int32]multipartPart, len(up.Parts))
+	for _, p := range up.Parts {
+		done[p.Number] = p
+	}
+
+	if _, err := obj.Body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	stateKey := multipartStateKey(s.bucket, obj.Key)
+
+	// Either hold one part in memory, or stream it from the file twice.
+	// Only sending a part counts against the bandwidth limit
+	src := unthrottled(obj.Body)
+	file, streaming := src.(io.ReaderAt)
+	streaming = streaming && s.bufferSize > 0
+	var buf []byte
+	if streaming {
+		buf = make([]byte, s.bufferSize)
+	} else {
+		buf = make([]byte, partSize)
+	}
+
+	var completed []types.CompletedPart
+	reused := 0
+	for number, offset := int32(1), int64(0); offset < size; number, offset = number+1, offset+partSize {
+		length := min(partSize, size-offset)
+		var body io.ReadSeeker
+		h := md5.New()
+		if streaming {
+			section := io.NewSectionReader(file, offset, length)
+			if _, err := io.CopyBuffer(h, struct{ io.Reader }{section}, buf); err != nil {
+				return err
+			}
+			if _, err := section.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			body = section
+		} else {
+			chunk := buf[:length]
+			if _, err := io.ReadFull(src, chunk); err != nil {
+				return err
+			}
+			h.Write(chunk)
+			body = bytes.NewReader(chunk)
+		}
+		sum := h.Sum(nil)
+		digest := hex.EncodeToString(sum)
+
+		part, ok := done[number]
+		if ok && part.MD5 == digest {
+			reused++
+		} else {
+			etag, err := s.uploadPart(ctx, up, number, throttledLike(obj.Body, body), length, sum)
+			if err != nil {
+				return fmt.Errorf("part %d: %w", number, err)
+			}
+			part = multipartPart{Number: number, ETag: etag, MD5: digest}
+			err = updateMultipartState(s.stateDir, s.dirMode, s.fileMode, func(uploads map[string]multipartUpload) {
+				u := uploads[stateKey]
+				u.Parts = append(u.Parts, part)
+				uploads[stateKey] = u
+			})
+			if err != nil {
+				LoggerFrom(ctx).Warn("failed to store multipart progress", "key", obj.Key, "error", err)
+			}
+		}
+		completed = append(completed, types.CompletedPart{PartNumber: aws.Int32(number), ETag: aws.String(part.ETag)})
+	}
+	if reused > 0 {
+		LoggerFrom(ctx).Info("resumed multipart upload", "key", obj.Key, "destination", s.Name(), "reused_parts", reused, "total_parts", len(completed))
+	}
+
+	callCtx, cancel := s3Context(ctx, s.timeout)
+	defer cancel()
+	_, err = s.client.CompleteMultipartUpload(callCtx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(obj.Key),
+		UploadId:        aws.String(up.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		var noSuchUpload *types.NoSuchUpload
+		if errors.As(err, &noSuchUpload) {
+			s.forgetUpload(ctx, obj.Key)
+		}
+		return err
+	}
+
+	s.forgetUpload(ctx, obj.Key)
+	return nil
+}
+
+// resumeOrCreateUpload returns the persisted upload for obj.Key when it
+// still exists on S3 with the same part size, and starts a new one otherwise.
+func (s *s3Storage) resumeOrCreateUpload(ctx context.Context, obj Object, partSize int64) (multipartUpload, error) {
+	stateKey := multipartStateKey(s.bucket, obj.Key)
+
+	multipartStateMu.Lock()
+	uploads, err := readMultipartState(s.stateDir)
+	multipartStateMu.Unlock()
+	if err != nil {
+		LoggerFrom(ctx).Warn("unable to read multipart state, starting over", "error", err)
+	}
+
+	if up, ok := uploads[stateKey]; ok {
+		if up.PartSize == partSize && s.uploadExists(ctx, up) {
+			return up, nil
+		}
+		s.abortUpload(ctx, up)
+	}
+
+	callCtx, cancel := s3Context(ctx, s.timeout)
+	defer cancel()
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(obj.Key),
+		ContentType: aws.String(obj.ContentType),
+	}
+	if obj.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(obj.ContentEncoding)
+	}
+	if obj.ContentDisposition != "" {
+		input.ContentDisposition = aws.String(obj.ContentDisposition)
+	}
+	if obj.CacheControl != "" {
+		input.CacheControl = aws.String(obj.CacheControl)
+	}
+	if len(obj.Metadata) > 0 {
+		input.Metadata = obj.Metadata
+	}
+	if s.acl != "" {
+		input.ACL = s.acl
+	}
+	out, err := s.client.CreateMultipartUpload(callCtx, input)
+	if err != nil {
+		return multipartUpload{}, err
+	}
+
+	up := multipartUpload{
+		Bucket:    s.bucket,
+		Key:       obj.Key,
+		UploadID:  aws.ToString(out.UploadId),
+		PartSize:  partSize,
+		StartedAt: time.Now().UTC(),
+	}
+	err = updateMultipartState(s.stateDir, s.dirMode, s.fileMode, func(uploads map[string]multipartUpload) {
+		uploads[stateKey] = up
+	})
+	if err != nil {
+		LoggerFrom(ctx).Warn("failed to store multipart upload", "key", obj.Key, "error", err)
+	}
+	return up, nil
+}
+
+// uploadExists reports whether S3 still knows the upload, which it will not
+// once it was completed, aborted or removed by a lifecycle rule.
+func (s *s3Storage) uploadExists(ctx context.Context, up multipartUpload) bool {
+	callCtx, cancel := s3Context(ctx, s.timeout)
+	defer cancel()
+	_, err := s.client.ListParts(callCtx, &s3.ListPartsInput{
+		Bucket:   aws.String(up.Bucket),
+		Key:      aws.String(up.Key),
+		UploadId: aws.String(up.UploadID),
+		MaxParts: aws.Int32(1),
+	})
+	return err == nil
+}
+
+// uploadPart sends part number of up. sum is the part's MD5, sent as
+// Content-MD5 when s.contentMD5 is set.
+func (s *s3Storage) uploadPart(ctx context.Context, up multipartUpload, number int32, body io.ReadSeeker, length int64, sum []byte) (string, error) {
+	callCtx, cancel := s3Context(ctx, s.timeout)
+	defer cancel()
+	input := &s3.UploadPartInput{
+		Bucket:        aws.String(up.Bucket),
+		Key:           aws.String(up.Key),
+		UploadId:      aws.String(up.UploadID),
+		PartNumber:    aws.Int32(number),
+		Body:          body,
+		ContentLength: aws.Int64(length),
+	}
+	if s.contentMD5 {
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum))
+	}
+	out, err := s.client.UploadPart(callCtx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+func (s *s3Storage) abortUpload(ctx context.Context, up multipartUpload) {
+	callCtx, cancel := s3Context(ctx, s.timeout)
+	defer cancel()
+	_, err := s.client.AbortMultipartUpload(callCtx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(up.Bucket),
+		Key:      aws.String(up.Key),
+		UploadId: aws.String(up.UploadID),
+	})
+	var noSuchUpload *types.NoSuchUpload
+	if err != nil && !errors.As(err, &noSuchUpload) {
+		LoggerFrom(ctx).Warn("failed to abort multipart upload", "key", up.Key, "upload_id", up.UploadID, "error", err)
+	}
+	s.forgetUpload(ctx, up.Key)
+}
+
+func (s *s3Storage) forgetUpload(ctx context.Context, key string) {
+	err := updateMultipartState(s.stateDir, s.dirMode, s.fileMode, func(uploads map[string]multipartUpload) {
+		delete(uploads, multipartStateKey(s.bucket, key))
+	})
+	if err != nil {
+		LoggerFrom(ctx).Warn("failed to update multipart state", "key", key, "error", err)
+	}
+}
+
+// abortStaleUploads aborts multipart uploads of backup archives below
+// prefix in the bucket that were started before cutoff, whether or not they are tracked
+// in the state file, so failed uploads stop accruing storage charges.
+func (s *s3Storage) abortStaleUploads(ctx context.Context, prefix string, cutoff time.Time) error {
+	var stale []multipartUpload
+	paginator := s3.NewListMultipartUploadsPaginator(s.client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		callCtx, cancel := s3Context(ctx, s.timeout)
+		page, err := paginator.NextPage(callCtx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, u := range page.Uploads {
+			if aws.ToTime(u.Initiated).Before(cutoff) {
+				stale = append(stale, multipartUpload{Bucket: s.bucket, Key: aws.ToString(u.Key), UploadID: aws.ToString(u.UploadId)})
+			}
+		}
+	}
+
+	for _, up := range stale {
+		s.abortUpload(ctx, up)
+		LoggerFrom(ctx).Info("aborted stale multipart upload", "key", up.Key, "destination", s.Name(), "upload_id", up.UploadID)
+	}
+	return nil
+}
+
+// AbortStaleUploads aborts multipart uploads on every S3 destination that
+// are older than cfg.AWS.StaleUploadAge. It is meant to run during cleanup.
+func AbortStaleUploads(ctx context.Context, cfg Config) error {
+	if cfg.AWS.StaleUploadAge <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-cfg.AWS.StaleUploadAge)
+
+	var errs []error
+	for _, dest := range destinations {
+		s, ok := dest.(*s3Storage)
+		if !ok {
+			continue
+		}
+		if err := s.abortStaleUploads(ctx, cfg.clusterKey(archivePrefix), cutoff); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Name(), err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%w: failed to abort stale uploads: %w", ErrCleanup, err)
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultSFTPTimeout bounds connecting to an SFTP server when
+// SFTPConfig.Timeout is unset.
+const defaultSFTPTimeout = 30 * time.Second
+
+// sftpStorage copies archives into a directory of an SFTP server, e.g. an
+// off-site host that is only reachable over SSH. Like file:// destinations
+// it keeps no object metadata.
+type sftpStorage struct {
+	addr   string
+	user   string
+	dir    string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// newSFTPStorage prepares a destination for dir on the server at addr,
+// host:port, authenticated as user with the password and key of cfg. It
+// does not connect; the connection is opened on first use.
+func newSFTPStorage(addr, user, dir string, cfg SFTPConfig) (*sftpStorage, error) {
+	if user == "" {
+		return nil, fmt.Errorf("sftp://%s: missing a user", addr)
+	}
+	var auth []ssh.AuthMethod
+	if cfg.PrivateKeyFile != "" {
+		signer, err := readPrivateKey(cfg.PrivateKeyFile, cfg.PrivateKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("sftp://%s: needs a password or a private key file", addr)
+	}
+
+	knownHosts := cfg.KnownHostsFile
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("sftp://%s: no known_hosts file to verify the server with: %w", addr, err)
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKey, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("sftp://%s: unable to read the known host keys: %w", addr, err)
+	}
+
+	return &sftpStorage{
+		addr: addr,
+		user: user,
+		dir:  path.Clean(dir),
+		config: &ssh.ClientConfig{
+			User:              user,
+			Auth:              auth,
+			HostKeyCallback:   hostKey,
+			HostKeyAlgorithms: knownHostKeyAlgorithms(hostKey, addr),
+			Timeout:           cmp.Or(cfg.Timeout, defaultSFTPTimeout),
+		},
+	}, nil
+}
+
+func readPrivateKey(file, passphrase string) (ssh.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the SFTP private key: %w", err)
+	}
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid SFTP private key %s: %w", file, err)
+	}
+	return signer, nil
+}
+
+// knownHostKeyAlgorithms lists the algorithms of the keys known for addr.
+// Without them the server may present a key of another type than the one
+// in known_hosts, which fails as a mismatch. nil leaves the choice to ssh.
+func knownHostKeyAlgorithms(hostKey ssh.HostKeyCallback, addr string) []string {
+	// A freshly generated key is never known, so the error names the keys
+	// that are
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(hostKey(addr, &net.TCPAddr{}, probe), &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, known.Key.Type())
+		}
+	}
+	return algorithms
+}
+
+func (s *sftpStorage) Name() string {
+	// sftp:// paths are absolute; /~/ marks one below the login directory
+	dir := s.dir
+	if !path.IsAbs(dir) {
+		dir = path.Join("/~", dir)
+	}
+	return "sftp://" + s.user + "@" + s.addr + dir
+}
+
+// session returns the SFTP client, connecting first when there is none
+// yet or the last connection was lost.
+func (s *sftpStorage) session(ctx context.Context) (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	dialer := net.Dialer{Timeout: s.config.Timeout}
+	raw, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake is bounded like the dial; ssh only bounds the latter
+	raw.SetDeadline(time.Now().Add(s.config.Timeout))
+	c, chans, reqs, err := ssh.NewClientConn(raw, s.addr, s.config)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+	conn := ssh.NewClient(c, chans, reqs)
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sftp subsystem not available: %w", err)
+	}
+	s.conn, s.client = conn, client
+
+	// Forget a lost connection, so the next call connects again
+	go func() {
+		conn.Wait()
+		client.Close()
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn, s.client = nil, nil
+		}
+		s.mu.Unlock()
+	}()
+	return client, nil
+}
+
+// check connects to the server, so that a wrong address, credential or
+// host key fails at startup rather than at the first upload.
+func (s *sftpStorage) check(ctx context.Context) error {
+	if _, err := s.session(ctx); err != nil {
+		return fmt.Errorf("destination %s not accessible: %w", s.Name(), err)
+	}
+	return nil
+}
+
+func (s *sftpStorage) Upload(ctx context.Context, obj Object) error {
+	client, err := s.session(ctx)
+	if err != nil {
+		return err
+	}
+	target := path.Join(s.dir, obj.Key)
+	if err := client.MkdirAll(path.Dir(target)); err != nil {
+		return err
+	}
+
+	// Write to a temporary name first so a partial copy is never mistaken
+	// for a complete backup
+	tmp := target + ".partial"
+	out, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	// Writes are pipelined, one round trip per packet would crawl over a
+	// distant link
+	if _, err := out.ReadFromWithConcurrency(contextReader{ctx, obj.Body}, 0); err != nil {
+		out.Close()
+		client.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		client.Remove(tmp)
+		return err
+	}
+	// Plain SFTP renames refuse to replace a file; the posix-rename
+	// extension does so atomically where the server has it
+	err = client.PosixRename(tmp, target)
+	var status *sftp.StatusError
+	if errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxOpUnsupported {
+		client.Remove(target)
+		err = client.Rename(tmp, target)
+	}
+	return err
+}
+
+// contextReader stops a copy once ctx is done, since SFTP writes do not
+// take a context.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func (s *sftpStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	client, err := s.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	file, err := client.Open(path.Join(s.dir, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *sftpStorage) OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	body, err := s.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	file := body.(*sftp.File)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+func (s *sftpStorage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	client, err := s.session(ctx)
+	if err != nil {
+		return err
+	}
+	// Only the folder the prefix ends in needs to be walked
+	root := path.Join(s.dir, prefix[:strings.LastIndex(prefix, "/")+1])
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, fs.ErrNotExist) && walker.Path() == root {
+				return nil
+			}
+			return err
+		}
+		info := walker.Stat()
+		if info.IsDir() || strings.HasSuffix(walker.Path(), ".partial") {
+			continue
+		}
+		key := s.key(walker.Path())
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := fn(ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// key turns the remote path p below s.dir into a key.
+func (s *sftpStorage) key(p string) string {
+	if s.dir == "." {
+		return strings.TrimPrefix(p, "./")
+	}
+	return strings.TrimPrefix(p, s.dir+"/")
+}
+
+func (s *sftpStorage) Delete(ctx context.Context, keys []string) error {
+	client, err := s.session(ctx)
+	if err != nil {
+		return err
+	}
+	failed := make(map[string]string)
+	for _, key := range keys {
+		target := path.Join(s.dir, key)
+		if err := client.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			failed[key] = err.Error()
+			continue
+		}
+		// Drop the folder of a per-database run with its last object;
+		// this fails harmlessly while the folder is not empty
+		if dir := path.Dir(target); dir != s.dir {
+			client.RemoveDirectory(dir)
+		}
+	}
+	if len(failed) > 0 {
+		return &DeleteError{Failed: failed, Total: len(keys)}
+	}
+	return nil
+}
+
+func (s *sftpStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	client, err := s.session(ctx)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := client.Stat(path.Join(s.dir, key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ObjectInfo{}, ErrObjectNotFound
+		}
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()}, nil
+}
@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WriteArchive streams the archive of cfg.OutputDir to w in the configured
+// format, e.g. to stdout for a pipeline. Nothing is uploaded.
+func WriteArchive(ctx context.Context, cfg Config, w io.Writer) error {
+	var comment string
+	if cfg.Archive.Comment {
+		comment = archiveComment(ctx, cfg)
+	}
+	if err := writeArchive(ctx, w, cfg.OutputDir, cfg.Archive, comment); err != nil {
+		return fmt.Errorf("%w: failed to write archive: %w", ErrUploadFailed, err)
+	}
+	LoggerFrom(ctx).Info("archive written", "format", cfg.Archive.Format)
+	return nil
+}
+
+// RestoreFromReader restores an archive read from r, such as stdin,
+// without touching any storage. name is the file r reads, or empty for
+// stdin. Unless format names it, the format is detected from the first
+// bytes, except for a tar.br archive, which has no magic bytes and is only
+// recognized by a name ending in .tar.br. The archive is spooled below
+// cfg.Restore.Dir, since a zip cannot be read front to back. Otherwise it
+// behaves like RestoreFromS3.
+func RestoreFromReader(ctx context.Context, cfg Config, r io.Reader, name, format string, databases []string) error {
+	return restore(ctx, cfg, "stdin", databases, func(target, scratch, dumpDir string) ([]string, error) {
+		br := bufio.NewReader(r)
+		head, _ := br.Peek(max(sealHeadSize, sniffHeadSize))
+
+		// An encrypted archive is decrypted before its format is known
+		sealed := isSealed(head)
+		archivePath := filepath.Join(scratch, "stdin"+sealSuffix)
+		if !sealed {
+			var err error
+			if format, err = streamArchiveFormat(head, name, format); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+			}
+			archivePath = filepath.Join(scratch, "stdin"+archiveExtension(format))
+		}
+		out, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cfg.FileMode())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrRestoreFailed, err)
+		}
+		n, err := io.Copy(out, br)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to read archive: %w", ErrRestoreFailed, err)
+		}
+		if sealed {
+			if archivePath, format, err = unsealStream(ctx, cfg.Encryption, archivePath, strings.TrimSuffix(name, sealSuffix), format); err != nil {
+				return nil, fmt.Errorf("%w: failed to decrypt archive: %w", ErrRestoreFailed, err)
+			}
+		}
+		LoggerFrom(ctx).Info("archive read", "format", format, "size", n)
+
+		return databases, unpackArchive(ctx, cfg, archivePath, target, dumpDir)
+	})
+}
+
+// unsealStream decrypts the spooled archive at path and renames it after
+// the format of its content, as streamArchiveFormat finds it with name,
+// the archive without its encryption suffix, and format. It returns the
+// new path and the format.
+func unsealStream(ctx context.Context, cfg EncryptionConfig, path, name, format string) (string, string, error) {
+	if _, err := unsealArchive(ctx, cfg, path); err != nil {
+		return "", "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	head := make([]byte, sniffHeadSize)
+	n, _ := io.ReadFull(file, head)
+	file.Close()
+
+	format, err = streamArchiveFormat(head[:n], name, format)
+	if err != nil {
+		return "", "", err
+	}
+	plainPath := strings.TrimSuffix(path, sealSuffix) + archiveExtension(format)
+	return plainPath, format, os.Rename(path, plainPath)
+}
+
+// sniffHeadSize is how much of an archive sniffArchiveFormat needs: up to
+// the end of the magic of a tar header.
+const sniffHeadSize = tarMagicOffset + len(tarMagic)
+
+// The "ustar" magic of every tar header written since POSIX.1-1988.
+const (
+	tarMagicOffset = 257
+	tarMagic       = "ustar"
+)
+
+// streamArchiveFormat picks the format of an archive read from a stream:
+// format when it is given, tar.br when name says so, since a brotli stream
+// has no magic bytes, and otherwise the one sniffArchiveFormat finds in
+// head.
+func streamArchiveFormat(head []byte, name, format string) (string, error) {
+	if format != "" {
+		return format, nil
+	}
+	if named, err := archiveFormatOf(name); err == nil && named == FormatTarBr {
+		return named, nil
+	}
+	return sniffArchiveFormat(head)
+}
+
+// sniffArchiveFormat tells the archive formats apart by their magic bytes.
+// A tar of an empty folder is all zeros.
+func sniffArchiveFormat(head []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return FormatZip, nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return FormatTarGz, nil
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FormatTarZst, nil
+	case len(head) >= sniffHeadSize && string(head[tarMagicOffset:sniffHeadSize]) == tarMagic,
+		len(head) > 0 && bytes.Count(head, []byte{0}) == len(head):
+		return FormatTar, nil
+	default:
+		return "", errors.New("unrecognized archive format")
+	}
+}
@@ -0,0 +1,51 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestStreamArchiveFormat(t *testing.T) {
+	cfg := uploadTestConfig(t)
+	heads := map[string][]byte{}
+	for _, format := range []string{FormatZip, FormatTarGz, FormatTarZst, FormatTarBr, FormatTar} {
+		var buf bytes.Buffer
+		archive := cfg.Archive
+		archive.Format = format
+		if err := writeArchive(context.Background(), &buf, cfg.OutputDir, archive, ""); err != nil {
+			t.Fatalf("writeArchive(%s): %v", format, err)
+		}
+		heads[format] = buf.Bytes()[:min(buf.Len(), sniffHeadSize)]
+	}
+
+	tests := []struct {
+		name    string
+		head    string
+		file    string
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{name: "zip", head: FormatZip, want: FormatZip},
+		{name: "tar.gz", head: FormatTarGz, want: FormatTarGz},
+		{name: "tar.zst", head: FormatTarZst, want: FormatTarZst},
+		{name: "tar", head: FormatTar, want: FormatTar},
+		{name: "tar.br on stdin", head: FormatTarBr, wantErr: true},
+		{name: "tar.br named by its file", head: FormatTarBr, file: "backup.tar.br", want: FormatTarBr},
+		{name: "tar.br named by -format", head: FormatTarBr, format: FormatTarBr, want: FormatTarBr},
+		{name: "tar.br in a file named otherwise", head: FormatTarBr, file: "backup.bin", wantErr: true},
+		{name: "magic bytes win over the name", head: FormatZip, file: "backup.tar.gz", want: FormatZip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := streamArchiveFormat(heads[tt.head], tt.file, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("streamArchiveFormat = %q, %v, want error: %v", got, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("streamArchiveFormat = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
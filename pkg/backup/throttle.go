@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// uploadLimiter caps the bytes per second read from the files being
+// uploaded, shared by every destination and concurrent upload. nil is
+// unlimited.
+var uploadLimiter *rate.Limiter
+
+// maxThrottleBurst bounds how many bytes a single read may take from the
+// limiter at once, so that a high limit still spreads out large reads.
+const maxThrottleBurst = 1 << 20
+
+// limitUploadBandwidth caps all uploads together to bytesPerSecond; 0
+// removes the limit.
+func limitUploadBandwidth(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		uploadLimiter = nil
+		return
+	}
+	uploadLimiter = rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, maxThrottleBurst)))
+}
+
+type uploadFileBody interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// throttledBody reads an upload's file at the pace of limiter. It keeps
+// io.ReaderAt so that multipart uploads still stream parts from disk.
+type throttledBody struct {
+	ctx     context.Context
+	file    uploadFileBody
+	limiter *rate.Limiter
+}
+
+func throttleUpload(ctx context.Context, file uploadFileBody) io.ReadSeeker {
+	if uploadLimiter == nil {
+		return file
+	}
+	return &throttledBody{ctx: ctx, file: file, limiter: uploadLimiter}
+}
+
+// unthrottled returns the file below a throttled body, for reads that do
+// not leave the host, such as the checksums of multipart parts.
+func unthrottled(body io.ReadSeeker) io.ReadSeeker {
+	if t, ok := body.(*throttledBody); ok {
+		return t.file
+	}
+	return body
+}
+
+// throttledLike throttles part, a piece of body, when body is throttled.
+func throttledLike(body io.ReadSeeker, part io.ReadSeeker) io.ReadSeeker {
+	t, ok := body.(*throttledBody)
+	f, seekable := part.(uploadFileBody)
+	if !ok || !seekable {
+		return part
+	}
+	return &throttledBody{ctx: t.ctx, file: f, limiter: t.limiter}
+}
+
+func (t *throttledBody) Read(p []byte) (int, error) {
+	p = p[:min(len(p), t.limiter.Burst())]
+	n, err := t.file.Read(p)
+	if n > 0 {
+		if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (t *throttledBody) ReadAt(p []byte, off int64) (int, error) {
+	var read int
+	for read < len(p) {
+		chunk := p[read:min(len(p), read+t.limiter.Burst())]
+		n, err := t.file.ReadAt(chunk, off+int64(read))
+		read += n
+		if n > 0 {
+			if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+				return read, werr
+			}
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (t *throttledBody) Seek(offset int64, whence int) (int64, error) {
+	return t.file.Seek(offset, whence)
+}
@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Settings of RestoreConfig.ToolsCheck, applied when the mongorestore
+// found at restore time may not read what the archive's mongodump wrote.
+const (
+	ToolsCheckWarn   = "warn"
+	ToolsCheckRefuse = "refuse"
+	ToolsCheckOff    = "off"
+)
+
+// toolsVersionPattern matches the first line of --version, e.g.
+// "mongodump version: 100.9.4", or "r3.6.3" for the legacy tools.
+var toolsVersionPattern = regexp.MustCompile(`version: r?(\d+\.\d+\.\d+)`)
+
+// toolsVersion runs tool --version and returns its version, e.g. 100.9.4.
+func toolsVersion(ctx context.Context, tool string) (string, error) {
+	out, err := exec.CommandContext(ctx, tool, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s --version: %w", tool, err)
+	}
+	m := toolsVersionPattern.FindSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("%s --version: no version in %q", tool, strings.TrimSpace(string(out)))
+	}
+	return string(m[1]), nil
+}
+
+// toolsIncompatibility explains why a mongorestore of version restore may
+// not read a dump written by mongodump dump, or returns "". Tools of one
+// major version share their dump format, and a newer mongorestore reads
+// what an older mongodump wrote, but not the other way around.
+func toolsIncompatibility(dump, restore string) string {
+	d, r := parseToolsVersion(dump), parseToolsVersion(restore)
+	if d == nil || r == nil {
+		return ""
+	}
+	switch {
+	case d[0] != r[0]:
+		return fmt.Sprintf("mongorestore %s and mongodump %s are different major versions", restore, dump)
+	case compareVersions(r, d) < 0:
+		return fmt.Sprintf("mongorestore %s is older than mongodump %s", restore, dump)
+	}
+	return ""
+}
+
+func parseToolsVersion(v string) []int {
+	parts := strings.Split(strings.TrimPrefix(v, "r"), ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	out := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil
+		}
+		out[i] = n
+	}
+	return out
+}
+
+func compareVersions(a, b []int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] - b[i]
+		}
+	}
+	return 0
+}
+
+// checkRestoreTools compares the local mongorestore with dumpVersion, the
+// mongodump the backup was taken with, as cfg.Restore.ToolsCheck says.
+// Backups that predate the recorded version are not checked.
+func checkRestoreTools(ctx context.Context, cfg Config, dumpVersion string) error {
+	log := LoggerFrom(ctx)
+	mode := cfg.Restore.ToolsCheck
+	if mode == ToolsCheckOff || dumpVersion == "" {
+		return nil
+	}
+
+	restoreVersion, err := toolsVersion(ctx, "mongorestore")
+	if err != nil {
+		if mode == ToolsCheckRefuse {
+			return fmt.Errorf("%w: unable to check the mongorestore version: %w", ErrRestoreFailed, err)
+		}
+		log.Warn("unable to check the mongorestore version", "error", err)
+		return nil
+	}
+	problem := toolsIncompatibility(dumpVersion, restoreVersion)
+	if problem == "" {
+		log.Info("mongorestore version", "mongorestore", restoreVersion, "mongodump", dumpVersion)
+		return nil
+	}
+	if mode == ToolsCheckRefuse {
+		return fmt.Errorf("%w: %s; install a matching MongoDB Database Tools release or set RESTORE_TOOLS_CHECK=warn", ErrRestoreFailed, problem)
+	}
+	log.Warn("mongorestore may not read this backup", "reason", problem)
+	return nil
+}
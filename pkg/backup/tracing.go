@@ -0,0 +1,22 @@
+package backup
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records the stages of a run as OpenTelemetry spans, children of
+// any span in the context passed in. Until a program registers a tracer
+// provider with otel.SetTracerProvider, the spans are no-ops.
+var tracer = otel.Tracer("mongodb_backup/pkg/backup")
+
+// endSpan ends span, recording err as its error status first when it is
+// not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
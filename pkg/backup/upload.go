@@ -0,0 +1,233 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// UploadToS3 zips the dump folder and uploads the archive (and, when
+// enabled, its manifest sidecar) to every configured destination. With
+// cfg.Archive.PerDatabase, every database is archived and uploaded on its
+// own instead; see uploadDatabases.
+func UploadToS3(ctx context.Context, cfg Config) (err error) {
+	ctx, span := tracer.Start(ctx, "backup.upload")
+	defer func() { endSpan(span, err) }()
+	log := LoggerFrom(ctx)
+
+	dir := cfg.OutputDir
+
+	// Skip archives whose content matches the previous upload, unless the
+	// backup is labeled and so always goes under its own key
+	var checksum string
+	if cfg.Upload.Dedup {
+		checksum, err = contentChecksum(dir)
+		if err != nil {
+			return fmt.Errorf("%w: failed to checksum backup folder: %w", ErrUploadFailed, err)
+		}
+		if rec, same := previousUploadMatches(ctx, cfg.StateDir, checksum); same && cfg.Label == "" {
+			rec.LastSeenAt = time.Now().UTC()
+			if err := writeUploadRecord(cfg, rec); err != nil {
+				log.Warn("failed to update upload record", "error", err)
+			}
+			log.Info("backup identical to previous upload, skipping", "key", rec.Key, "checksum", checksum)
+			return nil
+		}
+	}
+
+	if cfg.Archive.PerDatabase {
+		key, size, err := uploadDatabases(ctx, cfg, checksum)
+		if err != nil {
+			return fmt.Errorf("%w: failed to upload backup: %w", ErrUploadFailed, err)
+		}
+		recordUpload(ctx, cfg, key, checksum)
+		log.Info("backup uploaded", "key", key)
+		reportUploaded(ctx, key)
+		postManifestWebhook(ctx, cfg, key, checksum, size)
+		return nil
+	}
+
+	// Archive the backup folder
+	archivePath := archiveName(time.Now(), cfg.Label, cfg.Archive.Format)
+	var comment string
+	if cfg.Archive.Comment {
+		comment = archiveComment(ctx, cfg)
+	}
+	archiveStarted := time.Now()
+	archiveCtx, cancelArchive := withStageDeadline(ctx, StageArchive, cfg.Timeouts.Archive)
+	err = archiveFolder(archiveCtx, dir, archivePath, cfg.FileMode(), cfg.Archive, cfg.Encryption, comment)
+	err = stageError(archiveCtx, err)
+	cancelArchive()
+	recordStage(ctx, StageArchive, archiveStarted)
+	if err != nil {
+		os.Remove(archivePath)
+		return fmt.Errorf("%w: failed to archive backup folder: %w", ErrUploadFailed, err)
+	}
+	// The local archive is removed (or kept) whether or not the upload
+	// succeeded
+	defer func() {
+		if cfg.LocalArchive.Keep {
+			if keepErr := keepLocalArchive(ctx, cfg, archivePath); keepErr != nil {
+				os.Remove(archivePath)
+				if err == nil {
+					err = fmt.Errorf("%w: failed to keep local archive: %w", ErrCleanup, keepErr)
+				}
+			}
+			return
+		}
+		if removeErr := removeArchive(ctx, archivePath); removeErr != nil && err == nil {
+			err = removeErr
+		}
+	}()
+
+	// Read content type
+	contentType, err := archiveContentType(cfg.Archive.Format, archivePath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+
+	// With ENCRYPTION_MODE=kms-envelope an encrypted copy is uploaded; with
+	// age the archive was encrypted as it was written
+	uploadPath, sealedMetadata, err := sealArchive(ctx, cfg.Encryption, archivePath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+	if uploadPath != archivePath {
+		defer os.Remove(uploadPath)
+	}
+	encoding := archiveContentEncoding(cfg.Archive.Format)
+	if sealedMetadata != nil {
+		contentType, encoding = "application/octet-stream", ""
+	}
+
+	imagekey := cfg.clusterKey(archivePath)
+	preUpload := preUploadArchive{Path: uploadPath, Key: imagekey, Checksum: checksum, Encrypted: sealedMetadata != nil}
+	if err := runPreUploadCommand(ctx, cfg, preUpload); err != nil {
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+
+	// Upload to every configured destination
+	disposition, cacheControl := downloadHeaders(cfg.Upload, imagekey)
+	obj := Object{
+		Key:                imagekey,
+		ContentType:        contentType,
+		ContentEncoding:    encoding,
+		ContentDisposition: disposition,
+		CacheControl:       cacheControl,
+	}
+	obj.Metadata = map[string]string{}
+	if checksum != "" {
+		obj.Metadata[checksumMetadata] = checksum
+	}
+	if cfg.Label != "" {
+		obj.Metadata[labelMetadata] = cfg.Label
+	}
+	if cfg.ClusterName != "" {
+		obj.Metadata[clusterMetadata] = cfg.ClusterName
+	}
+	if cfg.AppVersion != "" {
+		obj.Metadata[versionMetadata] = cfg.AppVersion
+	}
+	maps.Copy(obj.Metadata, sealedMetadata)
+	var sum string
+	if cfg.Upload.ChecksumSidecar {
+		if sum, err = fileSHA256(uploadPath); err != nil {
+			return fmt.Errorf("%w: failed to hash archive: %w", ErrUploadFailed, err)
+		}
+		obj.Metadata[archiveSHA256Metadata] = sum
+	}
+	uploadStarted := time.Now()
+	uploadCtx, cancelUpload := withStageDeadline(ctx, StageUpload, cfg.Timeouts.Upload)
+	uploaded, err := uploadFile(uploadCtx, cfg.Upload.Quorum, uploadPath, obj)
+	if err != nil {
+		err = fmt.Errorf("failed to upload backup: %w", err)
+	} else if sum != "" {
+		err = uploadChecksumSidecar(uploadCtx, cfg, uploaded, imagekey, sum)
+	}
+	err = stageError(uploadCtx, err)
+	cancelUpload()
+	recordStage(ctx, StageUpload, uploadStarted)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+
+	recordUpload(ctx, cfg, imagekey, checksum)
+	log.Info("backup uploaded", "key", imagekey)
+	reportUploaded(ctx, imagekey)
+
+	if cfg.Upload.LatestPointer != "" || cfg.Upload.LatestCopy != "" {
+		updateLatest(ctx, cfg, uploaded, uploadPath, obj, checksum)
+	}
+
+	if cfg.Manifest.Sidecar {
+		if err := uploadManifestSidecar(ctx, cfg, imagekey+".manifest.json"); err != nil {
+			return fmt.Errorf("%w: failed to upload manifest sidecar: %w", ErrUploadFailed, err)
+		}
+	}
+
+	var size int64
+	if info, err := os.Stat(uploadPath); err == nil {
+		size = info.Size()
+	}
+	postManifestWebhook(ctx, cfg, imagekey, checksum, size)
+	return nil
+}
+
+// recordUpload remembers the uploaded key for DEDUP_UPLOADS.
+func recordUpload(ctx context.Context, cfg Config, key, checksum string) {
+	if checksum == "" {
+		return
+	}
+	now := time.Now().UTC()
+	if err := writeUploadRecord(cfg, uploadRecord{Key: key, Checksum: checksum, UploadedAt: now, LastSeenAt: now}); err != nil {
+		LoggerFrom(ctx).Warn("failed to store upload record", "error", err)
+	}
+}
+
+// removeArchive deletes the local archive. A missing file is only logged.
+func removeArchive(ctx context.Context, archivePath string) error {
+	log := LoggerFrom(ctx)
+
+	// Attempt to remove the file
+	removeerr := os.Remove(archivePath)
+	if removeerr != nil {
+		// Handle the error, e.g., if the file doesn't exist or permissions are insufficient
+		if os.IsNotExist(removeerr) {
+			log.Warn("file not found", "path", archivePath)
+			return nil
+		}
+		return fmt.Errorf("%w: error removing file %s: %w", ErrCleanup, archivePath, removeerr)
+	}
+	log.Info("file removed", "path", archivePath)
+	return nil
+}
+
+func uploadManifestSidecar(ctx context.Context, cfg Config, key string) error {
+	_, err := uploadFile(ctx, cfg.Upload.Quorum, filepath.Join(cfg.OutputDir, manifestFileName), Object{Key: key, ContentType: "application/json"})
+	if err != nil {
+		return err
+	}
+
+	LoggerFrom(ctx).Info("manifest uploaded", "key", key)
+	return nil
+}
+
+func detectContentType(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	buffer := make([]byte, 512)
+	_, err = file.Read(buffer)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read from archive: %w", err)
+	}
+	return http.DetectContentType(buffer), nil
+}
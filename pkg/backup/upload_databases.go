@@ -0,0 +1,400 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runIndexFileName is the last object written into the folder of a
+// per-database run. A folder without it holds an incomplete run.
+const runIndexFileName = "index.json"
+
+// RunIndex lists the objects of a per-database run, stored as index.json
+// in the run's folder.
+type RunIndex struct {
+	CreatedAt   time.Time          `json:"created_at"`
+	Label       string             `json:"label,omitempty"`
+	AppVersion  string             `json:"app_version,omitempty"`
+	Cluster     string             `json:"cluster"`
+	ToolVersion string             `json:"tool_version"`
+	DumpVersion string             `json:"mongodump_version,omitempty"`
+	Format      string             `json:"format"`
+	Databases   []RunIndexDatabase `json:"databases"`
+	// Files are the other objects of the run, such as the manifest and
+	// the mongodump logs.
+	Files []string `json:"files,omitempty"`
+	// Failed lists the databases that were dumped but could not be
+	// uploaded. They are missing from the run.
+	Failed []RunIndexFailure `json:"failed,omitempty"`
+	// Dictionary is the key of the zstd dictionary the archives were
+	// compressed with, see ArchiveConfig.Dictionary.
+	Dictionary string `json:"dictionary,omitempty"`
+}
+
+// RunIndexFailure names a database left out of a run and why.
+type RunIndexFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// DatabaseUploadError reports the databases of a per-database run that
+// could not be uploaded. The other databases are stored, and the run's
+// index lists both.
+type DatabaseUploadError struct {
+	// Index is the key of the run index, empty when no database was
+	// uploaded and the run has no index.
+	Index  string
+	Failed map[string]error
+	Total  int
+}
+
+func (e *DatabaseUploadError) Error() string {
+	parts := make([]string, 0, len(e.Failed))
+	for _, db := range slices.Sorted(maps.Keys(e.Failed)) {
+		parts = append(parts, fmt.Sprintf("%s: %v", db, e.Failed[db]))
+	}
+	return fmt.Sprintf("%d of %d databases not uploaded (%s)", len(e.Failed), e.Total, strings.Join(parts, "; "))
+}
+
+// RunIndexDatabase is the archive of one database in a RunIndex, with
+// its size in bytes as uploaded.
+type RunIndexDatabase struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// isRunIndexKey reports whether key names the index of a per-database run.
+func isRunIndexKey(key string) bool {
+	return path.Base(key) == runIndexFileName
+}
+
+// uploadDatabases archives every database folder below cfg.OutputDir on
+// its own and uploads it to <run>/<db>.<ext>, cfg.Upload.Concurrency at a
+// time, followed by the loose files (manifest, mongodump logs) and finally
+// the run index, whose key it returns along with the total size of the
+// database archives. Databases that fail every attempt are left out; the
+// others stay uploaded and a *DatabaseUploadError lists the failures.
+func uploadDatabases(ctx context.Context, cfg Config, checksum string) (string, int64, error) {
+	run, err := newDatabaseRun(ctx, cfg, time.Now())
+	if err != nil {
+		return "", 0, err
+	}
+	defer run.close(ctx)
+
+	entries, err := os.ReadDir(cfg.OutputDir)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read backup folder: %w", err)
+	}
+	var dbs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			dbs = append(dbs, e.Name())
+		}
+	}
+	if cfg.Archive.Dictionary && cfg.Archive.Format == FormatTarZst {
+		run.useDictionary(ctx, dbs)
+	}
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for range max(cfg.Upload.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for db := range jobs {
+				run.uploadDatabase(ctx, db)
+			}
+		}()
+	}
+	for _, db := range dbs {
+		select {
+		case jobs <- db:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+
+	key, err := run.finish(ctx, checksum)
+	return key, run.size, err
+}
+
+// databaseRun uploads one per-database run. uploadDatabase may be called
+// concurrently; finish completes the run once every database is uploaded.
+type databaseRun struct {
+	cfg      Config
+	folder   string
+	prefix   string
+	ext      string
+	metadata map[string]string
+	comment  string
+
+	mu     sync.Mutex
+	index  RunIndex
+	size   int64
+	failed map[string]error
+}
+
+// newDatabaseRun starts a run taken at now. Archives are staged in a local
+// folder named like the run's folder, which close removes.
+func newDatabaseRun(ctx context.Context, cfg Config, now time.Time) (*databaseRun, error) {
+	folder := runName(now, cfg.Label)
+	r := &databaseRun{
+		cfg:      cfg,
+		folder:   folder,
+		prefix:   cfg.clusterKey(folder) + "/",
+		ext:      archiveExtension(cfg.Archive.Format),
+		metadata: map[string]string{},
+		failed:   map[string]error{},
+		index: RunIndex{
+			CreatedAt:   now.UTC(),
+			Label:       cfg.Label,
+			AppVersion:  cfg.AppVersion,
+			Cluster:     cfg.Mongo.ClusterURI,
+			ToolVersion: Version,
+			Format:      cfg.Archive.Format,
+		},
+	}
+	if cfg.Label != "" {
+		r.metadata[labelMetadata] = cfg.Label
+	}
+	if cfg.ClusterName != "" {
+		r.metadata[clusterMetadata] = cfg.ClusterName
+	}
+	if cfg.AppVersion != "" {
+		r.metadata[versionMetadata] = cfg.AppVersion
+	}
+	if cfg.Archive.Comment {
+		r.comment = archiveComment(ctx, cfg)
+	}
+	if err := os.MkdirAll(folder, cfg.DirMode()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// close removes the staging folder, or keeps it as the local copy of the
+// run with cfg.LocalArchive.Keep.
+func (r *databaseRun) close(ctx context.Context) {
+	if r.cfg.LocalArchive.Keep {
+		if err := keepLocalArchive(ctx, r.cfg, r.folder); err != nil {
+			LoggerFrom(ctx).Warn("failed to keep local archives", "path", r.folder, "error", err)
+		} else {
+			return
+		}
+	}
+	if err := os.RemoveAll(r.folder); err != nil {
+		LoggerFrom(ctx).Warn("failed to remove staging folder", "path", r.folder, "error", err)
+	}
+}
+
+// uploadDatabase archives the dump of db and uploads it to
+// <run>/<db>.<ext>, trying the upload up to cfg.Upload.DatabaseAttempts
+// times. A database that still fails is recorded for finish.
+func (r *databaseRun) uploadDatabase(ctx context.Context, db string) error {
+	err := r.tryUploadDatabase(ctx, db)
+	if err != nil {
+		LoggerFrom(ctx).Error("failed to upload database", "db", db, "error", err)
+		r.mu.Lock()
+		r.failed[db] = err
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (r *databaseRun) tryUploadDatabase(ctx context.Context, db string) error {
+	log := LoggerFrom(ctx)
+	cfg := r.cfg
+	archivePath := filepath.Join(r.folder, db+r.ext)
+	if !cfg.LocalArchive.Keep {
+		defer os.Remove(archivePath)
+	}
+	archiveStarted := time.Now()
+	archiveCtx, cancelArchive := withStageDeadline(ctx, StageArchive, cfg.Timeouts.Archive)
+	err := archiveFolder(archiveCtx, filepath.Join(cfg.OutputDir, db), archivePath, cfg.FileMode(), cfg.Archive, cfg.Encryption, r.comment)
+	err = stageError(archiveCtx, err)
+	cancelArchive()
+	recordStage(ctx, StageArchive, archiveStarted)
+	if err != nil {
+		os.Remove(archivePath)
+		return fmt.Errorf("failed to archive %s: %w", db, err)
+	}
+	contentType, err := archiveContentType(cfg.Archive.Format, archivePath)
+	if err != nil {
+		return err
+	}
+	uploadPath, sealedMetadata, err := sealArchive(ctx, cfg.Encryption, archivePath)
+	if err != nil {
+		return err
+	}
+	metadata := maps.Clone(r.metadata)
+	if uploadPath != archivePath {
+		defer os.Remove(uploadPath)
+	}
+	encoding := archiveContentEncoding(cfg.Archive.Format)
+	if sealedMetadata != nil {
+		contentType, encoding = "application/octet-stream", ""
+		maps.Copy(metadata, sealedMetadata)
+	}
+	key := r.prefix + db + r.ext
+	preUpload := preUploadArchive{Path: uploadPath, Key: key, Database: db, Encrypted: sealedMetadata != nil}
+	if err := runPreUploadCommand(ctx, cfg, preUpload); err != nil {
+		return err
+	}
+	info, err := os.Stat(uploadPath)
+	if err != nil {
+		return err
+	}
+	var sum string
+	if cfg.Upload.ChecksumSidecar {
+		if sum, err = fileSHA256(uploadPath); err != nil {
+			return err
+		}
+		metadata[archiveSHA256Metadata] = sum
+	}
+
+	disposition, cacheControl := downloadHeaders(cfg.Upload, key)
+	obj := Object{
+		Key:                key,
+		ContentType:        contentType,
+		ContentEncoding:    encoding,
+		ContentDisposition: disposition,
+		CacheControl:       cacheControl,
+		Metadata:           metadata,
+	}
+	// Every attempt gets the whole upload deadline: a stalled connection is
+	// what a retry is for
+	upload := func() error {
+		defer recordStage(ctx, StageUpload, time.Now())
+		uploadCtx, cancel := withStageDeadline(ctx, StageUpload, cfg.Timeouts.Upload)
+		defer cancel()
+		uploaded, err := uploadFile(uploadCtx, cfg.Upload.Quorum, uploadPath, obj)
+		if err == nil && sum != "" {
+			err = uploadChecksumSidecar(uploadCtx, cfg, uploaded, key, sum)
+		}
+		return stageError(uploadCtx, err)
+	}
+	attempts := max(cfg.Upload.DatabaseAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		if err = upload(); err == nil {
+			break
+		}
+		if attempt == attempts || ctx.Err() != nil {
+			return fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+		wait := cfg.Upload.Retry.delay(attempt)
+		log.Warn("database upload failed, retrying", "db", db, "key", key, "attempt", attempt, "wait", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.index.Databases = append(r.index.Databases, RunIndexDatabase{Name: db, Key: key, Size: info.Size()})
+	r.size += info.Size()
+	return nil
+}
+
+// finish uploads the loose files of cfg.OutputDir (manifest, mongodump
+// logs) and then the run index, and points the latest pointer at the
+// index. It returns the index key. When databases failed to upload, the
+// index lists them, the pointer stays on the last complete run and the
+// error is a *DatabaseUploadError; without any uploaded database there is
+// no index at all.
+func (r *databaseRun) finish(ctx context.Context, checksum string) (string, error) {
+	log := LoggerFrom(ctx)
+	cfg := r.cfg
+
+	var partial *DatabaseUploadError
+	if len(r.failed) > 0 {
+		partial = &DatabaseUploadError{Failed: r.failed, Total: len(r.failed) + len(r.index.Databases)}
+		if len(r.index.Databases) == 0 {
+			return "", partial
+		}
+		for _, db := range slices.Sorted(maps.Keys(r.failed)) {
+			r.index.Failed = append(r.index.Failed, RunIndexFailure{Name: db, Error: r.failed[db].Error()})
+		}
+	}
+	if m, err := readManifest(filepath.Join(cfg.OutputDir, manifestFileName)); err == nil {
+		r.index.DumpVersion = m.DumpVersion
+	}
+
+	entries, err := os.ReadDir(cfg.OutputDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read backup folder: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		key := r.prefix + e.Name()
+		contentType := "application/octet-stream"
+		switch {
+		case e.Name() == manifestFileName, strings.HasSuffix(e.Name(), indexSpecsSuffix):
+			contentType = "application/json"
+		case strings.HasSuffix(e.Name(), dumpLogSuffix), e.Name() == restorePowerShellScript:
+			contentType = "text/plain; charset=utf-8"
+		case e.Name() == restoreShellScript:
+			contentType = "text/x-shellscript"
+		}
+		source := filepath.Join(cfg.OutputDir, e.Name())
+		if _, err := uploadFile(ctx, cfg.Upload.Quorum, source, Object{Key: key, ContentType: contentType, Metadata: r.metadata}); err != nil {
+			return "", fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+		r.index.Files = append(r.index.Files, key)
+	}
+
+	// The index goes last: its presence marks the run as complete
+	slices.SortFunc(r.index.Databases, func(a, b RunIndexDatabase) int { return strings.Compare(a.Name, b.Name) })
+	data, err := json.MarshalIndent(r.index, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	indexPath := filepath.Join(r.folder, runIndexFileName)
+	if err := os.WriteFile(indexPath, data, cfg.FileMode()); err != nil {
+		return "", err
+	}
+	obj := Object{
+		Key:          r.prefix + runIndexFileName,
+		ContentType:  "application/json",
+		CacheControl: "no-cache",
+		Metadata:     maps.Clone(r.metadata),
+	}
+	if checksum != "" {
+		obj.Metadata[checksumMetadata] = checksum
+	}
+	uploaded, err := uploadFile(ctx, cfg.Upload.Quorum, indexPath, obj)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w", obj.Key, err)
+	}
+	log.Info("run index uploaded", "key", obj.Key, "databases", len(r.index.Databases), "failed", len(r.index.Failed))
+	if partial != nil {
+		partial.Index = obj.Key
+		return obj.Key, partial
+	}
+
+	if cfg.Upload.LatestPointer != "" {
+		// A per-database run has no single archive to keep a copy of, so
+		// only the pointer is updated; it names the index
+		latestCfg := cfg
+		latestCfg.Upload.LatestCopy = ""
+		updateLatest(ctx, latestCfg, uploaded, indexPath, obj, checksum)
+	}
+	return obj.Key, nil
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseCommand splits s into a command and its arguments, the way
+// ParseDumpArgs does. No shell is involved, so nothing is expanded; wrap
+// the command in sh -c for pipes or variables.
+func ParseCommand(s string) ([]string, error) {
+	args, err := splitShellWords(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 || args[0] == "" {
+		return nil, errors.New("no command given")
+	}
+	return args, nil
+}
+
+// preUploadArchive is an archive about to be uploaded, as described to
+// the pre-upload command.
+type preUploadArchive struct {
+	// Path is the file that is uploaded, the encrypted copy of an
+	// encrypted archive.
+	Path string
+	Key  string
+	// Database is set for the archives of a per-database run.
+	Database  string
+	Checksum  string
+	Encrypted bool
+}
+
+// runPreUploadCommand runs cfg.Upload.PreUploadCommand on the archive a,
+// with its path as the last argument and BACKUP_* environment variables
+// describing it. The command may change the file in place; what it leaves
+// is uploaded. When it exits non-zero the error carries the end of its
+// standard error, and the archive must not be uploaded.
+func runPreUploadCommand(ctx context.Context, cfg Config, a preUploadArchive) error {
+	command := cfg.Upload.PreUploadCommand
+	if len(command) == 0 {
+		return nil
+	}
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, command[0], append(command[1:len(command):len(command)], a.Path)...)
+	cmd.Env = append(os.Environ(),
+		"BACKUP_ARCHIVE_PATH="+a.Path,
+		"BACKUP_ARCHIVE_KEY="+a.Key,
+		"BACKUP_ARCHIVE_FORMAT="+cfg.Archive.Format,
+		"BACKUP_ARCHIVE_SIZE="+strconv.FormatInt(info.Size(), 10),
+		"BACKUP_ARCHIVE_ENCRYPTED="+strconv.FormatBool(a.Encrypted),
+		"BACKUP_CHECKSUM="+a.Checksum,
+		"BACKUP_DATABASE="+a.Database,
+		"BACKUP_LABEL="+cfg.Label,
+		"BACKUP_CLUSTER="+cfg.ClusterName,
+		"BACKUP_APP_VERSION="+cfg.AppVersion,
+	)
+	stderr := &outputTail{limit: 4 << 10}
+	cmd.Stdout = commandOutput(ctx)
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+
+	started := time.Now()
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("pre-upload command failed: %w: %s", err, msg)
+		}
+		return fmt.Errorf("pre-upload command failed: %w", err)
+	}
+	LoggerFrom(ctx).Info("pre-upload command succeeded", "key", a.Key, "duration", time.Since(started).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,149 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// uploadTestConfig returns a config whose dump folder holds one small
+// database, for an upload to the memory storages dests. The test runs in a
+// temporary working directory, where the archive is staged.
+func uploadTestConfig(t *testing.T, dests ...Storage) Config {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	UseStorages(dests...)
+	t.Cleanup(func() { UseStorages() })
+
+	cfg := DefaultConfig()
+	cfg.Upload.Retry = Backoff{Base: time.Millisecond, Max: time.Millisecond}
+	dump := filepath.Join(cfg.OutputDir, "orders", "orders")
+	if err := os.MkdirAll(dump, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dump, "items.bson"), []byte("documents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// assertNoArchive fails when an archive is left in the working directory
+// or the per-database staging folder is.
+func assertNoArchive(t *testing.T, cfg Config) {
+	t.Helper()
+	for _, path := range []string{archiveName(time.Now(), cfg.Label, cfg.Archive.Format), runName(time.Now(), cfg.Label)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind (stat error %v)", path, err)
+		}
+	}
+}
+
+func TestUploadToS3Succeeds(t *testing.T) {
+	mem := NewMemoryStorage()
+	cfg := uploadTestConfig(t, mem)
+
+	if err := UploadToS3(context.Background(), cfg); err != nil {
+		t.Fatalf("UploadToS3: %v", err)
+	}
+	key := archiveName(time.Now(), "", FormatZip)
+	if keys := mem.Keys(); !slices.Equal(keys, []string{"latest.json", key}) {
+		t.Errorf("stored keys = %v, want latest.json and %s", keys, key)
+	}
+	if len(mem.Data(key)) == 0 {
+		t.Errorf("%s is empty", key)
+	}
+	assertNoArchive(t, cfg)
+}
+
+func TestUploadToS3Fails(t *testing.T) {
+	mem := NewMemoryStorage()
+	cfg := uploadTestConfig(t, mem)
+	mem.FailNext(errors.New("destination unavailable"))
+
+	err := UploadToS3(context.Background(), cfg)
+	if !errors.Is(err, ErrUploadFailed) {
+		t.Fatalf("UploadToS3 = %v, want ErrUploadFailed", err)
+	}
+	if keys := mem.Keys(); len(keys) != 0 {
+		t.Errorf("stored keys = %v, want none", keys)
+	}
+	assertNoArchive(t, cfg)
+}
+
+func TestUploadToS3QuorumKeepsPartialSuccess(t *testing.T) {
+	good, bad := NewMemoryStorage(), NewMemoryStorage()
+	cfg := uploadTestConfig(t, good, bad)
+	cfg.Upload.Quorum = 1
+	bad.FailNext(errors.New("destination unavailable"))
+
+	if err := UploadToS3(context.Background(), cfg); err != nil {
+		t.Fatalf("UploadToS3: %v", err)
+	}
+	if keys := good.Keys(); !slices.Contains(keys, archiveName(time.Now(), "", FormatZip)) {
+		t.Errorf("stored keys = %v, want the archive", keys)
+	}
+	assertNoArchive(t, cfg)
+}
+
+func TestUploadDatabaseRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		attempts int
+		wantErr  bool
+	}{
+		{name: "first attempt", failures: 0, attempts: 3},
+		{name: "after a failure", failures: 2, attempts: 3},
+		{name: "every attempt fails", failures: 3, attempts: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := NewMemoryStorage()
+			cfg := uploadTestConfig(t, mem)
+			cfg.Archive.PerDatabase = true
+			cfg.Upload.DatabaseAttempts = tt.attempts
+			for range tt.failures {
+				mem.FailNext(errors.New("connection reset"))
+			}
+
+			err := UploadToS3(context.Background(), cfg)
+			var partial *DatabaseUploadError
+			if got := errors.As(err, &partial); got != tt.wantErr {
+				t.Fatalf("UploadToS3 = %v, want a DatabaseUploadError: %v", err, tt.wantErr)
+			}
+			key := cfg.clusterKey(runName(time.Now(), "")) + "/orders.zip"
+			if got := slices.Contains(mem.Keys(), key); got == tt.wantErr {
+				t.Errorf("%s stored = %v, keys %v", key, got, mem.Keys())
+			}
+			// Every failure is retried, and the index and pointer follow a
+			// stored database
+			want := min(tt.failures+1, tt.attempts)
+			if !tt.wantErr {
+				want += 2
+			}
+			if got := mem.Attempts(); got != want {
+				t.Errorf("Attempts() = %d, want %d", got, want)
+			}
+			assertNoArchive(t, cfg)
+		})
+	}
+}
+
+func TestCleanExportsFolderEmptiesIt(t *testing.T) {
+	cfg := uploadTestConfig(t, NewMemoryStorage())
+
+	if err := CleanExportsFolder(context.Background(), cfg); err != nil {
+		t.Fatalf("CleanExportsFolder: %v", err)
+	}
+	entries, err := os.ReadDir(cfg.OutputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%s still holds %d entries", cfg.OutputDir, len(entries))
+	}
+}
@@ -0,0 +1,34 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+)
+
+// StorageUsage is the space taken by backups on one destination.
+type StorageUsage struct {
+	Destination string
+	Objects     int64
+	Bytes       int64
+}
+
+// MeasureStorage lists the backup objects of cfg's cluster on every
+// destination and sums their sizes. Listing a large bucket takes one
+// request per 1000 objects, so callers should cache the result rather than
+// call it per request.
+func MeasureStorage(ctx context.Context, cfg Config) ([]StorageUsage, error) {
+	usage := make([]StorageUsage, 0, len(destinations))
+	for _, dest := range destinations {
+		u := StorageUsage{Destination: dest.Name()}
+		err := dest.List(ctx, cfg.clusterKey(archivePrefix), func(info ObjectInfo) error {
+			u.Objects++
+			u.Bytes += info.Size
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dest.Name(), err)
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
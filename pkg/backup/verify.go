@@ -0,0 +1,229 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// VerifyReport describes an archive checked by VerifyArchive.
+type VerifyReport struct {
+	Format string
+	// Files and Bytes count the regular files read and their size.
+	Files int
+	Bytes int64
+	// Info is the archive comment, nil when the archive has none.
+	Info *ArchiveInfo
+	// Manifest is the archive's manifest.json, nil when it has none, as
+	// the archives of a per-database run.
+	Manifest *Manifest
+	// Checksum is the content checksum DEDUP_UPLOADS stores as the
+	// content-sha256 metadata of an archive it uploads.
+	Checksum string
+	// Problems are the differences between the manifest and the archive.
+	Problems []string
+}
+
+// VerifyArchive reads every entry of the zip, tar.gz, tar.zst, tar.br or
+// tar at path to the end, so that CRC errors and truncation surface,
+// without extracting anything. When the archive holds a manifest, every database and
+// collection it lists must be in the archive. A non-empty checksum must
+// match the archive's content checksum. The report is returned even when
+// the archive fails, as far as it got; the error wraps ErrVerifyFailed.
+func VerifyArchive(path, checksum string) (VerifyReport, error) {
+	format, err := archiveFormatOf(path)
+	if err != nil {
+		return VerifyReport{}, fmt.Errorf("%w: %w", ErrVerifyFailed, err)
+	}
+	if sealed, err := fileIsSealed(path); err != nil {
+		return VerifyReport{Format: format}, fmt.Errorf("%w: %w", ErrVerifyFailed, err)
+	} else if sealed {
+		return VerifyReport{Format: format}, fmt.Errorf("%w: the archive is encrypted; only restore decrypts it", ErrVerifyFailed)
+	}
+	report := VerifyReport{Format: format}
+	if info, ok, err := ReadArchiveInfo(path); err == nil && ok {
+		report.Info = &info
+	}
+
+	h := sha256.New()
+	names := map[string]bool{}
+	visit := func(name string, r io.Reader) error {
+		name = strings.TrimPrefix(name, "./")
+		names[name] = true
+		var content io.Writer = io.Discard
+		var manifest strings.Builder
+		switch {
+		case name == manifestFileName:
+			content = &manifest
+		case !checksumExcluded(name):
+			io.WriteString(h, name)
+			h.Write([]byte{0})
+			content = h
+		}
+		n, err := io.Copy(content, r)
+		report.Files++
+		report.Bytes += n
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if name == manifestFileName {
+			var m Manifest
+			if err := json.Unmarshal([]byte(manifest.String()), &m); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("manifest.json is not valid: %v", err))
+			} else {
+				report.Manifest = &m
+			}
+		}
+		return nil
+	}
+
+	switch format {
+	case FormatZip:
+		err = verifyZip(path, visit)
+	default:
+		err = verifyTar(path, format, visit)
+	}
+	if err != nil {
+		return report, fmt.Errorf("%w: %w", ErrVerifyFailed, err)
+	}
+	report.Checksum = hex.EncodeToString(h.Sum(nil))
+
+	if report.Manifest != nil {
+		report.Problems = append(report.Problems, manifestProblems(*report.Manifest, names)...)
+	}
+	if checksum != "" && !strings.EqualFold(checksum, report.Checksum) {
+		report.Problems = append(report.Problems, fmt.Sprintf("content checksum is %s, expected %s", report.Checksum, checksum))
+	}
+	if len(report.Problems) > 0 {
+		return report, fmt.Errorf("%w: %s", ErrVerifyFailed, strings.Join(report.Problems, "; "))
+	}
+	return report, nil
+}
+
+func verifyZip(path string, visit func(name string, r io.Reader) error) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		// The zip reader checks the CRC-32 once the entry is read in full
+		src, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		err = visit(f.Name, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyTar(path, format string, visit func(name string, r io.Reader) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	switch format {
+	case FormatTarGz:
+		// gzip checks the CRC-32 and length of the stream at its end
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case FormatTarZst:
+		// zstd checks the content checksum of every frame
+		zr, err := newZstdReader(file, nil)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case FormatTarBr:
+		// brotli has no checksum; a truncated or corrupt stream still
+		// fails to decode
+		r = brotli.NewReader(file)
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := visit(header.Name, tr); err != nil {
+			return err
+		}
+	}
+	// Drain what follows the tar trailer so a truncated stream fails
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// manifestProblems lists the dumped databases and collections of m whose
+// files are missing from names, the files of an archive. mongodump writes
+// <db>/<db>/<collection>.bson, or .bson.gz with --gzip; a collection split
+// into parts has all of its numbered parts instead.
+func manifestProblems(m Manifest, names map[string]bool) []string {
+	folders := map[string]bool{}
+	for name := range names {
+		if i := strings.Index(name, "/"); i > 0 {
+			folders[name[:i]] = true
+		}
+	}
+
+	var problems []string
+	for _, db := range m.Databases {
+		if db.Error != "" || db.Unchanged {
+			continue
+		}
+		if !folders[db.Name] {
+			problems = append(problems, fmt.Sprintf("database %s is in the manifest but not in the archive", db.Name))
+			continue
+		}
+		var missing []string
+		for _, coll := range db.Collections {
+			file := path.Join(db.Name, db.Name, coll.Name+".bson")
+			if coll.Parts > 0 {
+				for n := 1; n <= coll.Parts; n++ {
+					if !names[splitPartName(file, n)] {
+						missing = append(missing, fmt.Sprintf("%s (part %d of %d)", coll.Name, n, coll.Parts))
+					}
+				}
+			} else if !names[file] && !names[file+".gz"] {
+				missing = append(missing, coll.Name)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			problems = append(problems, fmt.Sprintf("database %s is missing collections %s", db.Name, strings.Join(missing, ", ")))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,183 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// metadataSuffix marks the files mongodump writes next to every dumped
+// collection with its options and indexes. A view only gets this file.
+const metadataSuffix = ".metadata.json"
+
+// listViews returns the definitions of the views of db.
+func listViews(ctx context.Context, db *mongo.Database) ([]ViewManifest, error) {
+	cursor, err := db.ListCollections(ctx, bson.D{{Key: "type", Value: "view"}})
+	if err != nil {
+		return nil, err
+	}
+	var specs []struct {
+		Name    string `bson:"name"`
+		Options struct {
+			ViewOn   string     `bson:"viewOn"`
+			Pipeline []bson.Raw `bson:"pipeline"`
+		} `bson:"options"`
+	}
+	if err := cursor.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+
+	views := make([]ViewManifest, 0, len(specs))
+	for _, spec := range specs {
+		stages := make([]string, len(spec.Options.Pipeline))
+		for i, stage := range spec.Options.Pipeline {
+			data, err := bson.MarshalExtJSON(stage, false, false)
+			if err != nil {
+				return nil, fmt.Errorf("view %s: %w", spec.Name, err)
+			}
+			stages[i] = string(data)
+		}
+		views = append(views, ViewManifest{
+			Name:     spec.Name,
+			ViewOn:   spec.Options.ViewOn,
+			Pipeline: json.RawMessage("[" + strings.Join(stages, ",") + "]"),
+		})
+	}
+	slices.SortFunc(views, func(a, b ViewManifest) int { return strings.Compare(a.Name, b.Name) })
+	return views, nil
+}
+
+// viewsAsCollections reports whether args make mongodump dump views as
+// the collections of their documents instead of as views.
+func viewsAsCollections(args []string) bool {
+	return slices.ContainsFunc(args, func(arg string) bool {
+		return arg == "--viewsAsCollections" || strings.HasPrefix(arg, "--viewsAsCollections=")
+	})
+}
+
+// dumpedViews returns the views in the metadata files of a dumped
+// database, by name, with the collection they are defined on.
+func dumpedViews(dumpDir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dumpDir)
+	if err != nil {
+		return nil, err
+	}
+	views := map[string]string{}
+	for _, e := range entries {
+		escaped, ok := strings.CutSuffix(e.Name(), metadataSuffix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dumpDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var meta struct {
+			CollectionName string `json:"collectionName"`
+			Type           string `json:"type"`
+			Options        struct {
+				ViewOn string `json:"viewOn"`
+			} `json:"options"`
+		}
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		if meta.Options.ViewOn == "" {
+			continue
+		}
+		name := meta.CollectionName
+		if name == "" {
+			// Older mongodumps only name the collection by its file
+			if name, err = url.PathUnescape(escaped); err != nil {
+				name = escaped
+			}
+		}
+		views[name] = meta.Options.ViewOn
+	}
+	return views, nil
+}
+
+// verifyViews checks that every view of a dumped database is in the dump's
+// metadata, defined on the same collection, and logs a warning for those
+// that are not.
+func verifyViews(ctx context.Context, dumpDir, dbName string, views []ViewManifest) {
+	log := LoggerFrom(ctx)
+	dumped, err := dumpedViews(dumpDir)
+	if err != nil {
+		log.Warn("unable to verify views", "db", dbName, "error", err)
+		return
+	}
+	var problems []string
+	for _, v := range views {
+		viewOn, ok := dumped[v.Name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("view %s is not in the dump", v.Name))
+		case viewOn != v.ViewOn:
+			problems = append(problems, fmt.Sprintf("view %s is dumped on %s instead of %s", v.Name, viewOn, v.ViewOn))
+		}
+	}
+	if len(problems) > 0 {
+		log.Warn("views missing from the dump", "db", dbName, "problems", problems)
+		return
+	}
+	log.Info("views verified", "db", dbName, "views", len(views))
+}
+
+// missingViews lists the db.view namespaces of the views m recorded for
+// dbs that are not views on the server of client.
+func missingViews(ctx context.Context, client *mongo.Client, m Manifest, dbs []string) ([]string, error) {
+	if m.ViewsAsCollections {
+		return nil, nil
+	}
+	var missing []string
+	for _, db := range m.Databases {
+		if !slices.Contains(dbs, db.Name) || db.Unchanged || len(db.Views) == 0 {
+			continue
+		}
+		names, err := client.Database(db.Name).ListCollectionNames(ctx, bson.D{{Key: "type", Value: "view"}})
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range db.Views {
+			if !slices.Contains(names, v.Name) {
+				missing = append(missing, db.Name+"."+v.Name)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// confirmRestoredViews checks that the views the manifest in dumpDir
+// recorded for dbs were recreated on target. A backup without a manifest
+// is not checked, and a check that cannot reach the server is only logged.
+func confirmRestoredViews(ctx context.Context, target MongoConfig, dumpDir string, dbs []string) error {
+	log := LoggerFrom(ctx)
+	m, err := readManifest(filepath.Join(dumpDir, manifestFileName))
+	if err != nil {
+		return nil
+	}
+	client, err := connectCluster(ctx, target)
+	if err != nil {
+		log.Warn("unable to check the restored views", "error", err)
+		return nil
+	}
+	defer client.Disconnect(context.Background())
+	missing, err := missingViews(ctx, client, m, dbs)
+	if err != nil {
+		log.Warn("unable to check the restored views", "error", err)
+		return nil
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%d views missing after the restore: %s", len(missing), strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookAttempts is how often the manifest webhook is tried.
+	webhookAttempts = 3
+	// webhookTimeout bounds a single webhook request.
+	webhookTimeout = 30 * time.Second
+)
+
+// UploadReport is the body of the manifest webhook: the manifest of an
+// uploaded backup and where it was stored.
+type UploadReport struct {
+	Manifest
+	// Key is the archive, or the run index of a per-database run.
+	Key      string `json:"key"`
+	Format   string `json:"format"`
+	Checksum string `json:"checksum,omitempty"`
+	// Size is the number of archive bytes uploaded per destination.
+	Size int64 `json:"size"`
+}
+
+// postManifestWebhook sends the report of an upload to
+// cfg.Manifest.WebhookURL, retrying failed attempts. The backup is already
+// stored, so failures are only logged.
+func postManifestWebhook(ctx context.Context, cfg Config, key, checksum string, size int64) {
+	if cfg.Manifest.WebhookURL == "" {
+		return
+	}
+	log := LoggerFrom(ctx)
+
+	manifest, err := readManifest(filepath.Join(cfg.OutputDir, manifestFileName))
+	if err != nil {
+		log.Warn("manifest webhook skipped, unable to read manifest", "error", err)
+		return
+	}
+	// The dumps of a streamed run are deleted as they are uploaded, so
+	// there is no folder left to checksum
+	if checksum == "" && !cfg.Upload.Stream {
+		if checksum, err = contentChecksum(cfg.OutputDir); err != nil {
+			log.Warn("failed to checksum backup folder for the manifest webhook", "error", err)
+		}
+	}
+	body, err := json.Marshal(UploadReport{
+		Manifest: manifest,
+		Key:      key,
+		Format:   cfg.Archive.Format,
+		Checksum: checksum,
+		Size:     size,
+	})
+	if err != nil {
+		log.Warn("manifest webhook failed", "error", err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = sendWebhook(ctx, cfg.Manifest.WebhookURL, body)
+		if err == nil {
+			log.Info("manifest webhook delivered", "key", key, "attempts", attempt)
+			return
+		}
+		// The URL may carry a token, keep it out of the logs
+		msg := strings.ReplaceAll(err.Error(), cfg.Manifest.WebhookURL, "<webhook url>")
+		if attempt == webhookAttempts {
+			log.Warn("manifest webhook failed", "key", key, "attempts", attempt, "error", msg)
+			return
+		}
+		wait := time.Duration(attempt) * 2 * time.Second
+		log.Warn("manifest webhook attempt failed, retrying", "attempt", attempt, "retry_in", wait, "error", msg)
+		select {
+		case <-ctx.Done():
+			log.Warn("manifest webhook failed", "key", key, "attempts", attempt, "error", ctx.Err())
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func sendWebhook(ctx context.Context, url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
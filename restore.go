@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"mongodb_backup/pkg/backup"
+)
+
+// runRestore implements the restore subcommand and returns the exit code:
+//
+//	mongodb_backup restore [-key mongodb-dump-2024-06-01.zip | -archive - [-format tar.br]] [-db orders,users] [-drop] [-confirm cluster]
+//	mongodb_backup restore -db orders -collection items [-ns-to orders.items_restored]
+func runRestore(ctx context.Context, cfg appConfig, args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	key := fs.String("key", "", "archive to restore (default: the one named by the latest pointer)")
+	archive := fs.String("archive", "", "restore a local archive instead of downloading one; - reads it from stdin")
+	format := fs.String("format", "", "format of the -archive (default: detected from its first bytes, or a .tar.br name); needed for a tar.br on stdin")
+	dbs := fs.String("db", "", "comma-separated databases to restore (default: all in the archive)")
+	drop := fs.Bool("drop", cfg.Backup.Restore.Drop, "drop each collection before restoring it")
+	concurrency := fs.Int("concurrency", cfg.Backup.Restore.Concurrency, "databases restored in parallel")
+	confirm := fs.String("confirm", "", "cluster URI to confirm restoring into the cluster the backup was taken from")
+	collection := fs.String("collection", "", "only restore this collection of the one database given with -db")
+	nsTo := fs.String("ns-to", "", "restore the -collection under this db.collection namespace instead of its own")
+	if err := fs.Parse(args); err != nil {
+		return ExitConfigError
+	}
+	if *archive != "" && *key != "" {
+		log.Printf("Configuration error: -key and -archive are mutually exclusive")
+		return ExitConfigError
+	}
+	if *format != "" {
+		if *archive == "" {
+			log.Printf("Configuration error: -format needs -archive")
+			return ExitConfigError
+		}
+		if err := backup.CheckArchiveFormat(*format); err != nil {
+			log.Printf("Configuration error: invalid -format: %v", err)
+			return ExitConfigError
+		}
+	}
+
+	restoreCfg := cfg.Backup
+	restoreCfg.Restore.Drop = *drop
+	restoreCfg.Restore.Concurrency = *concurrency
+	restoreCfg.Restore.Confirm = *confirm
+
+	var databases []string
+	for _, db := range strings.Split(*dbs, ",") {
+		if db = strings.TrimSpace(db); db != "" {
+			databases = append(databases, db)
+		}
+	}
+	if *collection != "" && len(databases) != 1 {
+		log.Printf("Configuration error: -collection needs exactly one database in -db")
+		return ExitConfigError
+	}
+	if *nsTo != "" {
+		if *collection == "" {
+			log.Printf("Configuration error: -ns-to needs -collection")
+			return ExitConfigError
+		}
+		if db, coll, ok := strings.Cut(*nsTo, "."); !ok || db == "" || coll == "" || strings.Contains(*nsTo, "*") {
+			log.Printf("Configuration error: invalid -ns-to %q (expected db.collection)", *nsTo)
+			return ExitConfigError
+		}
+	}
+	restoreCfg.Restore.Collection = *collection
+	restoreCfg.Restore.RenameTo = *nsTo
+
+	runID := newRunID()
+	runLog := logger.With("run_id", runID)
+	ctx = backup.WithLogger(ctx, runLog)
+
+	entry := commandAudit("restore")
+	entry.RunID, entry.Key, entry.Databases = runID, *key, databases
+	if *collection != "" {
+		entry.Databases = []string{databases[0] + "." + *collection}
+	}
+	if *archive != "" {
+		entry.Key = *archive
+	}
+
+	// Local archives only need the storage to keep the audit trail, and
+	// the AWS clients to decrypt an archive encrypted through KMS
+	if *archive == "" || cfg.Backup.AuditPrefix != "" {
+		if err := initStorage(ctx, cfg, false); err != nil {
+			log.Printf("Configuration error: %v", err)
+			return ExitConfigError
+		}
+	} else if err := backup.InitializeS3Client(ctx, cfg.Backup.AWS); err != nil {
+		log.Printf("Configuration error: %v", err)
+		return ExitConfigError
+	}
+	entry.Outcome = "started"
+	audit(ctx, cfg, entry)
+
+	var err error
+	switch *archive {
+	case "":
+		err = backup.RestoreFromS3(ctx, restoreCfg, *key, databases)
+	case "-":
+		err = backup.RestoreFromReader(ctx, restoreCfg, os.Stdin, "", *format, databases)
+	default:
+		file, openErr := os.Open(*archive)
+		if openErr != nil {
+			log.Printf("Configuration error: %v", openErr)
+			return ExitConfigError
+		}
+		defer file.Close()
+		err = backup.RestoreFromReader(ctx, restoreCfg, file, *archive, *format, databases)
+	}
+	entry.Outcome = "succeeded"
+	if err != nil {
+		entry.Outcome, entry.Error = "failed", err.Error()
+		runLog.Error("restore failed", "error", err)
+	}
+	audit(ctx, cfg, entry)
+	return exitCode(err)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"mongodb_backup/pkg/backup"
+)
+
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+func newRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UTC().Format("150405.000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// RunInfo describes a single backup run as reported by /status.
+type RunInfo struct {
+	ID         string     `json:"id"`
+	Trigger    string     `json:"trigger"`
+	Label      string     `json:"label,omitempty"`
+	AppVersion string     `json:"app_version,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	// Progress is updated live while the databases are dumped
+	Progress *backup.Progress `json:"progress,omitempty"`
+	// Suspicious marks a run whose backup was uploaded although its size
+	// is far from the recent average, described by SizeAnomaly.
+	Suspicious  bool                `json:"suspicious,omitempty"`
+	SizeAnomaly *backup.SizeAnomaly `json:"size_anomaly,omitempty"`
+	// RestoreCheck is the restore of the uploaded backup into an
+	// ephemeral mongod, with VERIFY_WITH_EPHEMERAL_MONGO.
+	RestoreCheck *backup.RestoreCheck `json:"restore_check,omitempty"`
+	// StageSeconds is how long each stage (connect, dump, archive,
+	// upload) took so far, failed or not.
+	StageSeconds map[string]float64 `json:"stage_seconds,omitempty"`
+}
+
+type runStatus struct {
+	mu      sync.Mutex
+	current *RunInfo
+	last    *RunInfo
+	// lastSuccess is when the last successful run finished, or when the
+	// backup seeded at startup was created.
+	lastSuccess time.Time
+}
+
+var status = &runStatus{}
+
+func (s *runStatus) start(id, trigger, label, appVersion string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = &RunInfo{ID: id, Trigger: trigger, Label: label, AppVersion: appVersion, StartedAt: time.Now().UTC()}
+}
+
+// setProgress records the dump progress of run id.
+func (s *runStatus) setProgress(id string, p backup.Progress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil || s.current.ID != id {
+		return
+	}
+	s.current.Progress = &p
+}
+
+// markSuspicious records the size anomaly of run id.
+func (s *runStatus) markSuspicious(id string, anomaly backup.SizeAnomaly) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil || s.current.ID != id {
+		return
+	}
+	s.current.Suspicious, s.current.SizeAnomaly = true, &anomaly
+}
+
+// setRestoreCheck records the restore check of run id.
+func (s *runStatus) setRestoreCheck(id string, check backup.RestoreCheck) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil || s.current.ID != id {
+		return
+	}
+	s.current.RestoreCheck = &check
+}
+
+// addStageTime adds d to the time run id spent in stage.
+func (s *runStatus) addStageTime(id, stage string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil || s.current.ID != id {
+		return
+	}
+	if s.current.StageSeconds == nil {
+		s.current.StageSeconds = map[string]float64{}
+	}
+	s.current.StageSeconds[stage] += d.Seconds()
+}
+
+func (s *runStatus) finish(id string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil || s.current.ID != id {
+		return
+	}
+	finished := time.Now().UTC()
+	s.current.FinishedAt = &finished
+	if err != nil {
+		s.current.Error = err.Error()
+	} else {
+		s.lastSuccess = finished
+		lastSuccessTimestamp.Set(float64(finished.Unix()))
+	}
+	s.last, s.current = s.current, nil
+}
+
+// seedLastSuccess records t, the creation time of a backup uploaded before
+// the service started, unless a run has already succeeded.
+func (s *runStatus) seedLastSuccess(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastSuccess.IsZero() {
+		s.lastSuccess = t
+		lastSuccessTimestamp.Set(float64(t.Unix()))
+	}
+}
+
+func (s *runStatus) lastSuccessAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSuccess
+}
+
+func (s *runStatus) snapshot() (current, last *RunInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil {
+		c := *s.current
+		current = &c
+	}
+	if s.last != nil {
+		l := *s.last
+		last = &l
+	}
+	return current, last
+}
+
+// checkSizeAnomaly reports the size anomaly BackUp recorded in the manifest
+// of run id, if any, in /status and the metrics.
+func checkSizeAnomaly(id string, cfg backup.Config) {
+	if cfg.Manifest.SizeDeviation <= 0 {
+		return
+	}
+	m, err := backup.ReadManifest(cfg)
+	if err != nil {
+		return
+	}
+	if m.SizeAnomaly == nil {
+		lastBackupSuspicious.Set(0)
+		return
+	}
+	sizeAnomalies.Inc()
+	lastBackupSuspicious.Set(1)
+	status.markSuspicious(id, *m.SizeAnomaly)
+}
+
+// checkRestore restores key, the backup run id uploaded, into an ephemeral
+// mongod and reports the outcome in /status and the metrics. A backup that
+// does not restore fails the run; a server that cannot be started only
+// skips the check.
+func checkRestore(ctx context.Context, id string, cfg backup.Config, key string) error {
+	log := backup.LoggerFrom(ctx)
+	check, err := backup.VerifyRestore(ctx, cfg, key)
+	if errors.Is(err, backup.ErrEphemeralMongo) {
+		log.Warn("restore check skipped", "key", key, "error", err)
+		return nil
+	}
+	status.setRestoreCheck(id, check)
+	restoreCheckDuration.Set(check.DurationSeconds)
+	if err != nil {
+		lastRestoreCheckPassed.Set(0)
+		return err
+	}
+	lastRestoreCheckPassed.Set(1)
+	return nil
+}
+
+// recordCatalog writes run id, as it finished with err, to the catalog
+// collection. key is the uploaded backup and m the run's manifest, either
+// of which may be missing. A failure is only logged.
+func recordCatalog(ctx context.Context, cfg backup.Config, id, trigger string, started time.Time, key string, m *backup.Manifest, err error) {
+	if cfg.Catalog.Collection == "" {
+		return
+	}
+	entry := backup.NewCatalogEntry(ctx, cfg, key, m)
+	entry.RunID, entry.Trigger, entry.Label = id, trigger, cfg.Label
+	entry.StartedAt, entry.FinishedAt = started, time.Now().UTC()
+	entry.Status = backup.CatalogSucceeded
+	if err != nil {
+		entry.Status, entry.Error = backup.CatalogFailed, err.Error()
+	}
+	// The run may have been cancelled, the entry is still worth writing
+	if storeErr := backup.StoreCatalogEntry(context.WithoutCancel(ctx), cfg, entry); storeErr != nil {
+		backup.LoggerFrom(ctx).Warn("failed to store catalog entry", "collection", cfg.Catalog.Collection, "error", storeErr)
+	}
+}
+
+// stageTimingAttrs lists the stage durations in the order the stages run,
+// for the log.
+func stageTimingAttrs(stages map[string]time.Duration) []any {
+	var attrs []any
+	for _, stage := range backup.Stages {
+		if d, ok := stages[stage]; ok {
+			attrs = append(attrs, stage, d.Round(time.Millisecond).String())
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+var cronLogger = cron.PrintfLogger(log.New(os.Stdout, "cron: ", log.LstdFlags))
+
+// countPanics counts a panicking job in backup_job_panics_total and panics
+// on, so that cron.Recover, wrapped around it, logs it with its stack.
+func countPanics(job cron.Job) cron.Job {
+	return cron.FuncJob(func() {
+		defer func() {
+			if r := recover(); r != nil {
+				jobPanics.Inc()
+				panic(r)
+			}
+		}()
+		job.Run()
+	})
+}
+
+// runSlot is held by the one backup that may run at a time, whatever
+// started it: the schedule, POST /backup or -once. All of them share the
+// dump folder and the local archive, so two runs must never overlap.
+var runSlot = make(chan struct{}, 1)
+
+// tryAcquireRun takes the run slot if it is free.
+func tryAcquireRun() bool {
+	select {
+	case runSlot <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquireRun waits for the run slot. It returns false if ctx is done first.
+func acquireRun(ctx context.Context) bool {
+	select {
+	case runSlot <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func releaseRun() {
+	<-runSlot
+}
+
+// acquireScheduledRun applies OVERLAP_POLICY to a scheduled run: "skip"
+// (the default) drops it while another run is going, "delay" waits for
+// that run to finish.
+func acquireScheduledRun(ctx context.Context, policy string) bool {
+	if policy == "delay" {
+		return acquireRun(ctx)
+	}
+	return tryAcquireRun()
+}
+
+func validateOverlapPolicy(policy string) error {
+	switch policy {
+	case "skip", "delay":
+		return nil
+	default:
+		return fmt.Errorf("invalid OVERLAP_POLICY %q (expected skip or delay)", policy)
+	}
+}
+
+// schedulerControl pauses scheduled runs during maintenance windows. While
+// paused, the cron entry stays registered but its runs are skipped (not
+// queued); manual runs through POST /backup are not affected.
+type schedulerControl struct {
+	mu          sync.Mutex
+	paused      bool
+	pausedSince time.Time
+	skipped     int
+
+	cron  *cron.Cron
+	entry cron.EntryID
+}
+
+// SchedulerStatus is reported under "scheduler" by GET /status.
+type SchedulerStatus struct {
+	Paused      bool       `json:"paused"`
+	PausedSince *time.Time `json:"paused_since,omitempty"`
+	// SkippedRuns counts scheduled runs skipped during the current pause
+	SkippedRuns int        `json:"skipped_runs,omitempty"`
+	NextRun     *time.Time `json:"next_run,omitempty"`
+}
+
+var scheduler = &schedulerControl{}
+
+// setPaused pauses or resumes the schedule and reports whether the state
+// changed.
+func (s *schedulerControl) setPaused(paused bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.paused == paused {
+		return false
+	}
+	s.paused = paused
+	s.skipped = 0
+	if paused {
+		s.pausedSince = time.Now().UTC()
+	}
+	return true
+}
+
+// allowRun is checked by the scheduled job before it starts.
+func (s *schedulerControl) allowRun() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.paused {
+		s.skipped++
+		return false
+	}
+	return true
+}
+
+func (s *schedulerControl) snapshot() SchedulerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := SchedulerStatus{Paused: s.paused, SkippedRuns: s.skipped}
+	if s.paused {
+		since := s.pausedSince
+		st.PausedSince = &since
+	} else if s.cron != nil {
+		if next := s.cron.Entry(s.entry).Next; !next.IsZero() {
+			st.NextRun = &next
+		}
+	}
+	return st
+}
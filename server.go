@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"mongodb_backup/pkg/backup"
+)
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func registerHandlers(ctx context.Context, cfg appConfig) {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "MongoDB Backup service is up...")
+	})
+
+	http.Handle("GET /metrics", promhttp.Handler())
+
+	// Liveness, and with MAX_BACKUP_AGE a staleness probe: 503 once the
+	// last successful backup is older than that
+	http.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		code, health := checkBackupHealth(cfg.MaxBackupAge, time.Now())
+		writeJSON(w, code, health)
+	})
+
+	http.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		current, last := status.snapshot()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"running":       current != nil,
+			"current":       current,
+			"last_run":      last,
+			"mongo_breaker": mongoBreaker.snapshot(),
+			"scheduler":     scheduler.snapshot(),
+		})
+	})
+
+	// List the stored archives, oldest first. ?check=checksums matches
+	// each with its .sha256 sidecar and reports orphans and mismatches.
+	http.HandleFunc("GET /backups", func(w http.ResponseWriter, r *http.Request) {
+		check := r.URL.Query().Get("check")
+		if check != "" && check != "checksums" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown check " + check + " (expected checksums)"})
+			return
+		}
+		backups, err := backup.ListBackups(r.Context(), cfg.Backup, check == "checksums")
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		resp := map[string]any{"backups": backups}
+		if check == "checksums" {
+			problems := map[string]int{}
+			for _, b := range backups {
+				if b.Checksum != backup.ChecksumOK {
+					problems[b.Checksum]++
+				}
+			}
+			resp["problems"] = problems
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	// Start an on-demand backup in the background and return its run ID. An
+	// optional JSON body {"label": "pre-migration-v2"} labels the backup.
+	http.HandleFunc("POST /backup", func(w http.ResponseWriter, r *http.Request) {
+		entry := requestAudit(r, cfg, "backup.trigger")
+		reject := func(code int, body map[string]string) {
+			entry.Outcome, entry.Error = "rejected", body["error"]
+			audit(r.Context(), cfg, entry)
+			writeJSON(w, code, body)
+		}
+
+		var req struct {
+			Label string `json:"label"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			reject(http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+			return
+		}
+		entry.Label = req.Label
+		runCfg := cfg.Backup
+		if req.Label != "" {
+			if err := backup.ValidateLabel(req.Label); err != nil {
+				reject(http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			runCfg.Label = req.Label
+		}
+
+		if !tryAcquireRun() {
+			body := map[string]string{"error": "a backup is already running"}
+			if current, _ := status.snapshot(); current != nil {
+				body["run_id"] = current.ID
+			}
+			reject(http.StatusConflict, body)
+			return
+		}
+		runID := newRunID()
+		entry.RunID, entry.Outcome = runID, "accepted"
+		audit(r.Context(), cfg, entry)
+		go func() {
+			defer releaseRun()
+			// A panicking run is logged and counted like a scheduled one,
+			// instead of taking the whole service down
+			defer func() {
+				if r := recover(); r != nil {
+					jobPanics.Inc()
+					logger.Error("backup run panicked", "run_id", runID, "panic", r, "stack", string(debug.Stack()))
+				}
+			}()
+			if err := runBackupJob(ctx, runCfg, runID, "manual"); err != nil {
+				logger.Error("backup run failed", "run_id", runID, "error", err)
+			}
+		}()
+		resp := map[string]string{"run_id": runID}
+		if runCfg.Label != "" {
+			resp["label"] = runCfg.Label
+		}
+		writeJSON(w, http.StatusAccepted, resp)
+	})
+
+	// Pause or resume scheduled runs, e.g. around a maintenance window
+	http.HandleFunc("POST /scheduler/pause", func(w http.ResponseWriter, r *http.Request) {
+		entry := requestAudit(r, cfg, "scheduler.pause")
+		entry.Outcome = "unchanged"
+		if scheduler.setPaused(true) {
+			entry.Outcome = "succeeded"
+			logger.Warn("scheduler paused, scheduled backups will be skipped")
+		}
+		audit(r.Context(), cfg, entry)
+		writeJSON(w, http.StatusOK, scheduler.snapshot())
+	})
+	http.HandleFunc("POST /scheduler/resume", func(w http.ResponseWriter, r *http.Request) {
+		entry := requestAudit(r, cfg, "scheduler.resume")
+		entry.Outcome = "unchanged"
+		if scheduler.setPaused(false) {
+			entry.Outcome = "succeeded"
+			logger.Info("scheduler resumed")
+		}
+		audit(r.Context(), cfg, entry)
+		writeJSON(w, http.StatusOK, scheduler.snapshot())
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"mongodb_backup/pkg/backup"
+)
+
+// tracingShutdownTimeout bounds flushing the spans still buffered at exit.
+const tracingShutdownTimeout = 5 * time.Second
+
+// tracer records the run span the package's stage spans are children of.
+var tracer = otel.Tracer("mongodb_backup")
+
+// startTracing exports spans over OTLP/HTTP to cfg.TracingEndpoint, a base
+// URL such as http://collector:4318 that /v1/traces is added to. Without an
+// endpoint nothing is traced. The returned function flushes the spans still
+// buffered; it must run before the process exits.
+func startTracing(ctx context.Context, cfg appConfig) (func(), error) {
+	if cfg.TracingEndpoint == "" {
+		return func() {}, nil
+	}
+	// Headers, TLS and timeouts come from the standard OTEL_EXPORTER_OTLP_*
+	// variables, which the exporter reads itself
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(cfg.TracingEndpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", cfg.TracingServiceName),
+			attribute.String("service.version", backup.Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warn("trace export failed", "error", err)
+	}))
+	logger.Info("tracing enabled", "endpoint", cfg.TracingEndpoint, "service", cfg.TracingServiceName)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logger.Warn("failed to flush traces", "error", err)
+		}
+	}, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"mongodb_backup/pkg/backup"
+)
+
+// runUploadArchive implements the upload-archive subcommand, which backs up
+// a mongodump --archive file written elsewhere instead of dumping the
+// cluster. The file is archived, encrypted, uploaded and followed by the
+// retention sweep like a -once backup. It returns the exit code:
+//
+//	mongodb_backup upload-archive [-label pre-migration] /mnt/dumps/orders.archive
+func runUploadArchive(ctx context.Context, cfg backup.Config, args []string) int {
+	fs := flag.NewFlagSet("upload-archive", flag.ContinueOnError)
+	label := fs.String("label", "", "label for the backup, added to its key and exempt from retention")
+	if err := fs.Parse(args); err != nil {
+		return ExitConfigError
+	}
+	if fs.NArg() != 1 {
+		log.Printf("Configuration error: upload-archive needs the path of one mongodump archive")
+		return ExitConfigError
+	}
+	if *label != "" {
+		if err := backup.ValidateLabel(*label); err != nil {
+			log.Printf("Configuration error: %v", err)
+			return ExitConfigError
+		}
+		cfg.Label = *label
+	}
+	cfg.ExternalArchive = fs.Arg(0)
+
+	// The archive is one file, with no database folders to archive one by
+	// one or to restore into an ephemeral server
+	if cfg.Archive.PerDatabase {
+		logger.Warn("ARCHIVE_PER_DATABASE does not apply to upload-archive, uploading a single archive")
+		cfg.Archive.PerDatabase = false
+	}
+	if cfg.RestoreCheck.Enabled {
+		logger.Warn("VERIFY_WITH_EPHEMERAL_MONGO does not apply to upload-archive, skipping the restore check")
+		cfg.RestoreCheck.Enabled = false
+	}
+
+	runID := newRunID()
+	err := runBackupJob(ctx, cfg, runID, "upload-archive")
+	if err != nil {
+		logger.Error("backup run failed", "run_id", runID, "error", err)
+	}
+	return exitCode(err)
+}
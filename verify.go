@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"mongodb_backup/pkg/backup"
+)
+
+// runVerify implements the verify subcommand, which reads a local archive
+// in full without restoring it, prints what it found and returns the exit
+// code:
+//
+//	mongodb_backup verify [-checksum sha256] mongodb-dump-2024-06-01.zip
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	checksum := fs.String("checksum", "", "expected content checksum, the content-sha256 metadata of an uploaded archive")
+	if err := fs.Parse(args); err != nil {
+		return ExitConfigError
+	}
+	if fs.NArg() != 1 {
+		log.Printf("Configuration error: verify needs the path of one archive")
+		return ExitConfigError
+	}
+	path := fs.Arg(0)
+
+	report, err := backup.VerifyArchive(path, *checksum)
+	fmt.Printf("archive:  %s (%s)\n", filepath.Base(path), report.Format)
+	fmt.Printf("files:    %d, %d bytes read\n", report.Files, report.Bytes)
+	if info := report.Info; info != nil {
+		fmt.Printf("created:  %s from %s, tool version %s\n", info.CreatedAt.Format("2006-01-02 15:04:05 MST"), info.Cluster, info.ToolVersion)
+	}
+	if m := report.Manifest; m != nil {
+		collections := 0
+		for _, db := range m.Databases {
+			collections += len(db.Collections)
+		}
+		fmt.Printf("manifest: %d databases, %d collections\n", len(m.Databases), collections)
+	}
+	if report.Checksum != "" {
+		fmt.Printf("checksum: %s\n", report.Checksum)
+	}
+	for _, problem := range report.Problems {
+		fmt.Printf("problem:  %s\n", problem)
+	}
+	if err != nil {
+		if len(report.Problems) > 0 {
+			fmt.Println("FAIL")
+		} else {
+			fmt.Printf("FAIL: %v\n", err)
+		}
+		return exitCode(err)
+	}
+	fmt.Println("PASS")
+	return ExitOK
+}